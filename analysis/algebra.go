@@ -0,0 +1,254 @@
+// ProfileSet algebra: operations building a new ProfileSet from others, to
+// combine per-worker files, drop warmup samples, compare two runs or zoom on
+// a subsystem. They never modify their operands. Expectations can apply some
+// of them per profile type (see Transform), and prof-dump exposes them as
+// flags.
+package analysis
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+// derive returns a ProfileSet with the facts, durations and profile types of
+// ps, but no samples. Types stay present even if no sample is added, so
+// assertions on them fail rather than error.
+func (ps *ProfileSet) derive() *ProfileSet {
+	out := newProfileSet()
+	maps.Copy(out.facts, ps.facts)
+	for t, a := range ps.dur {
+		agg := *a
+		out.dur[t] = &agg
+	}
+	for _, t := range ps.order {
+		out.order = append(out.order, t)
+		out.typed[t] = &sampleColumns{}
+	}
+	return out
+}
+
+// each calls fn for every sample of every type of ps, in type order.
+func (ps *ProfileSet) each(fn func(profileType string, ss StackSample)) {
+	for _, t := range ps.order {
+		for ss := range ps.All(t) {
+			fn(t, ss)
+		}
+	}
+}
+
+// add appends a sample to ps, interning its stack and labels. Label sets
+// come from interned maps, so they are already sorted.
+func (ps *ProfileSet) add(profileType string, ss StackSample) {
+	ps.addSample(profileType, ps.internStack(ss.Stack), ps.internLabels(ss.Labels), ss.Val)
+}
+
+// fill adds the samples of src that fn keeps, as fn returns them, and
+// returns ps finalized.
+func (ps *ProfileSet) fill(src *ProfileSet, fn func(profileType string, ss StackSample) (StackSample, bool)) *ProfileSet {
+	src.each(func(t string, ss StackSample) {
+		if ss, ok := fn(t, ss); ok {
+			ps.add(t, ss)
+		}
+	})
+	return ps.finalize()
+}
+
+// Merge returns the samples of every set in one ProfileSet, e.g. to assert on
+// per-worker files as a whole. Per-type durations are aggregated as for the
+// profiles of a single file, so total/Duration is the aggregate rate. The
+// first set with a fact sets its value.
+func Merge(sets ...*ProfileSet) *ProfileSet {
+	out := newProfileSet()
+	for _, ps := range sets {
+		for k, v := range ps.facts {
+			out.addFact(k, v)
+		}
+		for t, a := range ps.dur {
+			agg := out.dur[t]
+			if agg == nil {
+				agg = &durAgg{}
+				out.dur[t] = agg
+			}
+			agg.valueSum += a.valueSum
+			agg.rateSum += a.rateSum
+		}
+		ps.each(out.add)
+	}
+	return out.finalize()
+}
+
+// Filter returns the samples keep accepts. Durations are kept: dropping
+// samples does not change how long the profile lasted.
+func (ps *ProfileSet) Filter(keep func(profileType string, s StackSample) bool) *ProfileSet {
+	return ps.derive().fill(ps, func(t string, ss StackSample) (StackSample, bool) {
+		return ss, keep(t, ss)
+	})
+}
+
+// Scale returns the samples with their values multiplied by factor, rounded
+// to the nearest integer. Durations are kept.
+func (ps *ProfileSet) Scale(factor float64) *ProfileSet {
+	return ps.derive().fill(ps, func(_ string, ss StackSample) (StackSample, bool) {
+		ss.Val = int64(math.Round(float64(ss.Val) * factor))
+		return ss, true
+	})
+}
+
+// Subtract returns, for every profile type, stack and label set, the value
+// in ps minus the value in other, keeping the non-zero differences: positive
+// where ps has more. Types only in other are included, negated. The result
+// has the durations and facts of ps.
+func (ps *ProfileSet) Subtract(other *ProfileSet) *ProfileSet {
+	type key struct {
+		profileType, stack, labels string
+	}
+	var order []key
+	diff := map[key]int64{}
+	labels := map[key]map[string][]string{}
+	add := func(t string, ss StackSample, sign int64) {
+		k := key{t, ss.Stack, labelSetKey(ss.Labels)}
+		if _, ok := diff[k]; !ok {
+			order = append(order, k)
+			labels[k] = ss.Labels
+		}
+		diff[k] += sign * ss.Val
+	}
+	ps.each(func(t string, ss StackSample) { add(t, ss, 1) })
+	other.each(func(t string, ss StackSample) { add(t, ss, -1) })
+
+	out := ps.derive()
+	for _, k := range order {
+		if v := diff[k]; v != 0 {
+			out.add(k.profileType, StackSample{Stack: k.stack, Val: v, Labels: labels[k]})
+		}
+	}
+	return out.finalize()
+}
+
+// GroupBy splits the samples by the values of a label, e.g. "thread name":
+// each group holds the samples whose label values, joined with ",", are its
+// key. Samples without the label are grouped under "". Each group keeps the
+// durations and facts of ps.
+func (ps *ProfileSet) GroupBy(key string) map[string]*ProfileSet {
+	groups := map[string]*ProfileSet{}
+	ps.each(func(t string, ss StackSample) {
+		value := strings.Join(ss.Labels[key], ",")
+		g := groups[value]
+		if g == nil {
+			g = ps.derive()
+			groups[value] = g
+		}
+		g.add(t, ss)
+	})
+	for _, g := range groups {
+		g.finalize()
+	}
+	return groups
+}
+
+// FocusOn returns the samples whose stack contains frame, re-rooted at its
+// outermost occurrence: "main;handle;parse" focused on "handle" becomes
+// "handle;parse". Durations are kept.
+func (ps *ProfileSet) FocusOn(frame string) *ProfileSet {
+	return ps.refold(func(frames []string) ([]string, bool) {
+		i := slices.Index(frames, frame)
+		return frames[max(i, 0):], i >= 0
+	})
+}
+
+// refold returns the samples fn keeps, with the stacks it returns. Each
+// distinct stack is refolded once.
+func (ps *ProfileSet) refold(fn func(frames []string) ([]string, bool)) *ProfileSet {
+	type folded struct {
+		stack string
+		keep  bool
+	}
+	memo := map[string]folded{}
+	return ps.derive().fill(ps, func(_ string, ss StackSample) (StackSample, bool) {
+		f, ok := memo[ss.Stack]
+		if !ok {
+			frames, keep := fn(strings.Split(ss.Stack, ";"))
+			f = folded{strings.Join(frames, ";"), keep}
+			memo[ss.Stack] = f
+		}
+		ss.Stack = f.stack
+		return ss, f.keep
+	})
+}
+
+// only returns the samples of a single profile type.
+func (ps *ProfileSet) only(profileType string) *ProfileSet {
+	out := newProfileSet()
+	maps.Copy(out.facts, ps.facts)
+	if a := ps.dur[profileType]; a != nil {
+		agg := *a
+		out.dur[profileType] = &agg
+	}
+	if !ps.Has(profileType) {
+		return out
+	}
+	out.typed[profileType] = &sampleColumns{}
+	out.order = []string{profileType}
+	for ss := range ps.All(profileType) {
+		out.add(profileType, ss)
+	}
+	return out.finalize()
+}
+
+// Transform is applied to the profile before the assertions of a profile
+// type, in field order.
+type Transform struct {
+	// Merge asserts once on all the files the profile type matches, merged,
+	// rather than on each of them.
+	Merge bool `json:"merge,omitempty"`
+	// Filter keeps only the samples it matches.
+	Filter *SampleFilter `json:"filter,omitempty"`
+	// Exclude drops the samples it matches, e.g. warmup.
+	Exclude *SampleFilter `json:"exclude,omitempty"`
+	// Focus keeps the samples with this frame, re-rooted at it (see FocusOn).
+	Focus string `json:"focus,omitempty"`
+	// Scale multiplies the values (see Scale); 0 leaves them unchanged.
+	Scale float64 `json:"scale,omitempty"`
+}
+
+// SampleFilter matches samples whose folded stack matches RegularExpression
+// (any stack if empty) and whose labels satisfy Labels, as for a stack
+// content.
+type SampleFilter struct {
+	RegularExpression string   `json:"regular_expression,omitempty"`
+	Labels            []Labels `json:"labels,omitempty"`
+}
+
+// apply returns the profile type of ps transformed, or ps itself if t is
+// nil.
+func (t *Transform) apply(ps *ProfileSet, profileType string) (*ProfileSet, error) {
+	if t == nil {
+		return ps, nil
+	}
+	ps = ps.only(profileType)
+	for _, f := range []struct {
+		filter *SampleFilter
+		keep   bool
+	}{{t.Filter, true}, {t.Exclude, false}} {
+		if f.filter == nil {
+			continue
+		}
+		m := compileStackMatcher(f.filter.RegularExpression, f.filter.Labels)
+		if m.err != nil {
+			return nil, fmt.Errorf("Error in transform: %v", m.err)
+		}
+		ps = ps.Filter(func(_ string, ss StackSample) bool {
+			return (m.rx.MatchString(ss.Stack) && m.failingLabel(ss.Labels) < 0) == f.keep
+		})
+	}
+	if t.Focus != "" {
+		ps = ps.FocusOn(t.Focus)
+	}
+	if t.Scale != 0 {
+		ps = ps.Scale(t.Scale)
+	}
+	return ps, nil
+}
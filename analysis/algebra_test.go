@@ -0,0 +1,161 @@
+package analysis
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// folded formats the samples of a profile type as "stack=value" lines,
+// heaviest first.
+func folded(ps *ProfileSet, profileType string) string {
+	var lines []string
+	for ss := range ps.All(profileType) {
+		line := fmt.Sprintf("%s=%d", ss.Stack, ss.Val)
+		if len(ss.Labels) > 0 {
+			line += " " + formatSampleLabels(ss.Labels)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestMerge(t *testing.T) {
+	a := NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;a", Val: 100}).
+		SetDuration("cpu", 10).
+		AddFact("runtime_version", "1").
+		Build()
+	b := NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;a", Val: 50}).
+		Add("cpu", StackSample{Stack: "main;b", Val: 150}).
+		Add("alloc", StackSample{Stack: "main;b", Val: 7}).
+		SetDuration("cpu", 20).
+		AddFact("runtime_version", "2").
+		Build()
+
+	m := Merge(a, b)
+	if got, want := folded(m, "cpu"), "main;b=150\nmain;a=100\nmain;a=50"; got != want {
+		t.Errorf("cpu:\n%s\nwant\n%s", got, want)
+	}
+	if !m.Has("alloc") || m.Total("alloc") != 7 {
+		t.Error("types of every set should be merged")
+	}
+	// 100 over 10s and 200 over 20s: 300 at 20/s, i.e. 15s.
+	if got := m.Duration("cpu"); got != 15 {
+		t.Errorf("Duration = %v, want 15", got)
+	}
+	if m.facts["runtime_version"] != "1" {
+		t.Errorf("facts = %v, want the first set's", m.facts)
+	}
+}
+
+func TestFilterScaleFocus(t *testing.T) {
+	ps := NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;warmup;parse", Val: 40}).
+		Add("cpu", StackSample{Stack: "main;handle;parse", Val: 30}).
+		Add("cpu", StackSample{Stack: "main;handle;write", Val: 20, Labels: map[string][]string{"thread name": {"w"}}}).
+		Add("cpu", StackSample{Stack: "main;idle", Val: 11}).
+		SetDuration("cpu", 5).
+		Build()
+
+	filtered := ps.Filter(func(_ string, s StackSample) bool { return !strings.Contains(s.Stack, "warmup") })
+	if got, want := folded(filtered, "cpu"), "main;handle;parse=30\nmain;handle;write=20 thread name=[w]\nmain;idle=11"; got != want {
+		t.Errorf("Filter:\n%s\nwant\n%s", got, want)
+	}
+	if filtered.Duration("cpu") != 5 {
+		t.Error("Filter should keep durations")
+	}
+	if empty := ps.Filter(func(string, StackSample) bool { return false }); !empty.Has("cpu") || empty.Len("cpu") != 0 {
+		t.Error("Filter should keep emptied types")
+	}
+
+	if got, want := folded(ps.FocusOn("handle"), "cpu"), "handle;parse=30\nhandle;write=20 thread name=[w]"; got != want {
+		t.Errorf("FocusOn:\n%s\nwant\n%s", got, want)
+	}
+
+	scaled := ps.Scale(0.5)
+	if got := scaled.Total("cpu"); got != 20+15+10+6 {
+		t.Errorf("Scale total = %d, want rounded halves", got)
+	}
+	if scaled.Duration("cpu") != 5 {
+		t.Error("Scale should keep durations")
+	}
+	if ps.Total("cpu") != 101 {
+		t.Error("operations must not modify their operand")
+	}
+}
+
+func TestSubtractGroupBy(t *testing.T) {
+	run := NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;a", Val: 60, Labels: map[string][]string{"thread name": {"t1"}}}).
+		Add("cpu", StackSample{Stack: "main;a", Val: 40, Labels: map[string][]string{"thread name": {"t2"}}}).
+		Add("cpu", StackSample{Stack: "main;b", Val: 10}).
+		Build()
+	baseline := NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;a", Val: 60, Labels: map[string][]string{"thread name": {"t1"}}}).
+		Add("cpu", StackSample{Stack: "main;a", Val: 10, Labels: map[string][]string{"thread name": {"t2"}}}).
+		Add("cpu", StackSample{Stack: "main;c", Val: 5}).
+		Add("alloc", StackSample{Stack: "main;c", Val: 3}).
+		Build()
+
+	diff := run.Subtract(baseline)
+	if got, want := folded(diff, "cpu"), "main;a=30 thread name=[t2]\nmain;b=10\nmain;c=-5"; got != want {
+		t.Errorf("Subtract:\n%s\nwant\n%s", got, want)
+	}
+	if got := folded(diff, "alloc"); got != "main;c=-3" {
+		t.Errorf("Subtract alloc = %q, want the baseline-only type negated", got)
+	}
+
+	groups := run.GroupBy("thread name")
+	if len(groups) != 3 || groups["t1"].Total("cpu") != 60 || groups["t2"].Total("cpu") != 40 || groups[""].Total("cpu") != 10 {
+		t.Errorf("GroupBy = %v", groups)
+	}
+}
+
+// TestAnalyze_Transform checks expectations can merge the matching files and
+// transform them before asserting.
+func TestAnalyze_Transform(t *testing.T) {
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;warmup": 50, "main;handle;parse": 30, "main;handle;write": 20})
+	content, err := os.ReadFile(filepath.Join(dir, "profile.pprof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "worker2.pprof"), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "schema_version": 2,
+  "stacks": [{
+    "profile-type": "cpu",
+    "error_margin": 1,
+    "transform": { "merge": true, "exclude": { "regular_expression": ";warmup$" }, "focus": "handle" },
+    "value_matching_sum": 100,
+    "stack-content": [
+      { "regular_expression": "^handle;parse$", "percent": 60 },
+      { "regular_expression": "^handle;write$", "value": 40 }
+    ]
+  }]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Analyze(jsonPath, dir, Options{})
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+	if len(res.Files) != 1 || filepath.Base(res.Files[0].Path) != "profile.pprof+worker2.pprof" {
+		t.Fatalf("files = %+v, want the merge of both", res.Files)
+	}
+	typ := res.Files[0].Types[0]
+	if typ.TotalValue != 100 || res.Failed() {
+		t.Errorf("total = %d, verdict = %v, want 100 and passed", typ.TotalValue, typ.Verdict())
+		for _, a := range typ.Assertions {
+			t.Log(a.Message())
+		}
+	}
+}
@@ -7,6 +7,7 @@ package analysis
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -15,11 +16,11 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/google/pprof/profile"
 	"github.com/klauspost/compress/zstd"
 	"github.com/pierrec/lz4/v4"
-	"github.com/xeipuuv/gojsonschema"
 )
 
 var (
@@ -27,18 +28,39 @@ var (
 	_ json.Marshaler   = (*Optional[int64])(nil)
 )
 
-// JSON Schema for validating expected profile JSON files.
-// Basic structure validation, complex rules validated in Go code.
+// JSON Schema for validating expected profile JSON files of schema_version 1
+// (see schema.go for later versions). Basic structure validation, complex
+// rules validated in Go code.
 var expectedProfileSchema = `{
   "$schema": "https://json-schema.org/draft-07/schema#",
   "type": "object",
   "required": ["stacks"],
+  "definitions": {
+    "when": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["fact"],
+        "properties": {
+          "fact": { "type": "string", "minLength": 1 },
+          "version": { "type": "string" },
+          "equals": { "type": "string" },
+          "regex": { "type": "string" }
+        }
+      }
+    }
+  },
   "properties": {
+    "schema_version": { "const": 1 },
     "test_name": { "type": "string" },
     "note": { "type": "string" },
     "scale_by_duration": { "type": "boolean" },
     "pprof-regex": { "type": "string" },
     "allow_first_profile_failure": { "type": "boolean" },
+    "variables": {
+      "type": "object",
+      "additionalProperties": { "type": "number" }
+    },
     "stacks": {
       "type": "array",
       "items": {
@@ -47,6 +69,7 @@ var expectedProfileSchema = `{
         "properties": {
           "profile-type": { "type": "string", "minLength": 1 },
           "pprof-regex": { "type": "string" },
+          "when": { "$ref": "#/definitions/when" },
           "stack-content": {
             "type": "array",
             "minItems": 1,
@@ -58,7 +81,8 @@ var expectedProfileSchema = `{
                 "value": { "type": "integer" },
                 "percent": { "type": "integer" },
                 "error_margin": { "type": "integer" },
-                "labels": { "type": "array" }
+                "labels": { "type": "array" },
+                "when": { "$ref": "#/definitions/when" }
               }
             }
           },
@@ -112,8 +136,8 @@ type StackSample struct {
 // Reference data from the json files
 type Labels struct {
 	Key         string   `json:"key"`
-	Values      []string `json:"values"`       // fixed value
-	ValuesRegex string   `json:"values_regex"` // regex for values
+	Values      []string `json:"values"`                 // fixed value
+	ValuesRegex string   `json:"values_regex,omitempty"` // regex for values
 }
 
 type StackContent struct {
@@ -121,30 +145,58 @@ type StackContent struct {
 	// NOTE: When the corresponding profile has a duration > 0, this value represents a rate (x/sec).
 	//       If the corresponding profile is a snapshot (i.e. duration == 0), then this value represents
 	//       an absolute/raw/scalar value independent of time.
-	Value       Optional[int64] `json:"value"`
-	Percent     Optional[int64] `json:"percent"`
-	ErrorMargin Optional[int64] `json:"error_margin,omitempty"`
-	Labels      []Labels        `json:"labels"`
+	Value       Optional[int64] `json:"value,omitzero"`
+	Percent     Optional[int64] `json:"percent,omitzero"`
+	ErrorMargin Optional[int64] `json:"error_margin,omitzero"`
+	Labels      []Labels        `json:"labels,omitempty"`
+	// When restricts the entry to runs whose facts satisfy every condition;
+	// otherwise it is reported as skipped.
+	When []Condition `json:"when,omitempty"`
+	Note string      `json:"note,omitempty"`
+	// Pos is where the entry starts in the expectation file, when read from
+	// one.
+	Pos Position `json:"-"`
+	// compiled is the entry's matcher, compiled when read from a file.
+	compiled *stackMatcher
 }
 
 type TypedStacks struct {
 	ProfileType  string         `json:"profile-type"`
-	PprofRegex   string         `json:"pprof-regex"`
-	StackContent []StackContent `json:"stack-content"`
-	ErrorMargin  int64          `json:"error-margin,omitempty"`
+	PprofRegex   string         `json:"pprof-regex,omitempty"`
+	StackContent []StackContent `json:"stack-content,omitempty"`
+	// NOTE: Spelled "error-margin" in schema_version 1 files.
+	ErrorMargin int64 `json:"error_margin,omitempty"`
 	// NOTE: When the corresponding profile has a duration > 0, this value represents a rate (x/sec).
 	//       If the corresponding profile is a snapshot (i.e. duration == 0), then this value represents
 	//       an absolute/raw/scalar value independent of time.
-	ValueMatchingSum Optional[int64] `json:"value-matching-sum,omitempty"`
+	ValueMatchingSum Optional[int64] `json:"value_matching_sum,omitzero"`
+	// When restricts the whole profile type to runs whose facts satisfy every
+	// condition; otherwise it is reported as skipped.
+	When []Condition `json:"when,omitempty"`
+	// Transform, if set, is applied to the profile before the assertions.
+	Transform *Transform `json:"transform,omitempty"`
+	// Baseline, if set, also compares the whole profile type with a capture
+	// of an earlier run.
+	Baseline *Baseline `json:"baseline,omitempty"`
+	Note     string    `json:"note,omitempty"`
+	// Pos is where the entry starts in the expectation file, when read from
+	// one.
+	Pos Position `json:"-"`
 }
 
 type StackTestData struct {
+	SchemaVersion            int           `json:"schema_version"`
 	TestName                 string        `json:"test_name"`
 	Note                     string        `json:"note,omitempty"`
 	ScaleByDuration          bool          `json:"scale_by_duration"`
-	PprofRegex               string        `json:"pprof-regex"`
+	PprofRegex               string        `json:"pprof-regex,omitempty"`
 	AllowFirstProfileFailure bool          `json:"allow_first_profile_failure,omitempty"`
 	Stacks                   []TypedStacks `json:"stacks"`
+	// Variables holds the effective value of each declared variable (see
+	// variables.go); numeric fields referencing them are already resolved.
+	Variables map[string]float64 `json:"variables,omitempty"`
+
+	format expectationFormat // format of the source file, reused for captured data
 }
 
 // Validate rules that JSON Schema can't express
@@ -163,7 +215,11 @@ func (s *StackTestData) Validate() error {
 			_, hasValue := content.Value.Value()
 			_, hasPercent := content.Percent.Value()
 			if !hasValue && !hasPercent {
-				return fmt.Errorf("stacks[%d].stack-content[%d]: must have 'value' or 'percent' (or parent must have 'value-matching-sum')", i, j)
+				where := fmt.Sprintf("stacks[%d].stack-content[%d]", i, j)
+				if content.Pos.IsValid() {
+					where = fmt.Sprintf("line %d: %s", content.Pos.Line, where)
+				}
+				return fmt.Errorf("%s: must have 'value' or 'percent' (or parent must have 'value_matching_sum')", where)
 			}
 		}
 	}
@@ -254,8 +310,23 @@ func labelsKey(labels []Labels) string {
 	return b.String()
 }
 
-func captureProfData(r Reporter, ps *ProfileSet, path string, testName string) {
+func captureProfData(r Reporter, ps *ProfileSet, path string, testName string, format expectationFormat) error {
+	capturedData := captureStackData(ps, testName, true)
+	capturePath := captureFilePath(path, format.ext())
+
+	if err := writeExpectationFile(capturedData, capturePath, format); err != nil {
+		return fmt.Errorf("Failed to write : %v", err)
+	}
+	r.Logf("Results stored in %s", capturePath)
+	return nil
+}
+
+// captureStackData describes every stack of ps as a stack content, with its
+// value and percent; values are per second for profiles with a duration if
+// rates is set.
+func captureStackData(ps *ProfileSet, testName string, rates bool) StackTestData {
 	var capturedData StackTestData
+	capturedData.SchemaVersion = CurrentSchemaVersion
 	capturedData.TestName = testName
 
 	for _, sampleType := range ps.SampleTypes() {
@@ -267,8 +338,6 @@ func captureProfData(r Reporter, ps *ProfileSet, path string, testName string) {
 		// 10s allocation profile with a 60s CPU profile).
 		profileDuration := ps.Duration(sampleType)
 
-		typedProf, _ := ps.Samples(sampleType)
-
 		// Group samples by (stack, kept-labels) and sum their values. Without
 		// this, ephemeral labels like end_timestamp_ns produce one entry per
 		// raw sample even after the unstable keys are stripped from output.
@@ -284,7 +353,7 @@ func captureProfData(r Reporter, ps *ProfileSet, path string, testName string) {
 		// to 0 (e.g. two samples of 1 over a 2 s profile each scale to
 		// int64(0.5)=0, summing to 0 instead of the correct grouped rate
 		// of 1).
-		for _, ss := range typedProf {
+		for ss := range ps.All(sampleType) {
 			var labels []Labels
 			for key, value := range ss.Labels {
 				if containsStr(captureKeysToIgnore, key) {
@@ -322,7 +391,7 @@ func captureProfData(r Reporter, ps *ProfileSet, path string, testName string) {
 		}
 
 		// Scale grouped values to rates once, post-aggregation.
-		if profileDuration > 0 {
+		if rates && profileDuration > 0 {
 			for idx := range typedStack.StackContent {
 				if val, ok := typedStack.StackContent[idx].Value.Value(); ok {
 					typedStack.StackContent[idx].Value = NewOptionalFrom(int64(float64(val) / profileDuration))
@@ -332,15 +401,7 @@ func captureProfData(r Reporter, ps *ProfileSet, path string, testName string) {
 
 		capturedData.Stacks = append(capturedData.Stacks, typedStack)
 	}
-
-	jsonPath := captureJSONPath(path)
-
-	err := writeToJSONFile(capturedData, jsonPath)
-	if err != nil {
-		r.Fatalf("Failed to write : %v", err)
-	} else {
-		r.Logf("Results stored in %s", jsonPath)
-	}
+	return capturedData
 }
 
 // captureJSONPath is where captureProfData writes the observed-stacks JSON: the
@@ -349,59 +410,47 @@ func captureProfData(r Reporter, ps *ProfileSet, path string, testName string) {
 // foo.otlp.json) would otherwise resolve back to the input path, so a
 // .capture.json variant is used instead.
 func captureJSONPath(path string) string {
-	dir := filepath.Dir(path)
-	base := filepath.Base(path)
-	jsonPath := filepath.Join(dir, fileNameWithoutExt(base)+".json")
-	if jsonPath == path {
-		jsonPath = filepath.Join(dir, fileNameWithoutExt(base)+".capture.json")
-	}
-	return jsonPath
+	return captureFilePath(path, ".json")
 }
 
-func checkLabels(r Reporter, labels map[string][]string, expectedLabels []Labels) bool {
-	for _, expectedLabel := range expectedLabels {
-		if values, ok := labels[expectedLabel.Key]; ok {
-			if expectedLabel.Values != nil {
-				// Right now all values should be present.
-				if len(values) != len(expectedLabel.Values) {
-					return false
-				}
-				// Sample values and exepected values are sorted when read from profile/json file
-				for i, v := range expectedLabel.Values {
-					if values[i] != v {
-						return false
-					}
-				}
-			} else {
-				// Sample values and expected values are sorted when read from profile/json file
-				for _, v := range values {
-					matched, err := regexp.MatchString(expectedLabel.ValuesRegex, v)
-					if err != nil {
-						r.Fatalf("Error matching regexp %s: %v", v, err)
-					}
-					if !matched {
-						return false
-					}
-				}
-			}
-		} else {
-			return false
-		}
+// captureFilePath is captureJSONPath for an arbitrary capture extension (e.g.
+// .yaml when the expectations were written in YAML).
+func captureFilePath(path string, ext string) string {
+	dir := filepath.Dir(path)
+	base := filepath.Base(path)
+	capturePath := filepath.Join(dir, fileNameWithoutExt(base)+ext)
+	if capturePath == path {
+		capturePath = filepath.Join(dir, fileNameWithoutExt(base)+".capture"+ext)
 	}
-	return true
+	return capturePath
 }
 
-func assertStackWithFailureHandling(r Reporter, prof []StackSample, regexpStack string, valueOpt Optional[float64], pctOpt Optional[int64], epsilonPct int64, labels []Labels, allowFailure bool, hasFailures *bool) (matching int64) {
-	rx, err := regexp.Compile(regexpStack)
-	if err != nil {
-		r.Fatalf("Error compiling regex: %v, %s", err, regexpStack)
+// assertStackWithFailureHandling evaluates the value and/or percent
+// expectations of one stack content against prof, reporting each assertion to
+// r as it is decided. It also returns the matching value and sample count,
+// for value-matching-sum. With a non-nil ex, the assertions also list what the
+// stack content matched (see Explanation), aggregated into ex.
+func assertStackWithFailureHandling(r Reporter, prof typedSamples, profileType string, regexpStack string, m *stackMatcher, valueOpt Optional[float64], pctOpt Optional[int64], epsilonPct int64, labels []Labels, allowFailure bool, ex *explainer, source Position) (assertions []*AssertionResult, matching int64, matchedSamples int, err error) {
+	if m.err != nil {
+		return nil, 0, 0, m.err
 	}
+	memo := m.memo(prof)
+	start := time.Now()
 	var total int64 = 0
-	for _, ss := range prof {
+	// excluded holds, per expected label, the samples whose stack matched but
+	// that failed this label check, for diagnostics.
+	excluded := map[int][]StackSample{}
+	for ref, ss := range prof.all {
 		total += ss.Val
-		if rx.MatchString(ss.Stack) {
-			if labels == nil || checkLabels(r, ss.Labels, labels) {
+		if matched, failing := memo.match(ref, ss); matched {
+			if failing < 0 {
 				matching += ss.Val
+				matchedSamples++
+			} else {
+				excluded[failing] = append(excluded[failing], ss)
+			}
+			if ex != nil {
+				ex.add(ss, failing < 0)
 			}
 		}
 	}
@@ -410,43 +459,84 @@ func assertStackWithFailureHandling(r Reporter, prof []StackSample, regexpStack
 	if total != 0 {
 		actualPct = matching * 100 / total
 	}
+	elapsed := time.Since(start)
 
-	if value, ok := valueOpt.Value(); ok {
-		errorPct := relDiff(float64(matching), value)
+	failed := VerdictFail
+	if allowFailure {
+		failed = VerdictAllowedFailure
+	}
+	var diagnosis *Diagnosis // computed on the first failure only
+	var explanation *Explanation
+	if ex != nil {
+		explanation = ex.explanation(matching, total)
+	}
+	newAssertion := func(kind AssertionKind, expected, actual, errorPct float64) *AssertionResult {
+		a := &AssertionResult{
+			Kind:           kind,
+			ProfileType:    profileType,
+			Regex:          regexpStack,
+			Labels:         labels,
+			Expected:       expected,
+			Actual:         actual,
+			Tolerance:      epsilonPct,
+			Error:          errorPct,
+			MatchedSamples: matchedSamples,
+			Verdict:        VerdictPass,
+			Elapsed:        elapsed,
+			Explanation:    explanation,
+			Source:         source,
+		}
 		if errorPct > float64(epsilonPct) {
-			if allowFailure {
-				r.Logf("\033[33mAssertion failed (allowed): stack '%s' (labels=%v) should have been %.1f +/- %d%% of the profile but was %d with %.1f%% error\033[0m", regexpStack, labels, value, epsilonPct, matching, errorPct)
-				*hasFailures = true
-			} else {
-				r.Errorf("\033[31mAssertion failed: stack '%s' (labels=%v) should have been %.1f +/- %d%% of the profile but was %d with %.1f%% error\033[0m", regexpStack, labels, value, epsilonPct, matching, errorPct)
+			a.Verdict = failed
+			if diagnosis == nil {
+				diagnosis = diagnose(prof.values(), total, regexpStack, labels, excluded)
 			}
-		} else {
-			r.Logf("\033[32mAssertion succeeded: stack '%s' (labels=%v) is %.1f +/- %d%% of the profile (was %d with %.1f%% error)\033[0m", regexpStack, labels, value, epsilonPct, matching, errorPct)
+			a.Diagnosis = diagnosis
 		}
+		emit(r, a)
+		assertions = append(assertions, a)
+		return a
 	}
 
+	if value, ok := valueOpt.Value(); ok {
+		newAssertion(AssertValue, value, float64(matching), relDiff(float64(matching), value))
+	}
 	if pct, ok := pctOpt.Value(); ok {
-		diff := absDiff(pct, actualPct)
-		if diff > epsilonPct {
-			if allowFailure {
-				r.Logf("\033[33mAssertion failed (allowed): stack '%s' (labels=%v) should have been %d%% +/- %d%% of the profile but was %d%% with %d%% error\033[0m", regexpStack, labels, pct, epsilonPct, actualPct, diff)
-				*hasFailures = true
-			} else {
-				r.Errorf("\033[31mAssertion failed: stack '%s' (labels=%v) should have been %d%% +/- %d%% of the profile but was %d%% with %d%% error\033[0m", regexpStack, labels, pct, epsilonPct, actualPct, diff)
-			}
-		} else {
-			r.Logf("\033[32mAssertion succeeded: stack '%s' (labels=%v) is %d%% +/- %d%% of the profile (was %d%% with %d%% error)\033[0m", regexpStack, labels, pct, epsilonPct, actualPct, diff)
-		}
+		newAssertion(AssertPercent, float64(pct), float64(actualPct), float64(absDiff(pct, actualPct)))
 	}
-	return
+	if explanation != nil {
+		emit(r, Explained{Regex: regexpStack, Explanation: explanation})
+	}
+	return assertions, matching, matchedSamples, nil
 }
 
-func analyzeProfDataWithFailureHandling(r Reporter, prof []StackSample, typedStacks TypedStacks, durationSecs float64, allowFailure bool) {
+func analyzeProfDataWithFailureHandling(r Reporter, prof typedSamples, typedStacks TypedStacks, durationSecs float64, facts Facts, allowFailure bool, explain bool) ([]*AssertionResult, error) {
+	var assertions []*AssertionResult
+	start := time.Now()
 	var matchingSum int64 = 0
-	var hasFailures bool = false
+	matchingSamples := 0
+	// sumEx gathers the stacks value-matching-sum adds up, including those of
+	// the entries without value or percent, which have no assertion of their
+	// own to carry an explanation.
+	var sumEx *explainer
+	if _, ok := typedStacks.ValueMatchingSum.Value(); ok && explain {
+		sumEx = newExplainer(nil)
+	}
 
+	// A broken stack content does not stop the others; value-matching-sum is
+	// only checked when every stack content could be evaluated.
+	var errs []error
 	for _, stack := range typedStacks.StackContent {
 		regexpStack := stack.RegularExpression
+		if applies, reason, err := evalWhen(stack.When, facts); err != nil {
+			errs = append(errs, fmt.Errorf("Error evaluating conditions of stack '%s': %v", regexpStack, err))
+			continue
+		} else if !applies {
+			a := &AssertionResult{Kind: stackContentKind(stack), ProfileType: typedStacks.ProfileType, Regex: regexpStack, Labels: stack.Labels, Verdict: VerdictSkipped, SkipReason: reason, Source: stack.Pos}
+			emit(r, a)
+			assertions = append(assertions, a)
+			continue
+		}
 		// Do not scale values for profiles with a duration of 0 (eg. Node.js heap profiles)
 		valueOpt := MapOptional(stack.Value, func(v int64) float64 { return float64(v) })
 		if durationSecs > 0 {
@@ -460,76 +550,141 @@ func analyzeProfDataWithFailureHandling(r Reporter, prof []StackSample, typedSta
 			errorMargin = stackErrorMargin
 		}
 
-		matching := assertStackWithFailureHandling(r, prof, regexpStack, valueOpt, percent, errorMargin, stack.Labels, allowFailure, &hasFailures)
+		var ex *explainer
+		if explain {
+			ex = newExplainer(stack.Labels)
+		}
+		stackAssertions, matching, matchedSamples, err := assertStackWithFailureHandling(r, prof, typedStacks.ProfileType, regexpStack, stack.matcher(), valueOpt, percent, errorMargin, stack.Labels, allowFailure, ex, stack.Pos)
+		assertions = append(assertions, stackAssertions...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
 		matchingSum += matching
+		matchingSamples += matchedSamples
+		if sumEx != nil {
+			sumEx.addMatched(ex)
+		}
 		// TODO: add an assertion on counts (e.g. number of allocations), not just summed values.
 	}
 
-	if expectedSum, ok := typedStacks.ValueMatchingSum.Value(); ok {
+	if expectedSum, ok := typedStacks.ValueMatchingSum.Value(); ok && len(errs) == 0 {
 		value := float64(expectedSum)
 		if durationSecs > 0 {
 			// NOTE: When profile duration is bigger than 0, all values represent rates.
 			value = value * durationSecs
 		}
-		errorPct := relDiff(float64(matchingSum), value)
-		if errorPct > float64(typedStacks.ErrorMargin) {
+		a := &AssertionResult{
+			Kind:           AssertValueMatchingSum,
+			ProfileType:    typedStacks.ProfileType,
+			Expected:       value,
+			Actual:         float64(matchingSum),
+			Tolerance:      typedStacks.ErrorMargin,
+			Error:          relDiff(float64(matchingSum), value),
+			MatchedSamples: matchingSamples,
+			Verdict:        VerdictPass,
+			Elapsed:        time.Since(start),
+			Source:         typedStacks.Pos,
+		}
+		if a.Error > float64(typedStacks.ErrorMargin) {
+			a.Verdict = VerdictFail
 			if allowFailure {
-				r.Logf("\033[33mAssertion failed (allowed): profile '%s' should have total matching sum of %1.f +/- %d%% but was %d with %.1f%% error\033[0m", typedStacks.ProfileType, value, typedStacks.ErrorMargin, matchingSum, errorPct)
-				hasFailures = true
-			} else {
-				r.Errorf("\033[31mAssertion failed: profile '%s' should have total matching sum of %1.f +/- %d%% but was %d with %.1f%% error\033[0m", typedStacks.ProfileType, value, typedStacks.ErrorMargin, matchingSum, errorPct)
+				a.Verdict = VerdictAllowedFailure
+			}
+		}
+		if sumEx != nil {
+			var total int64
+			for _, ss := range prof.all {
+				total += ss.Val
 			}
-		} else {
-			r.Logf("\033[32mAssertion succeeded: profile '%s' has total matching sum of %1.f +/- %d%% (was %d with %.1f%% error)\033[0m", typedStacks.ProfileType, value, typedStacks.ErrorMargin, matchingSum, errorPct)
+			a.Explanation = sumEx.explanation(matchingSum, total)
 		}
+		emit(r, a)
+		assertions = append(assertions, a)
 	}
+	return assertions, errors.Join(errs...)
+}
 
-	if allowFailure && hasFailures {
-		r.Logf("\033[33mProfile analysis completed with failures (allowed for first profile)\033[0m")
+// stackContentKind is the kind of assertion a stack content makes, for
+// reporting it as skipped: entries without value or percent only contribute
+// to value-matching-sum.
+func stackContentKind(stack StackContent) AssertionKind {
+	if _, ok := stack.Value.Value(); ok {
+		return AssertValue
+	}
+	if _, ok := stack.Percent.Value(); ok {
+		return AssertPercent
 	}
+	return AssertValueMatchingSum
 }
 
-func writeToJSONFile(data StackTestData, filePath string) error {
-	jsonData, err := json.MarshalIndent(data, "", "  ")
+func writeExpectationFile(data StackTestData, filePath string, format expectationFormat) error {
+	content, err := format.marshal(data)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filePath, jsonData, 0644)
+	return os.WriteFile(filePath, content, 0644)
 }
 
 // ReadJSONFile loads, schema-validates and returns the expected_profile.json
-// description at filePath.
+// description at filePath. YAML (.yaml/.yml) and JSON with comments are
+// accepted too, see format.go.
 func ReadJSONFile(filePath string) (StackTestData, error) {
+	return ReadJSONFileWithVars(filePath, nil)
+}
+
+// ReadJSONFileWithVars is ReadJSONFile with explicit values for the file's
+// declared variables, taking precedence over their environment overrides and
+// defaults.
+func ReadJSONFileWithVars(filePath string, vars map[string]string) (StackTestData, error) {
 	var data StackTestData
-	byteValue, err := os.ReadFile(filePath)
+	byteValue, format, positions, err := readExpectationFile(filePath)
 	if err != nil {
 		return data, err
 	}
+	data.format = format
 
 	// Step 1: Validate JSON syntax
 	if !json.Valid(byteValue) {
-		return data, fmt.Errorf("invalid JSON syntax in %s", filePath)
+		return data, fmt.Errorf("invalid %s syntax in %s", format.name(filePath), filePath)
 	}
 
-	// Step 2: Validate against schema
-	schemaLoader := gojsonschema.NewStringLoader(expectedProfileSchema)
-	documentLoader := gojsonschema.NewBytesLoader(byteValue)
-	result, err := gojsonschema.Validate(schemaLoader, documentLoader)
+	// Step 1b: Resolve variables in numeric fields
+	byteValue, err = resolveVariables(byteValue, vars)
+	if err != nil {
+		return data, fmt.Errorf("variable resolution failed for %s: %v", filePath, err)
+	}
+
+	// Step 2: Validate against the schema of the file's version
+	version, err := schemaVersionOf(byteValue)
 	if err != nil {
 		return data, fmt.Errorf("schema validation error for %s: %v", filePath, err)
 	}
-	if !result.Valid() {
-		var errs []string
-		for _, desc := range result.Errors() {
-			errs = append(errs, desc.String())
-		}
+	schema, err := schemaFor(version)
+	if err != nil {
+		return data, fmt.Errorf("schema validation error for %s: %v", filePath, err)
+	}
+	errs, err := validateSchema(schema, byteValue, positions)
+	if err != nil {
+		return data, fmt.Errorf("schema validation error for %s: %v", filePath, err)
+	}
+	if len(errs) > 0 {
 		return data, fmt.Errorf("JSON schema validation failed for %s:\n  - %s", filePath, strings.Join(errs, "\n  - "))
 	}
 
+	// Step 2b: Migrate older versions to the current one
+	byteValue, err = migrateJSON(byteValue, version)
+	if err != nil {
+		return data, fmt.Errorf("migration failed for %s: %v", filePath, err)
+	}
+
 	// Step 3: Unmarshal validated JSON
 	if err := json.Unmarshal(byteValue, &data); err != nil {
 		return data, err
 	}
+	data.setPositions(positions)
+	data.compileMatchers()
+	data.resolveBaselines(filepath.Dir(filePath))
 
 	// Step 4: Validate rules
 	if err := data.Validate(); err != nil {
@@ -539,6 +694,18 @@ func ReadJSONFile(filePath string) (StackTestData, error) {
 	return data, nil
 }
 
+// defaultPprofRegex selects the profiles to analyze when the expectations do
+// not set pprof-regex.
+// python files are in the form "profile.<pid>.number"
+// Other profilers (using pprof) include pprof in the name
+// Filter out files that ends with '.json' to avoid considering files dumped by captureProfData as profiles
+// Golang regexes do not have negative lookahed, so we need to use `([^n]|[^o]n|[^s]on|[^j]son|[^.]json)$` instead of `(?![.]json)$
+const defaultPprofRegex = "^(profile|.*pprof)($|.*([^n]|[^o]n|[^s]on|[^j]son|[^.]json)$)"
+
+// captureOutputRegexp matches the YAML files captureProfData writes next to
+// profiles when the expectations are in YAML.
+var captureOutputRegexp = regexp.MustCompile(`\.ya?ml$`)
+
 func getAllFiles(folder string) ([]string, error) {
 	var files []string
 	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
@@ -559,7 +726,9 @@ func getAllFiles(folder string) ([]string, error) {
 	return files, nil
 }
 
-func getMatchingFiles(folder string, filenameRegex *regexp.Regexp) ([]string, error) {
+// getMatchingFiles lists the files under folder whose name matches
+// filenameRegex and, if set, not excludeRegex.
+func getMatchingFiles(folder string, filenameRegex *regexp.Regexp, excludeRegex *regexp.Regexp) ([]string, error) {
 	var matchingFiles []string
 	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -568,7 +737,7 @@ func getMatchingFiles(folder string, filenameRegex *regexp.Regexp) ([]string, er
 		if info.IsDir() {
 			return nil
 		}
-		if filenameRegex.MatchString(info.Name()) {
+		if filenameRegex.MatchString(info.Name()) && (excludeRegex == nil || !excludeRegex.MatchString(info.Name())) {
 			matchingFiles = append(matchingFiles, path)
 		}
 		return nil
@@ -636,84 +805,334 @@ func ReadPprofFile(pprofFile string) (*profile.Profile, error) {
 // stacks observed in the profile is written next to the pprof file (useful to
 // bootstrap an expected_profile.json).
 func AnalyzePprofFile(r Reporter, pprofFile string, typedStacks TypedStacks, testName string, captureData bool, scaleByDuration bool, allowFailure bool) {
-	ps, err := LoadProfileSet(pprofFile)
+	if _, err := analyzePprofFile(r, NewProfileCache(), pprofFile, typedStacks, &StackTestData{TestName: testName, ScaleByDuration: scaleByDuration}, captureData, allowFailure, false); err != nil {
+		r.Fatalf("%v", err)
+	}
+}
+
+// analyzePprofFile is AnalyzePprofFile with the test-wide settings taken from
+// the loaded expectations, and pprofFile loaded through profiles. Assertions
+// are reported to r as they are decided and returned; the returned TypeResult
+// is partial when err is set.
+func analyzePprofFile(r Reporter, profiles *ProfileCache, pprofFile string, typedStacks TypedStacks, stackTestData *StackTestData, captureData bool, allowFailure bool, explain bool) (*TypeResult, error) {
+	start := time.Now()
+	ps, err := profiles.Load(pprofFile)
 	if err != nil {
-		r.Fatalf("Error reading file %s: %v", pprofFile, err)
+		result := &TypeResult{ProfileType: typedStacks.ProfileType, AllowFailure: allowFailure, Source: typedStacks.Pos, Elapsed: time.Since(start)}
+		return result, fmt.Errorf("Error reading file %s: %v", pprofFile, err)
+	}
+	var capture func() error
+	if captureData {
+		// Store current data in a json file to help users create their tests.
+		capture = func() error { return captureProfData(r, ps, pprofFile, stackTestData.TestName, stackTestData.format) }
 	}
-	r.Logf("Analyzing results in %s for profile type %s", pprofFile, typedStacks.ProfileType)
+	result, err := analyzeProfileType(r, ps, pprofFile, typedStacks, stackTestData, allowFailure, explain, capture)
+	result.Elapsed = time.Since(start)
+	return result, err
+}
 
-	profileDuration := ps.Duration(typedStacks.ProfileType)
-	r.Logf("Found a profile duration of %.1f seconds (in %s)", profileDuration, filepath.Base(pprofFile))
+// analyzeMergedFiles asserts the profile type typedStacks on the merge of
+// files, named name.
+func analyzeMergedFiles(r Reporter, profiles *ProfileCache, files []string, name string, typedStacks TypedStacks, stackTestData *StackTestData, explain bool) (*TypeResult, error) {
+	start := time.Now()
+	sets := make([]*ProfileSet, len(files))
+	for i, file := range files {
+		ps, err := profiles.Load(file)
+		if err != nil {
+			result := &TypeResult{ProfileType: typedStacks.ProfileType, Source: typedStacks.Pos, Elapsed: time.Since(start)}
+			return result, fmt.Errorf("Error reading file %s: %v", file, err)
+		}
+		// Only the asserted type needs merging.
+		sets[i] = ps.only(typedStacks.ProfileType)
+	}
+	r.Logf("Merging %d files: %s", len(files), filepath.Base(name))
+	result, err := analyzeProfileType(r, Merge(sets...), name, typedStacks, stackTestData, false, explain, nil)
+	result.Elapsed = time.Since(start)
+	return result, err
+}
 
-	// Store current data in a json file to help users create their tests
-	if captureData {
-		captureProfData(r, ps, pprofFile, testName)
+// mergedName names the merge of files after the files, e.g.
+// "out/a.pprof+b.pprof".
+func mergedName(files []string) string {
+	bases := make([]string, len(files))
+	for i, file := range files {
+		bases[i] = filepath.Base(file)
+	}
+	return filepath.Join(filepath.Dir(files[0]), strings.Join(bases, "+"))
+}
+
+// analyzeProfileType asserts the profile type typedStacks of ps, named name in
+// events. capture, if set, is called once the analysis started; failing to
+// capture does not prevent the analysis.
+func analyzeProfileType(r Reporter, ps *ProfileSet, name string, typedStacks TypedStacks, stackTestData *StackTestData, allowFailure bool, explain bool, capture func() error) (*TypeResult, error) {
+	result := &TypeResult{ProfileType: typedStacks.ProfileType, AllowFailure: allowFailure, Source: typedStacks.Pos}
+	emit(r, FileStarted{Path: name, ProfileType: typedStacks.ProfileType, Duration: ps.Duration(typedStacks.ProfileType)})
+
+	var captureErr error
+	if capture != nil {
+		captureErr = capture()
+	}
+	ps, err := typedStacks.Transform.apply(ps, typedStacks.ProfileType)
+	if err != nil {
+		return result, errors.Join(captureErr, err)
+	}
+	if typedStacks.Transform != nil {
+		result.profile = ps
+	}
+	profileDuration := ps.Duration(typedStacks.ProfileType)
+	facts := FactsFor(ps)
+	if applies, reason, err := evalWhen(typedStacks.When, facts); err != nil {
+		return result, errors.Join(captureErr, fmt.Errorf("Error evaluating conditions of profile type %s: %v", typedStacks.ProfileType, err))
+	} else if !applies {
+		result.Skipped, result.SkipReason = true, reason
+		emit(r, Skipped{Path: name, ProfileType: typedStacks.ProfileType, Reason: reason, Source: typedStacks.Pos})
+		return result, captureErr
 	}
-	if !scaleByDuration {
+	if !stackTestData.ScaleByDuration {
 		// ignore duration, values can be considered absolute
 		profileDuration = 0
 	}
-	typedProf, ok := ps.Samples(typedStacks.ProfileType)
-	if !ok {
-		r.Fatalf("Couldn't find sample type %s", typedStacks.ProfileType)
+	result.Duration = profileDuration
+	if !ps.Has(typedStacks.ProfileType) {
+		return result, errors.Join(captureErr, fmt.Errorf("Couldn't find sample type %s", typedStacks.ProfileType))
+	}
+	result.Samples = ps.Len(typedStacks.ProfileType)
+	result.TotalValue = ps.Total(typedStacks.ProfileType)
+	result.Assertions, err = analyzeProfDataWithFailureHandling(r, ps.typedSamples(typedStacks.ProfileType), typedStacks, profileDuration, facts, allowFailure, explain)
+	if typedStacks.Baseline != nil {
+		assertions, baselineErr := typedStacks.Baseline.assert(r, ps, typedStacks, allowFailure)
+		result.Assertions = append(result.Assertions, assertions...)
+		err = errors.Join(err, baselineErr)
+	}
+	if allowFailure {
+		for _, a := range result.Assertions {
+			if a.Verdict == VerdictAllowedFailure {
+				emit(r, AllowedFailures{Path: name, ProfileType: typedStacks.ProfileType, Source: typedStacks.Pos})
+				break
+			}
+		}
 	}
-	analyzeProfDataWithFailureHandling(r, typedProf, typedStacks, profileDuration, allowFailure)
+	return result, errors.Join(captureErr, err)
 }
 
-// AnalyzeResults loads the expected_profile.json at jsonFilePath and asserts
-// every pprof file under pprofFolder matches it. Failures are reported via r.
-func AnalyzeResults(r Reporter, jsonFilePath string, pprofFolder string) {
-	stackTestData, err := ReadJSONFile(jsonFilePath)
+// Options tune Analyze.
+type Options struct {
+	// Vars overrides the expectation's declared variables (see
+	// ReadJSONFileWithVars).
+	Vars map[string]string
+	// Reporter, if set, is given progress logs and each assertion as soon as
+	// it is decided, exactly as AnalyzeResults prints them.
+	Reporter Reporter
+	// Explain lists, for every stack content, the heaviest distinct stacks
+	// it matched and those only its label checks excluded (see
+	// AssertionResult.Explanation), and reports them after its assertions.
+	Explain bool
+	// Workers is how many (profile type, file) pairs are analyzed
+	// concurrently; GOMAXPROCS if zero. Output is reported in the same order
+	// whatever the value.
+	Workers int
+	// Profiles, if set, caches the loaded profile files, to share them
+	// between Analyze calls. Otherwise each file is loaded once per call, and
+	// released after its last profile type.
+	Profiles *ProfileCache
+}
+
+// Analyze loads the expectations at jsonFilePath, asserts every matching
+// profile under pprofFolder against them and returns the results. Problems
+// that prevent checking part of the expectations (an unreadable profile, a
+// missing sample type, an invalid regex, ...) do not stop the analysis of the
+// rest: each is reported to the Reporter, in the scope it occurred in, and
+// recorded in the Result's Errors, and all of them are returned joined (see
+// errors.Join). Only unreadable expectations stop the analysis early. Failed
+// assertions are not errors: see Result.Failed.
+func Analyze(jsonFilePath string, pprofFolder string, opts Options) (*Result, error) {
+	r := opts.Reporter
+	if r == nil {
+		r = discardReporter{}
+	}
+	result := &Result{Expectations: jsonFilePath}
+	start := time.Now()
+	defer func() { result.Elapsed = time.Since(start) }()
+
+	var errs []error
+	fail := func(r Reporter, err error) { errs = append(errs, result.addErrors(r, err)...) }
+
+	stackTestData, err := ReadJSONFileWithVars(jsonFilePath, opts.Vars)
 	if err != nil {
-		r.Fatalf("Error opening file %s: %v", jsonFilePath, err)
+		fail(r, fmt.Errorf("Error opening file %s: %v", jsonFilePath, err))
+		return result, errors.Join(errs...)
 	}
+	result.TestName = stackTestData.TestName
+	result.Variables = stackTestData.Variables
 
-	var defaultPprofRegexp *regexp.Regexp
+	var defaultPprofRegexp, excludeRegexp *regexp.Regexp
 	if stackTestData.PprofRegex != "" {
-		defaultPprofRegexp = regexp.MustCompile(stackTestData.PprofRegex)
+		if defaultPprofRegexp, err = regexp.Compile(stackTestData.PprofRegex); err != nil {
+			// Only profile types with their own pprof-regex can be checked.
+			fail(r, fmt.Errorf("Error compiling pprof-regex: %v", err))
+		}
 	} else {
-		// python files are in the form "profile.<pid>.number"
-		// Other profilers (using pprof) include pprof in the name
-		// Filter out files that ends with '.json' to avoid considering files dumped by captureProfData as profiles
-		// Golang regexes do not have negative lookahed, so we need to use `([^n]|[^o]n|[^s]on|[^j]son|[^.]json)$` instead of `(?![.]json)$
-		defaultPprofRegexp = regexp.MustCompile("^(profile|.*pprof)($|.*([^n]|[^o]n|[^s]on|[^j]son|[^.]json)$)")
+		// YAML files dumped by captureProfData would match too: exclude them explicitly
+		excludeRegexp = captureOutputRegexp
+		defaultPprofRegexp = regexp.MustCompile(defaultPprofRegex)
 	}
-	processedProfilesMap := make(map[string]bool)
+	var types []typeFiles
 
-	for _, typedStacks := range stackTestData.Stacks {
+	for i, typedStacks := range stackTestData.Stacks {
 		// use typedStack.PprofRegex if defined, otherwise use defaultPprofRegexp
-		pprofRegexp := defaultPprofRegexp
+		pprofRegexp, exclude := defaultPprofRegexp, excludeRegexp
 		if typedStacks.PprofRegex != "" {
-			pprofRegexp = regexp.MustCompile(typedStacks.PprofRegex)
+			if pprofRegexp, err = regexp.Compile(typedStacks.PprofRegex); err != nil {
+				fail(r, fmt.Errorf("Error compiling pprof-regex of stacks[%d]: %v", i, err))
+				continue
+			}
+			exclude = nil
+		}
+		if pprofRegexp == nil {
+			continue // invalid top-level pprof-regex, already reported
 		}
-		matchingFiles, err := getMatchingFiles(pprofFolder, pprofRegexp)
+		matchingFiles, err := getMatchingFiles(pprofFolder, pprofRegexp, exclude)
 		if err != nil {
-			r.Fatalf("Error getting matching files: %v", err)
+			fail(r, fmt.Errorf("Error getting matching files: %v", err))
+			continue
 		}
 		if len(matchingFiles) == 0 {
-			r.Errorf("No matching files found for %s in %s", pprofRegexp, pprofFolder)
+			msg := fmt.Sprintf("No matching files found for %s in %s", pprofRegexp, pprofFolder)
+			result.Errors = append(result.Errors, msg)
+			r.Errorf("%s", msg)
 
 			if allFiles, err := getAllFiles(pprofFolder); err == nil {
 				r.Errorf("All files: %v", allFiles)
 			}
-		} else {
-			// Sort files by name to ensure consistent ordering
-			sort.Strings(matchingFiles)
-
-			for i, file := range matchingFiles {
-				_, fileAlreadyProcessed := processedProfilesMap[file]
-				if !fileAlreadyProcessed {
-					processedProfilesMap[file] = true
-				}
+			continue
+		}
 
-				// Allow failure for the first profile if the setting is enabled
-				allowFailure := stackTestData.AllowFirstProfileFailure && i == 0
-				if allowFailure {
-					r.Logf("Analyzing first profile with failure tolerance enabled: %s", filepath.Base(file))
-				}
+		// Sort files by name to ensure consistent ordering
+		sort.Strings(matchingFiles)
+		types = append(types, typeFiles{typedStacks: typedStacks, files: matchingFiles})
+	}
+	jobs := planJobs(types, stackTestData.AllowFirstProfileFailure)
+
+	profiles := opts.Profiles
+	if profiles == nil {
+		profiles = NewProfileCache()
+	}
+	analyzeJob := func(r Reporter, j *analysisJob) (*TypeResult, error) {
+		if len(j.files) > 1 {
+			return analyzeMergedFiles(r, profiles, j.files, j.name, j.typedStacks, &stackTestData, opts.Explain)
+		}
+		if j.allowFailure {
+			r.Logf("Analyzing first profile with failure tolerance enabled: %s", filepath.Base(j.name))
+		}
+		return analyzePprofFile(r, profiles, j.name, j.typedStacks, &stackTestData, j.captureData, j.allowFailure, opts.Explain)
+	}
+	runJobs(jobs, opts.Workers, profiles, opts.Profiles == nil, analyzeJob, func(j *analysisJob) {
+		inScope(r, j.typedStacks.ProfileType+"/"+filepath.Base(j.name), func(r Reporter) {
+			if j.result != nil {
+				fileResult := result.file(j.name)
+				fileResult.Types = append(fileResult.Types, j.result)
+			}
+			j.rec.replay(r)
+			if j.err != nil {
+				fail(r, fmt.Errorf("%s (%s): %w", filepath.Base(j.name), j.typedStacks.ProfileType, j.err))
+			}
+		})
+	})
+	return result, errors.Join(errs...)
+}
+
+// addErrors reports each of the errors joined in err to r and records it in
+// the result's Errors. It returns them.
+func (res *Result) addErrors(r Reporter, err error) []error {
+	errs := splitErrors(err)
+	for _, e := range errs {
+		r.Errorf("%v", e)
+		res.Errors = append(res.Errors, e.Error())
+	}
+	return errs
+}
 
-				AnalyzePprofFile(r, file, typedStacks, stackTestData.TestName, !fileAlreadyProcessed, stackTestData.ScaleByDuration, allowFailure)
+// AnalyzeProfileSet asserts an in-memory ProfileSet, named name in the
+// results and events, against every profile type of data, without touching
+// the filesystem: nothing is captured, and pprof-regex, Transform.Merge and
+// allow_first_profile_failure are ignored. It validates data first. As with
+// Analyze, problems are reported, recorded in the Result's Errors and
+// returned joined, and each profile type runs in its own scope of a
+// ScopedReporter. Options.Vars, Workers and Profiles do not apply.
+func AnalyzeProfileSet(ps *ProfileSet, name string, data *StackTestData, opts Options) (*Result, error) {
+	r := opts.Reporter
+	if r == nil {
+		r = discardReporter{}
+	}
+	result := &Result{TestName: data.TestName, Variables: data.Variables}
+	start := time.Now()
+	defer func() { result.Elapsed = time.Since(start) }()
+
+	var errs []error
+	if err := data.Validate(); err != nil {
+		errs = result.addErrors(r, fmt.Errorf("Invalid expectations: %v", err))
+		return result, errors.Join(errs...)
+	}
+	for _, typedStacks := range data.Stacks {
+		inScope(r, typedStacks.ProfileType+"/"+name, func(r Reporter) {
+			typeStart := time.Now()
+			typeResult, err := analyzeProfileType(r, ps, name, typedStacks, data, false, opts.Explain, nil)
+			typeResult.Elapsed = time.Since(typeStart)
+			fileResult := result.file(name)
+			fileResult.Types = append(fileResult.Types, typeResult)
+			if err != nil {
+				errs = append(errs, result.addErrors(r, fmt.Errorf("%s (%s): %w", name, typedStacks.ProfileType, err))...)
+			}
+		})
+	}
+	return result, errors.Join(errs...)
+}
+
+// splitErrors lists the errors joined in err (see errors.Join), prefixing
+// each with the context err wraps them in, if any.
+func splitErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		if inner := errors.Unwrap(err); inner != nil {
+			if _, ok := inner.(interface{ Unwrap() []error }); ok {
+				prefix := strings.TrimSuffix(err.Error(), inner.Error())
+				var errs []error
+				for _, e := range splitErrors(inner) {
+					errs = append(errs, fmt.Errorf("%s%w", prefix, e))
+				}
+				return errs
 			}
 		}
+		return []error{err}
+	}
+	var errs []error
+	for _, e := range joined.Unwrap() {
+		errs = append(errs, splitErrors(e)...)
+	}
+	return errs
+}
+
+// inScope runs fn in a scope named name if r is a ScopedReporter, or with r
+// itself otherwise.
+func inScope(r Reporter, name string, fn func(r Reporter)) {
+	if sr, ok := r.(ScopedReporter); ok {
+		sr.Scope(name, fn)
+		return
+	}
+	fn(r)
+}
+
+// AnalyzeResults loads the expected_profile.json at jsonFilePath and asserts
+// every pprof file under pprofFolder matches it. Failures are reported via r.
+func AnalyzeResults(r Reporter, jsonFilePath string, pprofFolder string) {
+	AnalyzeResultsWithVars(r, jsonFilePath, pprofFolder, nil)
+}
+
+// AnalyzeResultsWithVars is AnalyzeResults with explicit values for the
+// expectation's declared variables (see ReadJSONFileWithVars).
+func AnalyzeResultsWithVars(r Reporter, jsonFilePath string, pprofFolder string, vars map[string]string) {
+	if _, err := Analyze(jsonFilePath, pprofFolder, Options{Vars: vars, Reporter: r}); err != nil {
+		// Each error has been reported already.
+		r.Fatalf("Analysis of %s incomplete: %d errors", jsonFilePath, len(splitErrors(err)))
 	}
 }
@@ -448,3 +448,57 @@ func TestCaptureProfData_LowCountRateNotTruncated(t *testing.T) {
 		t.Errorf("expected grouped rate value=1 (2 samples / 2s), got %d — pre-grouping scaling truncated", got)
 	}
 }
+
+// TestPublicAPI_ProfileSetBuilder builds a ProfileSet in memory and asserts
+// on it with AnalyzeProfileSet, the way a repo with its own profile format
+// would.
+func TestPublicAPI_ProfileSetBuilder(t *testing.T) {
+	ps := analysis.NewProfileSetBuilder().
+		Add("cpu", analysis.StackSample{Stack: "main;work", Val: 60, Labels: map[string][]string{"thread.name": {"worker"}}}).
+		Add("cpu", analysis.StackSample{Stack: "main;work", Val: 30, Labels: map[string][]string{"thread name": {"main"}}}).
+		Add("cpu", analysis.StackSample{Stack: "main;idle", Val: 10}).
+		SetDuration("cpu", 10).
+		AddFact("runtime_version", "1.2.3").
+		Build()
+
+	if got := ps.Duration("cpu"); got != 10 {
+		t.Errorf("Duration = %v, want 10", got)
+	}
+	samples, _ := ps.Samples("cpu")
+	if len(samples) != 3 || samples[0].Val != 60 || samples[0].Labels[analysis.LabelThreadName][0] != "worker" {
+		t.Errorf("samples = %+v, want heaviest first with canonical label keys", samples)
+	}
+
+	data := &analysis.StackTestData{
+		TestName:        "in-memory",
+		ScaleByDuration: true,
+		Stacks: []analysis.TypedStacks{{
+			ProfileType: "cpu",
+			ErrorMargin: 1,
+			StackContent: []analysis.StackContent{
+				{RegularExpression: ";work$", Percent: analysis.NewOptionalFrom[int64](90)},
+				// 6/s over the 10s profile.
+				{RegularExpression: ";work$", Value: analysis.NewOptionalFrom[int64](6),
+					Labels: []analysis.Labels{{Key: analysis.LabelThreadName, Values: []string{"worker"}}}},
+				{RegularExpression: ";idle$", Percent: analysis.NewOptionalFrom[int64](50)},
+			},
+		}, {
+			ProfileType:  "alloc",
+			StackContent: []analysis.StackContent{{RegularExpression: "main", Percent: analysis.NewOptionalFrom[int64](100)}},
+		}},
+	}
+	res, err := analysis.AnalyzeProfileSet(ps, "synthetic", data, analysis.Options{})
+	if err == nil || !strings.Contains(err.Error(), "alloc") {
+		t.Errorf("err = %v, want the missing alloc type", err)
+	}
+	if len(res.Files) != 1 || res.Files[0].Path != "synthetic" || len(res.Files[0].Types) != 2 {
+		t.Fatalf("unexpected result shape: %+v", res)
+	}
+	var verdicts []string
+	for _, a := range res.Files[0].Types[0].Assertions {
+		verdicts = append(verdicts, a.Verdict.String())
+	}
+	if got := strings.Join(verdicts, " "); got != "pass pass fail" {
+		t.Errorf("verdicts = %s, want pass pass fail", got)
+	}
+}
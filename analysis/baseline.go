@@ -0,0 +1,203 @@
+// Golden baselines: hand-written stack contents only cover the stacks someone
+// thought of. A profile type can also be compared as a whole with a committed
+// capture of an earlier run (see WriteBaseline), asserting its distribution of
+// values over stacks stayed close, so regressions in any stack are caught.
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxDistance is Baseline.MaxDistance when no tolerance is set.
+	defaultMaxDistance = 10
+	// baselineChangesCount is how many stacks a failed baseline assertion's
+	// Diagnosis lists.
+	baselineChangesCount = 5
+)
+
+// Baseline compares a profile type with a capture of an earlier run. Stacks
+// are aligned after normalizing their frames (see NormalizeFrame), and only
+// their shares of the profile type are compared, so the runs may last or
+// sample differently.
+type Baseline struct {
+	// File is the capture, as written by WriteBaseline or captured next to a
+	// profile, relative to the expectation file (to the working directory if
+	// the expectations were not read from a file).
+	File string `json:"file"`
+	// MaxDistance is the largest total-variation distance between the
+	// baseline and the profile, in percent: the share of the profile that
+	// moved between stacks. It is 10 if neither tolerance is set.
+	MaxDistance int64 `json:"max_distance,omitempty"`
+	// MaxShareDelta is the largest change of a stack's share of the profile,
+	// in percentage points.
+	MaxShareDelta int64 `json:"max_share_delta,omitempty"`
+
+	// path is File resolved against the expectation file's directory.
+	path string
+	once sync.Once
+	data StackTestData
+	err  error
+}
+
+// resolveBaselines resolves the baseline files relative to dir, the directory
+// of the expectation file.
+func (data *StackTestData) resolveBaselines(dir string) {
+	for _, s := range data.Stacks {
+		if b := s.Baseline; b != nil && !filepath.IsAbs(b.File) {
+			b.path = filepath.Join(dir, b.File)
+		}
+	}
+}
+
+// load returns the samples of a profile type in the baseline. The file is
+// read once, however many profiles are compared with it.
+func (b *Baseline) load(profileType string) (*ProfileSet, error) {
+	b.once.Do(func() {
+		path := b.path
+		if path == "" {
+			path = b.File
+		}
+		b.data, b.err = ReadJSONFile(path)
+	})
+	if b.err != nil {
+		return nil, b.err
+	}
+	for _, s := range b.data.Stacks {
+		if s.ProfileType != profileType {
+			continue
+		}
+		builder := NewProfileSetBuilder()
+		for _, c := range s.StackContent {
+			stack, ok := capturedStack(c.RegularExpression)
+			if !ok {
+				return nil, fmt.Errorf("stack content '%s' is not a captured stack", c.RegularExpression)
+			}
+			val, ok := c.Value.Value()
+			if !ok {
+				val, _ = c.Percent.Value()
+			}
+			labels := map[string][]string{}
+			for _, l := range c.Labels {
+				labels[l.Key] = l.Values
+			}
+			builder.Add(profileType, StackSample{Stack: stack, Val: val, Labels: labels})
+		}
+		return builder.Build(), nil
+	}
+	return nil, fmt.Errorf("no profile type %s", profileType)
+}
+
+// capturedStack returns the folded stack a captured stack content's regex
+// matches exactly, as written by regexp.QuoteMeta between ^ and $.
+func capturedStack(regex string) (string, bool) {
+	quoted, ok := strings.CutPrefix(regex, "^")
+	if !ok {
+		return "", false
+	}
+	if quoted, ok = strings.CutSuffix(quoted, "$"); !ok {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 0; i < len(quoted); i++ {
+		c := quoted[i]
+		if c == '\\' && i+1 < len(quoted) {
+			i++
+			c = quoted[i]
+		} else if strings.IndexByte(`.+*?()|[]{}^$`, c) >= 0 {
+			return "", false // a hand-written regex
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), true
+}
+
+// assert compares a profile type of ps with the baseline: its distance, and
+// if MaxShareDelta is set, every stack whose share moved by more, or the one
+// that moved the most if none did.
+func (b *Baseline) assert(r Reporter, ps *ProfileSet, typedStacks TypedStacks, allowFailure bool) ([]*AssertionResult, error) {
+	start := time.Now()
+	profileType := typedStacks.ProfileType
+	base, err := b.load(profileType)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading baseline %s: %v", b.File, err)
+	}
+	d := Diff(base, ps.only(profileType), DiffOptions{Normalize: NormalizeFrame}).Types[0]
+
+	verdict := func(failed bool) Verdict {
+		switch {
+		case !failed:
+			return VerdictPass
+		case allowFailure:
+			return VerdictAllowedFailure
+		}
+		return VerdictFail
+	}
+	maxDistance := b.MaxDistance
+	if maxDistance == 0 && b.MaxShareDelta == 0 {
+		maxDistance = defaultMaxDistance
+	}
+	var assertions []*AssertionResult
+	newAssertion := func(a *AssertionResult) {
+		a.ProfileType = profileType
+		a.MatchedSamples = ps.Len(profileType)
+		a.Elapsed = time.Since(start)
+		a.Source = typedStacks.Pos
+		emit(r, a)
+		assertions = append(assertions, a)
+	}
+
+	if maxDistance > 0 {
+		a := &AssertionResult{Kind: AssertBaseline, Actual: d.Distance, Tolerance: maxDistance, Error: d.Distance, Verdict: verdict(d.Distance > float64(maxDistance))}
+		if a.Verdict != VerdictPass {
+			a.Diagnosis = &Diagnosis{BaselineChanges: d.Stacks[:min(baselineChangesCount, len(d.Stacks))]}
+		}
+		newAssertion(a)
+	}
+	if b.MaxShareDelta > 0 {
+		shareAssertion := func(s StackDiff) *AssertionResult {
+			return &AssertionResult{
+				Kind:      AssertBaselineShare,
+				Regex:     "^" + regexp.QuoteMeta(s.Stack) + "$",
+				Expected:  s.BaseShare,
+				Actual:    s.CandidateShare,
+				Tolerance: b.MaxShareDelta,
+				Error:     math.Abs(s.ShareDelta),
+			}
+		}
+		failed := false
+		for _, s := range d.Stacks {
+			if math.Abs(s.ShareDelta) > float64(b.MaxShareDelta) {
+				a := shareAssertion(s)
+				a.Verdict = verdict(true)
+				newAssertion(a)
+				failed = true
+			}
+		}
+		if !failed {
+			// Report how close the stack that moved the most came.
+			a := &AssertionResult{Kind: AssertBaselineShare, Tolerance: b.MaxShareDelta}
+			if len(d.Stacks) > 0 {
+				a = shareAssertion(d.Stacks[0])
+			}
+			a.Verdict = VerdictPass
+			newAssertion(a)
+		}
+	}
+	return assertions, nil
+}
+
+// WriteBaseline writes the stacks of ps to path as a capture a Baseline can
+// be compared with, in the expectation format of its extension. Values are
+// written as they are, not per second, so small stacks are not rounded away.
+// To aggregate several runs, Merge them first.
+func WriteBaseline(path string, ps *ProfileSet, testName string) error {
+	format := formatOf(path)
+	return writeExpectationFile(captureStackData(ps, testName, false), path, format)
+}
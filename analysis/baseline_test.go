@@ -0,0 +1,111 @@
+package analysis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCapturedStack(t *testing.T) {
+	for regex, want := range map[string]string{
+		"^main;work$":                             "main;work",
+		`^main;Foo\$\$Lambda\.run;a\[\]$`:         "main;Foo$$Lambda.run;a[]",
+		"^" + `std::vector<int>::push_back` + "$": "std::vector<int>::push_back",
+	} {
+		if got, ok := capturedStack(regex); !ok || got != want {
+			t.Errorf("capturedStack(%q) = %q, %v, want %q", regex, got, ok, want)
+		}
+	}
+	for _, regex := range []string{"main;work", "^main;.*$", "^main;(a|b)$"} {
+		if got, ok := capturedStack(regex); ok {
+			t.Errorf("capturedStack(%q) = %q, want not a captured stack", regex, got)
+		}
+	}
+}
+
+// writeBaselineExpectations captures a baseline of stacks in dir and writes
+// expectations comparing the cpu profile with it, returning their path.
+func writeBaselineExpectations(t *testing.T, dir string, stacks map[string]int64, baseline string) string {
+	t.Helper()
+	ps := NewProfileSetBuilder()
+	for stack, v := range stacks {
+		ps.Add("cpu", StackSample{Stack: stack, Val: v})
+	}
+	if err := WriteBaseline(filepath.Join(dir, "baseline.yaml"), ps.SetDuration("cpu", 60).Build(), "golden"); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "schema_version": 2,
+  "stacks": [{ "profile-type": "cpu", "baseline": `+baseline+` }]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return jsonPath
+}
+
+func TestAnalyze_Baseline(t *testing.T) {
+	profiles := t.TempDir()
+	writeFoldedPprof(t, profiles, map[string]int64{"main;handler.func2;parse": 52, "main;write": 38, "main;idle": 10})
+
+	t.Run("pass", func(t *testing.T) {
+		// Closures renumbered between the runs still align.
+		jsonPath := writeBaselineExpectations(t, t.TempDir(), map[string]int64{"main;handler.func1;parse": 50, "main;write": 40, "main;idle": 10},
+			`{ "file": "baseline.yaml", "max_distance": 5, "max_share_delta": 3 }`)
+		res, err := Analyze(jsonPath, profiles, Options{})
+		if err != nil {
+			t.Fatalf("Analyze: %v", err)
+		}
+		typ := res.Files[0].Types[0]
+		if res.Failed() || len(typ.Assertions) != 2 {
+			t.Fatalf("failed = %v, assertions = %d, want 2 passing", res.Failed(), len(typ.Assertions))
+		}
+		for i, want := range []string{
+			"Assertion succeeded: profile 'cpu' is within 5% of the baseline (distance was 2.0%)",
+			"Assertion succeeded: stack '^main;handler\\.func;parse$' is 50.0% +/- 3% of the profile as in the baseline (was 52.0%)",
+		} {
+			if got := typ.Assertions[i].Message(); got != want {
+				t.Errorf("assertion %d = %q, want %q", i, got, want)
+			}
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		jsonPath := writeBaselineExpectations(t, t.TempDir(), map[string]int64{"main;handler.func1;parse": 80, "main;write": 10, "main;idle": 10},
+			`{ "file": "baseline.yaml", "max_share_delta": 20 }`)
+		res, err := Analyze(jsonPath, profiles, Options{})
+		if err != nil {
+			t.Fatalf("Analyze: %v", err)
+		}
+		typ := res.Files[0].Types[0]
+		if !res.Failed() || len(typ.Assertions) != 2 {
+			t.Fatalf("failed = %v, assertions = %+v, want the two stacks that moved by 28pp", res.Failed(), typ.Assertions)
+		}
+		for _, a := range typ.Assertions {
+			if a.Kind != AssertBaselineShare || a.Verdict != VerdictFail || a.Error != 28 {
+				t.Errorf("assertion = %+v", a)
+			}
+		}
+	})
+
+	t.Run("diagnosis", func(t *testing.T) {
+		jsonPath := writeBaselineExpectations(t, t.TempDir(), map[string]int64{"main;handler.func1;parse": 80, "main;write": 10, "main;idle": 10}, `{ "file": "baseline.yaml" }`)
+		res, _ := Analyze(jsonPath, profiles, Options{})
+		a := res.Files[0].Types[0].Assertions[0]
+		if a.Kind != AssertBaseline || a.Verdict != VerdictFail || a.Tolerance != defaultMaxDistance || a.Diagnosis == nil {
+			t.Fatalf("assertion = %+v, want a failed baseline assertion with the default tolerance", a)
+		}
+		if got := a.Diagnosis.String(); !strings.Contains(got, "80.00% -> 52.00% (-28.00pp)  80 -> 52 (-35.0%)  main;handler.func;parse") {
+			t.Errorf("diagnosis:\n%s", got)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		dir := t.TempDir()
+		jsonPath := writeBaselineExpectations(t, dir, map[string]int64{"main": 1}, `{ "file": "other.json" }`)
+		if _, err := Analyze(jsonPath, profiles, Options{}); err == nil || !strings.Contains(err.Error(), "Error loading baseline other.json") {
+			t.Errorf("err = %v", err)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+// ProfileSet builder: the public way to construct a ProfileSet from formats
+// this package has no adapter for, or from synthetic data, and assert on it
+// with AnalyzeProfileSet.
+package analysis
+
+import (
+	"maps"
+	"slices"
+)
+
+// ProfileSetBuilder accumulates samples into a ProfileSet. Its methods return
+// the builder, so calls can be chained:
+//
+//	ps := analysis.NewProfileSetBuilder().
+//		Add("cpu", analysis.StackSample{Stack: "main;work", Val: 90}).
+//		Add("cpu", analysis.StackSample{Stack: "main;idle", Val: 10}).
+//		SetDuration("cpu", 10).
+//		Build()
+type ProfileSetBuilder struct {
+	ps  *ProfileSet
+	dur map[string]float64
+}
+
+// NewProfileSetBuilder returns a builder of an empty ProfileSet.
+func NewProfileSetBuilder() *ProfileSetBuilder {
+	return &ProfileSetBuilder{ps: newProfileSet(), dur: map[string]float64{}}
+}
+
+// Add appends a sample to a profile type, creating the type on first use.
+// The stack is folded root-first ("main;work;compute"); label keys are
+// normalized with the other adapters' (see the Label* constants). The labels
+// are copied.
+func (b *ProfileSetBuilder) Add(profileType string, s StackSample) *ProfileSetBuilder {
+	labels := make(map[string][]string, len(s.Labels))
+	for k, v := range s.Labels {
+		key := canonKey(k)
+		labels[key] = append(labels[key], v...)
+	}
+	for k := range labels {
+		slices.Sort(labels[k])
+	}
+	b.ps.addSample(profileType, b.ps.internStack(s.Stack), b.ps.internLabels(labels), s.Val)
+	return b
+}
+
+// SetDuration sets the duration in seconds of a profile type, by which
+// expected values are scaled when the expectations have
+// scale_by_duration. Types without one are snapshots. As for profile files, a
+// type whose values sum to 0 has no duration.
+func (b *ProfileSetBuilder) SetDuration(profileType string, seconds float64) *ProfileSetBuilder {
+	b.dur[profileType] = seconds
+	return b
+}
+
+// AddFact records a fact about the run for `when` conditions (see Facts). The
+// first value of a key wins.
+func (b *ProfileSetBuilder) AddFact(key, value string) *ProfileSetBuilder {
+	b.ps.addFact(key, value)
+	return b
+}
+
+// Build returns the ProfileSet, with each type's samples sorted heaviest
+// first. The builder is reset to an empty ProfileSet.
+func (b *ProfileSetBuilder) Build() *ProfileSet {
+	ps := b.ps
+	for _, t := range slices.Sorted(maps.Keys(b.dur)) {
+		ps.addProfileDuration(t, ps.Total(t), b.dur[t])
+	}
+	*b = *NewProfileSetBuilder()
+	return ps.finalize()
+}
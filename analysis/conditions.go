@@ -0,0 +1,185 @@
+// Conditional expectations: `when` clauses on TypedStacks / StackContent that
+// are evaluated against facts describing the run (runtime and profiler
+// versions, tags, environment). They let one expected_profile.json carry
+// expectations that only hold for some Python/Ruby/Node or profiler releases
+// instead of duplicating a scenario per version.
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+// Condition is one entry of a `when` clause. Fact names a key in the run's
+// Facts; exactly one of Version (a semver constraint such as ">= 3.11, < 3.13"),
+// Equals (exact string) or Regex must be set. A condition on a fact that is
+// not present never holds.
+type Condition struct {
+	Fact    string `json:"fact"`
+	Version string `json:"version,omitempty"`
+	Equals  string `json:"equals,omitempty"`
+	Regex   string `json:"regex,omitempty"`
+}
+
+// Custom unmarshaller for Condition to ensure exactly one matcher is defined
+func (c *Condition) UnmarshalJSON(data []byte) error {
+	type condition Condition
+	var tmp condition
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	n := 0
+	for _, m := range []string{tmp.Version, tmp.Equals, tmp.Regex} {
+		if m != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("condition on fact %q: exactly one of version, equals and regex must be defined", tmp.Fact)
+	}
+
+	*c = Condition(tmp)
+	return nil
+}
+
+func (c Condition) String() string {
+	switch {
+	case c.Version != "":
+		return fmt.Sprintf("%s version %s", c.Fact, c.Version)
+	case c.Regex != "":
+		return fmt.Sprintf("%s =~ /%s/", c.Fact, c.Regex)
+	default:
+		return fmt.Sprintf("%s == %q", c.Fact, c.Equals)
+	}
+}
+
+// versionInFact extracts the first version-looking token from a fact value,
+// so facts such as "CPython 3.11.4" or "v2.3.0-rc1" compare as versions.
+var versionInFact = regexp.MustCompile(`[0-9]+(\.[0-9]+)*(-[0-9A-Za-z.]+)?`)
+
+// Eval reports whether the condition holds for facts. When it does not, the
+// returned reason says why, for the "skipped" log line.
+func (c Condition) Eval(facts Facts) (bool, string, error) {
+	actual, ok := facts[c.Fact]
+	if !ok {
+		return false, fmt.Sprintf("fact %q is not set", c.Fact), nil
+	}
+	switch {
+	case c.Version != "":
+		constraints, err := version.NewConstraint(c.Version)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid version constraint %q for fact %q: %v", c.Version, c.Fact, err)
+		}
+		v, err := version.NewVersion(versionInFact.FindString(actual))
+		if err != nil {
+			return false, fmt.Sprintf("fact %q = %q is not a version", c.Fact, actual), nil
+		}
+		if !constraints.Check(v) {
+			return false, fmt.Sprintf("fact %q = %q does not satisfy %q", c.Fact, actual, c.Version), nil
+		}
+	case c.Regex != "":
+		rx, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid regex %q for fact %q: %v", c.Regex, c.Fact, err)
+		}
+		if !rx.MatchString(actual) {
+			return false, fmt.Sprintf("fact %q = %q does not match /%s/", c.Fact, actual, c.Regex), nil
+		}
+	default:
+		if actual != c.Equals {
+			return false, fmt.Sprintf("fact %q = %q is not %q", c.Fact, actual, c.Equals), nil
+		}
+	}
+	return true, "", nil
+}
+
+// evalWhen reports whether every condition holds (an empty clause always
+// does), with the reason of the first one that does not.
+func evalWhen(when []Condition, facts Facts) (bool, string, error) {
+	for _, c := range when {
+		ok, reason, err := c.Eval(facts)
+		if err != nil || !ok {
+			return false, reason, err
+		}
+	}
+	return true, "", nil
+}
+
+// Facts are the key/value pairs `when` conditions are evaluated against.
+type Facts map[string]string
+
+// Keys returns the fact names in sorted order.
+func (f Facts) Keys() []string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// envFactPrefix namespaces environment variables among the facts, so e.g.
+// DD_PROFILING_TIMELINE_ENABLED is available as env.DD_PROFILING_TIMELINE_ENABLED.
+const envFactPrefix = "env."
+
+// ddTagsEnv lists the environment variables holding Datadog tags
+// (comma-separated key:value pairs). Each tag becomes a fact of its own.
+var ddTagsEnv = []string{"DD_TAGS", "DD_PROFILING_TAGS"}
+
+// FactsFor returns the facts describing the run that produced ps: the facts
+// the format adapter extracted from the profile itself (pprof comments, OTLP
+// resource attributes), Datadog tags from the environment, and every
+// environment variable under the "env." prefix. Profile facts win over tags.
+func FactsFor(ps *ProfileSet) Facts {
+	facts := Facts{}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			facts[envFactPrefix+k] = v
+		}
+	}
+	for _, name := range ddTagsEnv {
+		for k, v := range parseDDTags(os.Getenv(name)) {
+			facts[k] = v
+		}
+	}
+	if ps != nil {
+		for k, v := range ps.facts {
+			facts[k] = v
+		}
+	}
+	return facts
+}
+
+// parseDDTags parses Datadog's "k1:v1,k2:v2" tag format. Tags without a value
+// are ignored; only the first colon separates the key from the value.
+func parseDDTags(s string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if k, v, ok := strings.Cut(tag, ":"); ok && k != "" {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// parseFactComment extracts a fact from a free-form profile comment of the
+// form "key=value" or "key: value". Other comments are ignored.
+func parseFactComment(comment string) (string, string, bool) {
+	sep := strings.IndexAny(comment, "=:")
+	if sep <= 0 {
+		return "", "", false
+	}
+	k := strings.TrimSpace(comment[:sep])
+	v := strings.TrimSpace(comment[sep+1:])
+	if k == "" || strings.ContainsAny(k, " \t") {
+		return "", "", false
+	}
+	return k, v, true
+}
@@ -0,0 +1,152 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+// TestConditionEval covers each matcher kind, version extraction from noisy
+// fact values, and the not-set / invalid-constraint paths.
+func TestConditionEval(t *testing.T) {
+	facts := Facts{
+		"runtime_version":         "CPython 3.11.4",
+		"profiler_version":        "v2.3.0-rc1",
+		"language":                "python",
+		"process.runtime.version": "not-a-version",
+	}
+	cases := []struct {
+		c    Condition
+		want bool
+	}{
+		{Condition{Fact: "runtime_version", Version: ">= 3.11, < 3.13"}, true},
+		{Condition{Fact: "runtime_version", Version: "< 3.11"}, false},
+		{Condition{Fact: "profiler_version", Version: ">= 2.2"}, false}, // pre-releases only match explicit pre-release constraints
+		{Condition{Fact: "profiler_version", Version: ">= 2.3.0-rc0"}, true},
+		{Condition{Fact: "language", Equals: "python"}, true},
+		{Condition{Fact: "language", Equals: "ruby"}, false},
+		{Condition{Fact: "language", Regex: "^py"}, true},
+		{Condition{Fact: "process.runtime.version", Version: ">= 1"}, false},
+		{Condition{Fact: "missing", Equals: "x"}, false},
+	}
+	for _, tc := range cases {
+		got, reason, err := tc.c.Eval(facts)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.c, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %v (%s), want %v", tc.c, got, reason, tc.want)
+		}
+		if !got && reason == "" {
+			t.Errorf("%s: a condition that does not hold must give a reason", tc.c)
+		}
+	}
+
+	if _, _, err := (Condition{Fact: "language", Version: "~>>"}).Eval(facts); err == nil {
+		t.Error("expected an error for an invalid version constraint")
+	}
+}
+
+// TestConditionUnmarshal requires exactly one matcher per condition.
+func TestConditionUnmarshal(t *testing.T) {
+	var c Condition
+	if err := json.Unmarshal([]byte(`{"fact": "a", "equals": "b"}`), &c); err != nil {
+		t.Errorf("valid condition rejected: %v", err)
+	}
+	for _, bad := range []string{`{"fact": "a"}`, `{"fact": "a", "equals": "b", "regex": "c"}`} {
+		if err := json.Unmarshal([]byte(bad), &c); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+// TestFactsFor covers the fact sources: pprof comments, DD_TAGS and plain
+// environment variables, with profile facts taking precedence over tags.
+func TestFactsFor(t *testing.T) {
+	t.Setenv("DD_TAGS", "runtime_version:3.10.0,team:profiling")
+	t.Setenv("PROF_CORRECTNESS_FACT", "yes")
+
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "count"}},
+		Comments:   []string{"runtime_version=3.12.1", "profiler_version: 2.3.0", "just a free-form comment"},
+	}
+	facts := FactsFor(FromPprof(p))
+
+	want := map[string]string{
+		"runtime_version":           "3.12.1",
+		"profiler_version":          "2.3.0",
+		"team":                      "profiling",
+		"env.PROF_CORRECTNESS_FACT": "yes",
+	}
+	for k, v := range want {
+		if facts[k] != v {
+			t.Errorf("fact %q = %q, want %q", k, facts[k], v)
+		}
+	}
+	if _, ok := facts["just a free-form comment"]; ok {
+		t.Error("free-form comment leaked as a fact")
+	}
+}
+
+// TestAnalyze_WhenSkipsNonApplicable drives the analyzer end to end: entries
+// whose conditions don't hold are reported as skipped (not failed), while the
+// applicable ones are still asserted.
+func TestAnalyze_WhenSkipsNonApplicable(t *testing.T) {
+	dir := t.TempDir()
+	fn := &profile.Function{ID: 1, Name: "hot"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "count"}},
+		Function:   []*profile.Function{fn},
+		Location:   []*profile.Location{loc},
+		Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{10}}},
+		Comments:   []string{"runtime_version=3.11.4"},
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+"/profile.pprof", buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := dir + "/expected_profile.json"
+	if err := os.WriteFile(jsonPath, []byte(`{
+      "test_name": "when",
+      "stacks": [
+        {
+          "profile-type": "cpu",
+          "stack-content": [
+            { "regular_expression": "^hot$", "value": 10, "error_margin": 0,
+              "when": [{ "fact": "runtime_version", "version": ">= 3.11" }] },
+            { "regular_expression": "^hot$", "value": 999, "error_margin": 0,
+              "when": [{ "fact": "runtime_version", "version": "< 3.11" }] }
+          ]
+        },
+        {
+          "profile-type": "wall",
+          "when": [{ "fact": "runtime_version", "version": "< 3.11" }],
+          "stack-content": [{ "regular_expression": "^hot$", "value": 1 }]
+        }
+      ]
+    }`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	r := NewStdReporter(&out, &out)
+	Run(r, func() { AnalyzeResults(r, jsonPath, dir) })
+	if r.Failed() {
+		t.Fatalf("non-applicable entries must not fail the analysis:\n%s", out.String())
+	}
+	if got := strings.Count(out.String(), "skipped"); got != 2 {
+		t.Errorf("expected 2 skipped entries, got %d:\n%s", got, out.String())
+	}
+	if !strings.Contains(out.String(), `does not satisfy "< 3.11"`) {
+		t.Errorf("skip reason missing from output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,278 @@
+// Diagnostics for failed stack assertions: instead of only "was 0 with 100%
+// error", list the heaviest actual stacks closest to the expected regex and,
+// when labels filtered matching stacks out, which label check failed and the
+// label values the profile actually has.
+package analysis
+
+import (
+	"fmt"
+	"iter"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	// nearestStacksCount is how many actual stacks a Diagnosis lists.
+	nearestStacksCount = 5
+	// labelValuesCount is how many actual label values a LabelMismatch lists.
+	labelValuesCount = 5
+	// missingLabel stands for a sample without the expected label key.
+	missingLabel = "<missing>"
+)
+
+// Diagnosis explains why a stack or baseline assertion failed.
+type Diagnosis struct {
+	// NearestStacks are the actual stacks most similar to the regex, closest
+	// first and heaviest first among equally close ones.
+	NearestStacks []NearStack `json:"nearest_stacks,omitempty"`
+	// LabelMismatches describe the samples whose stack matched the regex but
+	// that a label check excluded, one entry per failing label check.
+	LabelMismatches []LabelMismatch `json:"label_mismatches,omitempty"`
+	// BaselineChanges are, for a failed baseline assertion, the stacks whose
+	// share of the profile changed the most.
+	BaselineChanges []StackDiff `json:"baseline_changes,omitempty"`
+}
+
+// NearStack is an actual stack and how far it is from the expected regex.
+type NearStack struct {
+	Stack string `json:"stack"`
+	Value int64  `json:"value"`
+	// Percent is the share of the profile's total value.
+	Percent float64 `json:"percent"`
+	// Distance is the number of frames to insert, delete or replace for the
+	// stack to match the regex (0 when it matches frame by frame).
+	Distance int `json:"distance"`
+}
+
+// LabelMismatch is an expected label that samples with a matching stack did
+// not satisfy.
+type LabelMismatch struct {
+	Key string `json:"key"`
+	// Expected is the expected values, or the values_regex.
+	Expected string `json:"expected"`
+	// Actual lists the label values of the excluded samples, heaviest first.
+	Actual []LabelValue `json:"actual"`
+	// Value is the total value of the excluded samples.
+	Value int64 `json:"value"`
+}
+
+// LabelValue is one set of values of a label, as found on samples.
+type LabelValue struct {
+	Values string `json:"values"` // e.g. "[1 2]", or "<missing>"
+	Value  int64  `json:"value"`
+}
+
+// Lines formats the diagnosis for logs, one line per item.
+func (d *Diagnosis) Lines() []string {
+	var lines []string
+	for _, m := range d.LabelMismatches {
+		actual := make([]string, len(m.Actual))
+		for i, v := range m.Actual {
+			actual[i] = fmt.Sprintf("%s (value %d)", v.Values, v.Value)
+		}
+		lines = append(lines, fmt.Sprintf("Matching stacks worth %d were excluded by label '%s': expected %s, got %s", m.Value, m.Key, m.Expected, strings.Join(actual, ", ")))
+	}
+	if len(d.NearestStacks) > 0 {
+		lines = append(lines, "Nearest actual stacks (frame distance, share of profile, value):")
+		for _, s := range d.NearestStacks {
+			lines = append(lines, fmt.Sprintf("  %d  %5.1f%%  %d  %s", s.Distance, s.Percent, s.Value, s.Stack))
+		}
+	}
+	if len(d.BaselineChanges) > 0 {
+		lines = append(lines, "Largest changes from the baseline (share of profile, value):")
+		for _, s := range d.BaselineChanges {
+			lines = append(lines, fmt.Sprintf("  %s  %s  %s", s.FormatShare(), s.FormatChange(), s.Stack))
+		}
+	}
+	return lines
+}
+
+// String formats the diagnosis as a multi-line string.
+func (d *Diagnosis) String() string {
+	return strings.Join(d.Lines(), "\n")
+}
+
+// diagnose builds the Diagnosis of a failed assertion of regexpStack against
+// prof. excluded holds, by index in labels, the samples whose stack matched
+// but that failed that label check.
+func diagnose(prof iter.Seq[StackSample], total int64, regexpStack string, labels []Labels, excluded map[int][]StackSample) *Diagnosis {
+	d := &Diagnosis{}
+
+	for i, l := range labels {
+		samples := excluded[i]
+		if len(samples) == 0 {
+			continue
+		}
+		m := LabelMismatch{Key: l.Key, Expected: fmt.Sprint(l.Values)}
+		if l.Values == nil {
+			m.Expected = fmt.Sprintf("values matching '%s'", l.ValuesRegex)
+		}
+		values := map[string]int64{}
+		for _, ss := range samples {
+			m.Value += ss.Val
+			if v, ok := ss.Labels[l.Key]; ok {
+				values[fmt.Sprint(v)] += ss.Val
+			} else {
+				values[missingLabel] += ss.Val
+			}
+		}
+		for v, value := range values {
+			m.Actual = append(m.Actual, LabelValue{Values: v, Value: value})
+		}
+		sort.Slice(m.Actual, func(a, b int) bool {
+			if m.Actual[a].Value != m.Actual[b].Value {
+				return m.Actual[a].Value > m.Actual[b].Value
+			}
+			return m.Actual[a].Values < m.Actual[b].Values
+		})
+		if len(m.Actual) > labelValuesCount {
+			m.Actual = m.Actual[:labelValuesCount]
+		}
+		d.LabelMismatches = append(d.LabelMismatches, m)
+	}
+
+	values := map[string]int64{}
+	for ss := range prof {
+		values[ss.Stack] += ss.Val
+	}
+	pattern := parseStackPattern(regexpStack)
+	for stack, value := range values {
+		near := NearStack{Stack: stack, Value: value, Distance: pattern.distance(stack)}
+		if total != 0 {
+			near.Percent = 100 * float64(value) / float64(total)
+		}
+		d.NearestStacks = append(d.NearestStacks, near)
+	}
+	sort.Slice(d.NearestStacks, func(a, b int) bool {
+		sa, sb := d.NearestStacks[a], d.NearestStacks[b]
+		if sa.Distance != sb.Distance {
+			return sa.Distance < sb.Distance
+		}
+		if sa.Value != sb.Value {
+			return sa.Value > sb.Value
+		}
+		return sa.Stack < sb.Stack
+	})
+	if len(d.NearestStacks) > nearestStacksCount {
+		d.NearestStacks = d.NearestStacks[:nearestStacksCount]
+	}
+	return d
+}
+
+// stackPattern is a stack regex split into per-frame patterns, to compare it
+// with actual stacks frame by frame. The split on ';' is a heuristic: a regex
+// whose groups span frames is compared as best it can be, which is enough to
+// rank stacks by similarity.
+type stackPattern struct {
+	frames        []framePattern
+	anchoredStart bool // ^: stack frames before the pattern are not free
+	anchoredEnd   bool // $: stack frames after the pattern are not free
+}
+
+type framePattern struct {
+	// wildcard frames (".*", ".+", "") match any number of stack frames.
+	wildcard bool
+	rx       *regexp.Regexp // nil if the frame is not a valid regex on its own
+	literal  string
+	cache    map[string]bool
+}
+
+func parseStackPattern(regexpStack string) stackPattern {
+	p := stackPattern{}
+	s := regexpStack
+	if strings.HasPrefix(s, "^") {
+		p.anchoredStart = true
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "$") && !strings.HasSuffix(s, `\$`) {
+		p.anchoredEnd = true
+		s = s[:len(s)-1]
+	}
+	parts := strings.Split(s, ";")
+	for i, part := range parts {
+		f := framePattern{literal: part, cache: map[string]bool{}}
+		switch part {
+		case "", ".*", ".+", ".*?", "(.*)":
+			f.wildcard = true
+		default:
+			// A frame is whole unless it is the first or last piece of an
+			// unanchored regex, which may match the end or start of a frame.
+			prefix, suffix := "^", "$"
+			if i == 0 && !p.anchoredStart {
+				prefix = ""
+			}
+			if i == len(parts)-1 && !p.anchoredEnd {
+				suffix = ""
+			}
+			f.rx, _ = regexp.Compile(prefix + "(?:" + part + ")" + suffix)
+		}
+		p.frames = append(p.frames, f)
+	}
+	return p
+}
+
+func (f *framePattern) matches(frame string) bool {
+	if f.wildcard {
+		return true
+	}
+	ok, cached := f.cache[frame]
+	if !cached {
+		if f.rx != nil {
+			ok = f.rx.MatchString(frame)
+		} else {
+			ok = f.literal == frame
+		}
+		f.cache[frame] = ok
+	}
+	return ok
+}
+
+// distance is the frame-level edit distance between the pattern and stack:
+// the number of frames to insert, delete or replace for stack to match.
+// Wildcards absorb any number of frames, as do the ends of the stack the
+// regex is not anchored to.
+func (p stackPattern) distance(stack string) int {
+	var frames []string
+	if stack != "" {
+		frames = strings.Split(stack, ";")
+	}
+	n := len(frames)
+	cost := func(f *framePattern) int {
+		if f.wildcard {
+			return 0
+		}
+		return 1
+	}
+
+	// prev[j] is the distance between the first i pattern frames and the
+	// first j stack frames.
+	prev := make([]int, n+1)
+	cur := make([]int, n+1)
+	for j := range prev {
+		if p.anchoredStart {
+			prev[j] = j
+		}
+	}
+	for i := range p.frames {
+		f := &p.frames[i]
+		cur[0] = prev[0] + cost(f)
+		for j := 1; j <= n; j++ {
+			replace := prev[j-1]
+			if !f.matches(frames[j-1]) {
+				replace++
+			}
+			cur[j] = min(
+				prev[j]+cost(f),  // pattern frame missing from the stack
+				cur[j-1]+cost(f), // extra stack frame
+				replace,
+			)
+		}
+		prev, cur = cur, prev
+	}
+	if p.anchoredEnd {
+		return prev[n]
+	}
+	return slices.Min(prev)
+}
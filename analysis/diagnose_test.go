@@ -0,0 +1,94 @@
+package analysis
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStackPatternDistance(t *testing.T) {
+	tests := []struct {
+		regex, stack string
+		want         int
+	}{
+		{"^main;foo;bar$", "main;foo;bar", 0},
+		{"^main;foo;bar$", "main;foo;baz", 1},      // replaced frame
+		{"^main;foo;bar$", "main;bar", 1},          // missing frame
+		{"^main;foo;bar$", "main;foo;x;bar", 1},    // extra frame
+		{"^main;foo;bar$", "main;foo;bar;leaf", 1}, // anchored end
+		{";bar$", "a;b;c;bar", 0},                  // unanchored start is free
+		{"^main;.*;bar$", "main;a;b;c;bar", 0},     // wildcards absorb frames
+		{"^main;.*foo;bar$", "main;pkg.foo;bar", 0},
+		{"main;fo", "x;main;foo;y", 0}, // unanchored ends match partial frames
+		{"^main;work$", "", 2},
+		{"^a;(b$", "a;(b", 0}, // invalid per-frame regexes compare literally
+	}
+	for _, tt := range tests {
+		if got := parseStackPattern(tt.regex).distance(tt.stack); got != tt.want {
+			t.Errorf("distance(%q, %q) = %d, want %d", tt.regex, tt.stack, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	prof := []StackSample{
+		{Stack: "main;work;compute", Val: 60, Labels: map[string][]string{"thread": {"worker"}}},
+		{Stack: "main;work;compute", Val: 20},
+		{Stack: "main;idle", Val: 15},
+		{Stack: "gc;mark", Val: 5},
+	}
+	labels := []Labels{{Key: "thread", Values: []string{"main"}}}
+	assertions, matching, _, err := assertStackWithFailureHandling(discardReporter{}, samplesOf(prof), "cpu", "^main;work;compute$", compileStackMatcher("^main;work;compute$", labels), Optional[float64]{}, NewOptionalFrom[int64](80), 5, labels, false, nil, Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matching != 0 || len(assertions) != 1 || assertions[0].Verdict != VerdictFail {
+		t.Fatalf("expected a failure, got matching=%d %+v", matching, assertions)
+	}
+	d := assertions[0].Diagnosis
+	if d == nil {
+		t.Fatal("failed assertion has no diagnosis")
+	}
+
+	if len(d.LabelMismatches) != 1 {
+		t.Fatalf("expected one label mismatch, got %+v", d.LabelMismatches)
+	}
+	m := d.LabelMismatches[0]
+	if m.Key != "thread" || m.Expected != "[main]" || m.Value != 80 {
+		t.Errorf("unexpected label mismatch %+v", m)
+	}
+	if want := []LabelValue{{"[worker]", 60}, {missingLabel, 20}}; len(m.Actual) != 2 || m.Actual[0] != want[0] || m.Actual[1] != want[1] {
+		t.Errorf("actual label values = %+v, want %+v", m.Actual, want)
+	}
+
+	want := []NearStack{
+		{Stack: "main;work;compute", Value: 80, Percent: 80, Distance: 0},
+		{Stack: "main;idle", Value: 15, Percent: 15, Distance: 2},
+		{Stack: "gc;mark", Value: 5, Percent: 5, Distance: 3},
+	}
+	if len(d.NearestStacks) != len(want) {
+		t.Fatalf("nearest stacks = %+v, want %+v", d.NearestStacks, want)
+	}
+	for i := range want {
+		if d.NearestStacks[i] != want[i] {
+			t.Errorf("nearest stack %d = %+v, want %+v", i, d.NearestStacks[i], want[i])
+		}
+	}
+
+	text := d.String()
+	for _, s := range []string{"excluded by label 'thread': expected [main], got [worker] (value 60), <missing> (value 20)", "main;work;compute"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("missing %q in\n%s", s, text)
+		}
+	}
+}
+
+func TestDiagnose_OnlyOnFailure(t *testing.T) {
+	prof := []StackSample{{Stack: "main;work", Val: 10}}
+	assertions, _, _, err := assertStackWithFailureHandling(discardReporter{}, samplesOf(prof), "cpu", "^main;work$", compileStackMatcher("^main;work$", nil), Optional[float64]{}, NewOptionalFrom[int64](100), 5, nil, false, nil, Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assertions[0].Verdict != VerdictPass || assertions[0].Diagnosis != nil {
+		t.Errorf("passing assertion should have no diagnosis: %+v", assertions[0])
+	}
+}
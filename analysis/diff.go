@@ -0,0 +1,279 @@
+// Profile diffs: compare a baseline ProfileSet with a candidate, e.g. the same
+// scenario profiled by two releases of a profiler, stack by stack and label by
+// label. Values are compared both absolutely and as shares of their profile
+// type, which stay comparable when the runs lasted or sampled differently.
+package analysis
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DiffOptions configure Diff.
+type DiffOptions struct {
+	// Normalize rewrites each frame before stacks are aligned, so that frames
+	// naming the same code in both runs compare equal. Nil compares frames as
+	// they are; see NormalizeFrame.
+	Normalize func(frame string) string
+}
+
+// frameNoise are the parts of frame names that change from run to run
+// without the code changing.
+var frameNoise = []struct {
+	rx   *regexp.Regexp
+	repl string
+}{
+	// Java lambdas: Foo$$Lambda$123/0x0000000800c0b000, Foo$$Lambda/0x...
+	{regexp.MustCompile(`\$\$Lambda(\$[0-9]+)?([/.]0x[0-9a-fA-F]+)?`), "$$Lambda"},
+	// Go closures: main.handler.func2.1
+	{regexp.MustCompile(`\.func[0-9]+(\.[0-9]+)*`), ".func"},
+	{regexp.MustCompile(`0x[0-9a-fA-F]+`), "0x?"},
+	// Line numbers: parse.py:42
+	{regexp.MustCompile(`:[0-9]+$`), ""},
+}
+
+// NormalizeFrame removes from a frame what differs between runs of the same
+// code: addresses, Java lambda and Go closure numbers, and line numbers.
+func NormalizeFrame(frame string) string {
+	for _, n := range frameNoise {
+		frame = n.rx.ReplaceAllLiteralString(frame, n.repl)
+	}
+	return frame
+}
+
+// ProfileDiff is the comparison of a baseline ProfileSet with a candidate.
+type ProfileDiff struct {
+	// Types lists the profile types of the baseline, then those only in the
+	// candidate.
+	Types []TypeDiff `json:"types"`
+}
+
+// TypeDiff compares one profile type.
+type TypeDiff struct {
+	ProfileType string `json:"profile_type"`
+	// Total compares the total values.
+	Total DiffValues `json:"total"`
+	// Distance is the total-variation distance between the distributions of
+	// the values over stacks, in percent: the share of the profile that moved
+	// to other stacks, from 0 when they are the same to 100 when they have no
+	// stack in common.
+	Distance float64 `json:"distance"`
+	// Stacks and Labels list the (normalized) stacks, and the label values
+	// of each key, whose value or share changed, largest share change first.
+	Stacks []StackDiff `json:"stacks"`
+	Labels []LabelDiff `json:"labels"`
+}
+
+// StackDiff compares the value of a folded stack.
+type StackDiff struct {
+	Stack string `json:"stack"`
+	DiffValues
+}
+
+// LabelDiff compares the value of the samples with a label's values.
+type LabelDiff struct {
+	Key    string `json:"key"`
+	Values string `json:"values"` // e.g. "[1 2]"
+	DiffValues
+}
+
+// DiffValues compares a value in the baseline and in the candidate.
+type DiffValues struct {
+	Base      int64 `json:"base"`
+	Candidate int64 `json:"candidate"`
+	Delta     int64 `json:"delta"`
+	// ChangePercent is Delta relative to Base, in percent; nil when Base is
+	// 0.
+	ChangePercent *float64 `json:"change_percent,omitempty"`
+	// BaseShare and CandidateShare are the percent of their profile type's
+	// total value, and ShareDelta their difference, in percentage points.
+	BaseShare      float64 `json:"base_share"`
+	CandidateShare float64 `json:"candidate_share"`
+	ShareDelta     float64 `json:"share_delta"`
+}
+
+func newDiffValues(base, candidate, baseTotal, candidateTotal int64) DiffValues {
+	v := DiffValues{Base: base, Candidate: candidate, Delta: candidate - base}
+	if base != 0 {
+		change := float64(v.Delta) / math.Abs(float64(base)) * 100
+		v.ChangePercent = &change
+	}
+	if baseTotal != 0 {
+		v.BaseShare = float64(base) / float64(baseTotal) * 100
+	}
+	if candidateTotal != 0 {
+		v.CandidateShare = float64(candidate) / float64(candidateTotal) * 100
+	}
+	v.ShareDelta = v.CandidateShare - v.BaseShare
+	return v
+}
+
+// diffTable sums the values of keys in the baseline ([0]) and the candidate
+// ([1]), in first-seen order.
+type diffTable[K comparable] struct {
+	order  []K
+	values map[K]*[2]int64
+}
+
+func (t *diffTable[K]) add(k K, side int, val int64) {
+	if t.values == nil {
+		t.values = map[K]*[2]int64{}
+	}
+	v := t.values[k]
+	if v == nil {
+		v = &[2]int64{}
+		t.values[k] = v
+		t.order = append(t.order, k)
+	}
+	v[side] += val
+}
+
+// changed calls fn for the keys whose value or share of the totals changed.
+func (t *diffTable[K]) changed(baseTotal, candidateTotal int64, fn func(k K, v DiffValues)) {
+	for _, k := range t.order {
+		if v := newDiffValues(t.values[k][0], t.values[k][1], baseTotal, candidateTotal); v.Delta != 0 || v.ShareDelta != 0 {
+			fn(k, v)
+		}
+	}
+}
+
+// Diff compares candidate with base, profile type by profile type. Stacks are
+// aligned after normalizing their frames with opts.Normalize, and label
+// values are compared per key; samples without a key do not count for it.
+// The keys whose values change every run (captureKeysToIgnore: thread, span
+// and trace IDs, timestamps...) are not compared, as they never line up.
+func Diff(base, candidate *ProfileSet, opts DiffOptions) *ProfileDiff {
+	types := slices.Clone(base.order)
+	for _, t := range candidate.order {
+		if !base.Has(t) {
+			types = append(types, t)
+		}
+	}
+	normalized := map[string]string{}
+	normalize := func(stack string) string {
+		if opts.Normalize == nil {
+			return stack
+		}
+		n, ok := normalized[stack]
+		if !ok {
+			frames := strings.Split(stack, ";")
+			for i, f := range frames {
+				frames[i] = opts.Normalize(f)
+			}
+			n = strings.Join(frames, ";")
+			normalized[stack] = n
+		}
+		return n
+	}
+
+	d := &ProfileDiff{}
+	for _, t := range types {
+		var stacks diffTable[string]
+		var labels diffTable[[2]string]
+		for side, ps := range []*ProfileSet{base, candidate} {
+			for ss := range ps.All(t) {
+				stacks.add(normalize(ss.Stack), side, ss.Val)
+				for k, v := range ss.Labels {
+					if containsStr(captureKeysToIgnore, k) {
+						continue
+					}
+					labels.add([2]string{k, fmt.Sprint(v)}, side, ss.Val)
+				}
+			}
+		}
+		baseTotal, candidateTotal := base.Total(t), candidate.Total(t)
+		td := TypeDiff{ProfileType: t, Total: newDiffValues(baseTotal, candidateTotal, baseTotal, candidateTotal)}
+		stacks.changed(baseTotal, candidateTotal, func(stack string, v DiffValues) {
+			td.Distance += math.Abs(v.ShareDelta) / 2
+			td.Stacks = append(td.Stacks, StackDiff{Stack: stack, DiffValues: v})
+		})
+		labels.changed(baseTotal, candidateTotal, func(kv [2]string, v DiffValues) {
+			td.Labels = append(td.Labels, LabelDiff{Key: kv[0], Values: kv[1], DiffValues: v})
+		})
+		slices.SortStableFunc(td.Stacks, func(a, b StackDiff) int { return compareDiffValues(a.DiffValues, b.DiffValues) })
+		slices.SortStableFunc(td.Labels, func(a, b LabelDiff) int {
+			return cmp.Or(compareDiffValues(a.DiffValues, b.DiffValues), strings.Compare(a.Key, b.Key))
+		})
+		d.Types = append(d.Types, td)
+	}
+	return d
+}
+
+// compareDiffValues orders the largest share changes first, then the largest
+// value changes.
+func compareDiffValues(a, b DiffValues) int {
+	return cmp.Or(
+		cmp.Compare(math.Abs(b.ShareDelta), math.Abs(a.ShareDelta)),
+		cmp.Compare(abs(b.Delta), abs(a.Delta)),
+	)
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// DiffThresholds are the changes a ProfileDiff may show; 0 disables a
+// threshold.
+type DiffThresholds struct {
+	// MaxTotalChange is the largest change, in percent, of a profile type's
+	// total value. A type missing from either side exceeds any threshold.
+	MaxTotalChange float64
+	// MaxDistance is the largest distance of a profile type (see
+	// TypeDiff.Distance), in percent.
+	MaxDistance float64
+	// MaxShareDelta is the largest change of a stack's or label value's share
+	// of its profile type, in percentage points.
+	MaxShareDelta float64
+}
+
+// Exceeded describes the changes of d beyond th, in order.
+func (d *ProfileDiff) Exceeded(th DiffThresholds) []string {
+	var out []string
+	for _, t := range d.Types {
+		if th.MaxTotalChange > 0 && t.Total.Delta != 0 {
+			if c := t.Total.ChangePercent; c == nil || math.Abs(*c) > th.MaxTotalChange {
+				out = append(out, fmt.Sprintf("%s: total %s, more than %g%%", t.ProfileType, t.Total.FormatChange(), th.MaxTotalChange))
+			}
+		}
+		if th.MaxDistance > 0 && t.Distance > th.MaxDistance {
+			out = append(out, fmt.Sprintf("%s: distance %.1f%%, more than %g%%", t.ProfileType, t.Distance, th.MaxDistance))
+		}
+		if th.MaxShareDelta <= 0 {
+			continue
+		}
+		for _, s := range t.Stacks {
+			if math.Abs(s.ShareDelta) > th.MaxShareDelta {
+				out = append(out, fmt.Sprintf("%s: stack %s: share %s, more than %gpp", t.ProfileType, s.Stack, s.FormatShare(), th.MaxShareDelta))
+			}
+		}
+		for _, l := range t.Labels {
+			if math.Abs(l.ShareDelta) > th.MaxShareDelta {
+				out = append(out, fmt.Sprintf("%s: label %s=%s: share %s, more than %gpp", t.ProfileType, l.Key, l.Values, l.FormatShare(), th.MaxShareDelta))
+			}
+		}
+	}
+	return out
+}
+
+// FormatChange formats the values and their relative change, e.g.
+// "100 -> 150 (+50.0%)", or "0 -> 150 (new)".
+func (v DiffValues) FormatChange() string {
+	change := "new"
+	if v.ChangePercent != nil {
+		change = fmt.Sprintf("%+.1f%%", *v.ChangePercent)
+	}
+	return fmt.Sprintf("%d -> %d (%s)", v.Base, v.Candidate, change)
+}
+
+// FormatShare formats the shares and their change, e.g.
+// "10.00% -> 15.00% (+5.00pp)".
+func (v DiffValues) FormatShare() string {
+	return fmt.Sprintf("%.2f%% -> %.2f%% (%+.2fpp)", v.BaseShare, v.CandidateShare, v.ShareDelta)
+}
@@ -0,0 +1,146 @@
+package analysis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeFrame(t *testing.T) {
+	for frame, want := range map[string]string{
+		"com.example.Foo$$Lambda$123/0x0000000800c0b000.run": "com.example.Foo$$Lambda.run",
+		"com.example.Foo$$Lambda/0x0000000800c0b000.run":     "com.example.Foo$$Lambda.run",
+		"main.handler.func2.1":                               "main.handler.func",
+		"libc.so.6+0x7f12ab":                                 "libc.so.6+0x?",
+		"parse.py:42":                                        "parse.py",
+		"main.work":                                          "main.work",
+	} {
+		if got := NormalizeFrame(frame); got != want {
+			t.Errorf("NormalizeFrame(%q) = %q, want %q", frame, got, want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	base := NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;handler.func1;work", Val: 80, Labels: map[string][]string{"thread name": {"w1"}}}).
+		Add("cpu", StackSample{Stack: "main;idle", Val: 20}).
+		Add("alloc", StackSample{Stack: "main;alloc", Val: 5}).
+		Build()
+	candidate := NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;handler.func3;work", Val: 120, Labels: map[string][]string{"thread name": {"w1"}}}).
+		Add("cpu", StackSample{Stack: "main;idle", Val: 20}).
+		Add("cpu", StackSample{Stack: "main;gc", Val: 60}).
+		Add("wall", StackSample{Stack: "main", Val: 1}).
+		Build()
+
+	d := Diff(base, candidate, DiffOptions{Normalize: NormalizeFrame})
+	var types []string
+	for _, td := range d.Types {
+		types = append(types, td.ProfileType)
+	}
+	if got := strings.Join(types, ","); got != "cpu,alloc,wall" {
+		t.Fatalf("types = %s, want the baseline's then the candidate's", got)
+	}
+
+	cpu := d.Types[0]
+	if got := cpu.Total.FormatChange(); got != "100 -> 200 (+100.0%)" {
+		t.Errorf("total = %s", got)
+	}
+	if cpu.Distance != 30 {
+		t.Errorf("distance = %v, want the 30%% that moved to gc", cpu.Distance)
+	}
+	// gc is new; idle kept its value but halved its share.
+	var stacks []string
+	for _, s := range cpu.Stacks {
+		stacks = append(stacks, s.Stack+" "+s.FormatChange()+" "+s.FormatShare())
+	}
+	want := []string{
+		"main;gc 0 -> 60 (new) 0.00% -> 30.00% (+30.00pp)",
+		"main;handler.func;work 80 -> 120 (+50.0%) 80.00% -> 60.00% (-20.00pp)",
+		"main;idle 20 -> 20 (+0.0%) 20.00% -> 10.00% (-10.00pp)",
+	}
+	if strings.Join(stacks, "\n") != strings.Join(want, "\n") {
+		t.Errorf("stacks:\n%s\nwant\n%s", strings.Join(stacks, "\n"), strings.Join(want, "\n"))
+	}
+	if len(cpu.Labels) != 1 || cpu.Labels[0].Key != "thread name" || cpu.Labels[0].Values != "[w1]" || cpu.Labels[0].Delta != 40 {
+		t.Errorf("labels = %+v", cpu.Labels)
+	}
+	if got := d.Types[1].Total.FormatChange(); got != "5 -> 0 (-100.0%)" {
+		t.Errorf("alloc total = %s", got)
+	}
+
+	// Without normalization the closures do not align.
+	if raw := Diff(base, candidate, DiffOptions{}); len(raw.Types[0].Stacks) != 4 {
+		t.Errorf("raw stacks = %+v, want 4", raw.Types[0].Stacks)
+	}
+}
+
+func TestDiffExceeded(t *testing.T) {
+	base := NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;a", Val: 50}).
+		Add("cpu", StackSample{Stack: "main;b", Val: 50}).
+		Build()
+	candidate := NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;a", Val: 66}).
+		Add("cpu", StackSample{Stack: "main;b", Val: 44}).
+		Build()
+	d := Diff(base, candidate, DiffOptions{})
+
+	if got := d.Exceeded(DiffThresholds{}); len(got) != 0 {
+		t.Errorf("no thresholds: %v", got)
+	}
+	if got := d.Exceeded(DiffThresholds{MaxTotalChange: 10, MaxShareDelta: 10}); len(got) != 0 {
+		t.Errorf("within thresholds: %v", got)
+	}
+	got := d.Exceeded(DiffThresholds{MaxTotalChange: 5, MaxDistance: 5, MaxShareDelta: 5})
+	want := []string{
+		"cpu: total 100 -> 110 (+10.0%), more than 5%",
+		"cpu: distance 10.0%, more than 5%",
+		"cpu: stack main;a: share 50.00% -> 60.00% (+10.00pp), more than 5pp",
+		"cpu: stack main;b: share 50.00% -> 40.00% (-10.00pp), more than 5pp",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Exceeded:\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Runs never share thread or span IDs: they must not count as moves.
+	base = NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;a", Val: 50, Labels: map[string][]string{LabelThreadID: {"101"}, LabelSpanID: {"7"}, "thread name": {"main"}}}).
+		Build()
+	candidate = NewProfileSetBuilder().
+		Add("cpu", StackSample{Stack: "main;a", Val: 50, Labels: map[string][]string{LabelThreadID: {"202"}, LabelSpanID: {"9"}, "thread name": {"main"}}}).
+		Build()
+	d = Diff(base, candidate, DiffOptions{})
+	if got := d.Exceeded(DiffThresholds{MaxShareDelta: 5}); len(got) != 0 {
+		t.Errorf("per-run labels only: %v", got)
+	}
+	if labels := d.Types[0].Labels; len(labels) != 0 {
+		t.Errorf("per-run labels diffed: %+v", labels)
+	}
+}
+
+func TestLoadProfileDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;a": 10})
+	content, err := os.ReadFile(filepath.Join(dir, "profile.pprof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"worker2.pprof", "profile.pprof.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ps, err := LoadProfileDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ps.Total("cpu"); got != 20 {
+		t.Errorf("total = %d, want the two profiles merged", got)
+	}
+	if _, err := LoadProfileDir(t.TempDir()); err == nil {
+		t.Error("want an error for a directory without profiles")
+	}
+}
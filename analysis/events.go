@@ -0,0 +1,216 @@
+// Typed events: besides Logf/Errorf, the analyzer describes what it does as
+// Events (a file started, an assertion decided, a profile type skipped, ...).
+// A Reporter that also implements EventReporter receives them as values and
+// decides how to present them; any other Reporter, such as *testing.T, gets
+// them rendered as log lines.
+package analysis
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Event is one of *AssertionResult, FileStarted, Skipped, Explained or
+// AllowedFailures.
+type Event interface {
+	isEvent()
+}
+
+// EventReporter is a Reporter that receives the analyzer's typed events
+// instead of their text. Logf and Errorf are still used for other messages
+// (matching files, errors, ...). RenderEvent renders an event as the analyzer
+// would, for implementations that only want to handle some of them.
+type EventReporter interface {
+	Reporter
+	Event(e Event)
+}
+
+// FileStarted is sent before the assertions of a profile type are evaluated
+// against a file.
+type FileStarted struct {
+	Path        string
+	ProfileType string
+	// Duration is the profile duration in seconds, whether or not values are
+	// scaled by it.
+	Duration float64
+}
+
+// Skipped is sent when a profile type does not apply to a file because of
+// its `when` clause. Skipped assertions are sent as *AssertionResult.
+type Skipped struct {
+	Path        string
+	ProfileType string
+	Reason      string
+	// Source is where the profile type's entry is in the expectation file.
+	Source Position
+}
+
+// Explained is sent after the assertions of a stack content when
+// Options.Explain is set.
+type Explained struct {
+	Regex       string
+	Explanation *Explanation
+}
+
+// AllowedFailures is sent after the assertions of a profile type when some of
+// them failed but failures are allowed for the file (allow_first_profile_failure).
+type AllowedFailures struct {
+	Path        string
+	ProfileType string
+	// Source is where the profile type's entry is in the expectation file.
+	Source Position
+}
+
+func (*AssertionResult) isEvent() {}
+func (FileStarted) isEvent()      {}
+func (Skipped) isEvent()          {}
+func (Explained) isEvent()        {}
+func (AllowedFailures) isEvent()  {}
+
+// Style selects how rendered events are colored.
+type Style int
+
+const (
+	// StyleAuto uses ANSI colors when writing to a terminal and NO_COLOR is
+	// not set. For Reporters without a writer (*testing.T) it keeps ANSI
+	// colors unless NO_COLOR is set.
+	StyleAuto Style = iota
+	// StylePlain never uses escape sequences.
+	StylePlain
+	// StyleANSI always uses ANSI colors, even if NO_COLOR is set.
+	StyleANSI
+)
+
+// ParseStyle parses the values of a --color style flag: "auto", "never" (or
+// "plain") and "always" (or "ansi").
+func ParseStyle(s string) (Style, error) {
+	switch s {
+	case "auto", "":
+		return StyleAuto, nil
+	case "never", "plain":
+		return StylePlain, nil
+	case "always", "ansi":
+		return StyleANSI, nil
+	}
+	return StyleAuto, fmt.Errorf("unknown color style %q (want auto, always or never)", s)
+}
+
+// resolve turns StyleAuto into StylePlain or StyleANSI for output written to
+// w, or to an unknown destination if w is nil.
+func (s Style) resolve(w io.Writer) Style {
+	if s != StyleAuto {
+		return s
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return StylePlain
+	}
+	if w == nil {
+		return StyleANSI
+	}
+	if f, ok := w.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return StyleANSI
+		}
+	}
+	return StylePlain
+}
+
+type ansiColor string
+
+const (
+	colorNone   ansiColor = ""
+	colorGreen  ansiColor = "\033[32m"
+	colorRed    ansiColor = "\033[31m"
+	colorYellow ansiColor = "\033[33m"
+)
+
+// eventLine is one line of a rendered event.
+type eventLine struct {
+	text  string
+	color ansiColor
+	// error lines are reported with Errorf, and mark the run as failed.
+	error bool
+}
+
+func (l eventLine) format(style Style) string {
+	if style == StyleANSI && l.color != colorNone {
+		return string(l.color) + l.text + "\033[0m"
+	}
+	return l.text
+}
+
+// eventLines renders e as the analyzer logs it.
+func eventLines(e Event) []eventLine {
+	switch e := e.(type) {
+	case *AssertionResult:
+		line := eventLine{text: e.Message(), color: colorYellow}
+		switch e.Verdict {
+		case VerdictPass:
+			line.color = colorGreen
+		case VerdictFail:
+			line.color, line.error = colorRed, true
+		}
+		lines := []eventLine{line}
+		if e.Diagnosis != nil {
+			for _, l := range e.Diagnosis.Lines() {
+				lines = append(lines, eventLine{text: "    " + l})
+			}
+		}
+		return lines
+	case FileStarted:
+		return []eventLine{
+			{text: fmt.Sprintf("Analyzing results in %s for profile type %s", e.Path, e.ProfileType)},
+			{text: fmt.Sprintf("Found a profile duration of %.1f seconds (in %s)", e.Duration, filepath.Base(e.Path))},
+		}
+	case Skipped:
+		return []eventLine{{text: fmt.Sprintf("Assertions skipped: profile type '%s' does not apply to %s (%s)", e.ProfileType, filepath.Base(e.Path), e.Reason), color: colorYellow}}
+	case Explained:
+		lines := []eventLine{{text: fmt.Sprintf("Explain '%s':", e.Regex)}}
+		for _, l := range e.Explanation.Lines() {
+			lines = append(lines, eventLine{text: "    " + l})
+		}
+		return lines
+	case AllowedFailures:
+		return []eventLine{{text: "Profile analysis completed with failures (allowed for first profile)", color: colorYellow}}
+	}
+	return nil
+}
+
+// RenderEvent reports e to r as log lines in the given style, failures with
+// Errorf. StyleAuto is resolved as for a Reporter without a writer.
+func RenderEvent(r Reporter, e Event, style Style) {
+	style = style.resolve(nil)
+	for _, l := range eventLines(e) {
+		if l.error {
+			r.Errorf("%s", l.format(style))
+		} else {
+			r.Logf("%s", l.format(style))
+		}
+	}
+}
+
+// emit sends e to r, as an event if r is an EventReporter and rendered with
+// StyleAuto otherwise.
+func emit(r Reporter, e Event) {
+	if er, ok := r.(EventReporter); ok {
+		er.Event(e)
+		return
+	}
+	RenderEvent(r, e, StyleAuto)
+}
+
+// styledReporter renders events of a plain Reporter in a fixed style.
+type styledReporter struct {
+	Reporter
+	style Style
+}
+
+func (s styledReporter) Event(e Event) { RenderEvent(s.Reporter, e, s.style) }
+
+// WithStyle returns r as an EventReporter that renders events in style, e.g.
+// WithStyle(t, StylePlain) for tests whose logs end up in files.
+func WithStyle(r Reporter, style Style) EventReporter {
+	return styledReporter{Reporter: r, style: style}
+}
@@ -0,0 +1,112 @@
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// eventRecorder is an EventReporter keeping the events it receives.
+type eventRecorder struct {
+	discardReporter
+	events []Event
+}
+
+func (r *eventRecorder) Event(e Event) { r.events = append(r.events, e) }
+
+func TestEventReporter(t *testing.T) {
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;hot": 90, "main;cold": 10})
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "test_name": "events",
+  "stacks": [
+    { "profile-type": "cpu", "error_margin": 5, "stack-content": [
+      { "regular_expression": ";hot$", "percent": 90 },
+      { "regular_expression": ";cold$", "percent": 10, "when": [{ "fact": "runtime_version", "version": ">= 99" }] }
+    ]},
+    { "profile-type": "cpu", "when": [{ "fact": "runtime_version", "version": ">= 99" }], "stack-content": [
+      { "regular_expression": ";hot$", "percent": 90 }
+    ]}
+  ]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var r eventRecorder
+	if _, err := Analyze(jsonPath, dir, Options{Reporter: &r, Explain: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	for _, e := range r.events {
+		switch e := e.(type) {
+		case *AssertionResult:
+			kinds = append(kinds, "assertion:"+e.Verdict.String())
+		default:
+			kinds = append(kinds, fmt.Sprintf("%T", e))
+		}
+	}
+	want := []string{
+		"analysis.FileStarted", "assertion:pass", "analysis.Explained", "assertion:skipped",
+		"analysis.FileStarted", "analysis.Skipped",
+	}
+	if strings.Join(kinds, " ") != strings.Join(want, " ") {
+		t.Errorf("events = %v, want %v", kinds, want)
+	}
+}
+
+func TestRenderEvent_Styles(t *testing.T) {
+	pass := &AssertionResult{Kind: AssertPercent, Regex: "main", Expected: 100, Actual: 100, Verdict: VerdictPass}
+	fail := &AssertionResult{Kind: AssertPercent, Regex: "main", Expected: 100, Verdict: VerdictFail}
+
+	var out, errOut bytes.Buffer
+	r := NewStdReporter(&out, &errOut)
+	r.Event(pass)
+	r.Event(fail)
+	if strings.Contains(out.String()+errOut.String(), "\033[") {
+		t.Errorf("StyleAuto should not color a buffer:\n%s%s", out.String(), errOut.String())
+	}
+	if !strings.HasPrefix(out.String(), "Assertion succeeded") || !strings.HasPrefix(errOut.String(), "Assertion failed") || !r.Failed() {
+		t.Errorf("unexpected output:\nout: %s\nerr: %s", out.String(), errOut.String())
+	}
+
+	out.Reset()
+	r.Style = StyleANSI
+	r.Event(pass)
+	if !strings.HasPrefix(out.String(), "\033[32mAssertion succeeded") {
+		t.Errorf("StyleANSI should color successes green: %q", out.String())
+	}
+
+	// Plain Reporters such as *testing.T keep colors unless NO_COLOR is set.
+	if StyleAuto.resolve(nil) != StyleANSI {
+		t.Error("StyleAuto without a writer should use ANSI colors")
+	}
+	t.Setenv("NO_COLOR", "1")
+	if StyleAuto.resolve(nil) != StylePlain {
+		t.Error("StyleAuto should honor NO_COLOR")
+	}
+	if StyleANSI.resolve(nil) != StyleANSI {
+		t.Error("StyleANSI should override NO_COLOR")
+	}
+
+	var plain bytes.Buffer
+	w := WithStyle(NewStdReporter(&plain, &plain), StylePlain)
+	w.Event(Skipped{Path: "/tmp/cpu.pprof", ProfileType: "cpu", Reason: "no"})
+	if got := plain.String(); got != "Assertions skipped: profile type 'cpu' does not apply to cpu.pprof (no)\n" {
+		t.Errorf("unexpected rendering %q", got)
+	}
+}
+
+func TestParseStyle(t *testing.T) {
+	for s, want := range map[string]Style{"auto": StyleAuto, "always": StyleANSI, "never": StylePlain} {
+		if got, err := ParseStyle(s); err != nil || got != want {
+			t.Errorf("ParseStyle(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseStyle("sometimes"); err == nil {
+		t.Error("expected an error for an unknown style")
+	}
+}
@@ -0,0 +1,187 @@
+// Explain mode: for every stack content, list the distinct stacks and label
+// sets that made up its matching value, and those its regex matched but its
+// label checks excluded, so a regex that over-matches (e.g. `.*main;.*b`
+// catching unrelated frames) shows up even when the assertion passes. Only
+// the labels the stack content checks tell samples apart, so per-thread or
+// per-span labels do not split a stack into many entries.
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// explainedStacksCount is how many stacks an Explanation lists of each kind.
+const explainedStacksCount = 10
+
+// Explanation lists what a stack content matched.
+type Explanation struct {
+	// MatchingValue is the value of the samples whose stack and labels
+	// matched; TotalValue that of the whole profile type.
+	MatchingValue int64 `json:"matching_value"`
+	TotalValue    int64 `json:"total_value"`
+	// Matched are the distinct stacks and label sets that contributed to the
+	// matching value, heaviest first, MatchedStacks being how many there are
+	// before keeping the first explainedStacksCount.
+	Matched       []ExplainedStack `json:"matched"`
+	MatchedStacks int              `json:"matched_stacks"`
+	// ExcludedByLabels are the distinct stacks and label sets the regex
+	// matched but a label check excluded, heaviest first, ExcludedStacks and
+	// ExcludedValue how many there are and their value, before keeping the
+	// first explainedStacksCount.
+	ExcludedByLabels []ExplainedStack `json:"excluded_by_labels,omitempty"`
+	ExcludedStacks   int              `json:"excluded_stacks,omitempty"`
+	ExcludedValue    int64            `json:"excluded_value,omitempty"`
+}
+
+// ExplainedStack is a distinct stack and label set within an Explanation.
+type ExplainedStack struct {
+	Stack string `json:"stack"`
+	// Labels are the sample labels the stack content checks, formatted as
+	// "key=[values] ...".
+	Labels  string `json:"labels,omitempty"`
+	Value   int64  `json:"value"`
+	Samples int    `json:"samples"`
+	// Percent is the share of the profile's total value.
+	Percent float64 `json:"percent"`
+}
+
+// explainer aggregates the samples of one stack content into an Explanation.
+type explainer struct {
+	// keys are the label keys the stack content checks, the only ones that
+	// tell samples apart.
+	keys     []string
+	matched  map[string]*ExplainedStack
+	excluded map[string]*ExplainedStack
+}
+
+func newExplainer(labels []Labels) *explainer {
+	e := &explainer{matched: map[string]*ExplainedStack{}, excluded: map[string]*ExplainedStack{}}
+	for _, l := range labels {
+		e.keys = append(e.keys, l.Key)
+	}
+	return e
+}
+
+func (e *explainer) add(ss StackSample, matched bool) {
+	group := e.excluded
+	if matched {
+		group = e.matched
+	}
+	checked := map[string][]string{}
+	for _, k := range e.keys {
+		if v, ok := ss.Labels[k]; ok {
+			checked[k] = v
+		}
+	}
+	labels := formatSampleLabels(checked)
+	key := ss.Stack + "\x00" + labels
+	s := group[key]
+	if s == nil {
+		s = &ExplainedStack{Stack: ss.Stack, Labels: labels}
+		group[key] = s
+	}
+	s.Value += ss.Val
+	s.Samples++
+}
+
+// addMatched adds the stacks o matched to those e matched, for the
+// explanation of value-matching-sum.
+func (e *explainer) addMatched(o *explainer) {
+	for key, s := range o.matched {
+		if m := e.matched[key]; m != nil {
+			m.Value += s.Value
+			m.Samples += s.Samples
+		} else {
+			c := *s
+			e.matched[key] = &c
+		}
+	}
+}
+
+func (e *explainer) explanation(matching, total int64) *Explanation {
+	x := &Explanation{
+		MatchingValue:    matching,
+		TotalValue:       total,
+		Matched:          explainedStacks(e.matched, total),
+		MatchedStacks:    len(e.matched),
+		ExcludedByLabels: explainedStacks(e.excluded, total),
+		ExcludedStacks:   len(e.excluded),
+	}
+	for _, s := range e.excluded {
+		x.ExcludedValue += s.Value
+	}
+	return x
+}
+
+func explainedStacks(group map[string]*ExplainedStack, total int64) []ExplainedStack {
+	stacks := make([]ExplainedStack, 0, len(group))
+	for _, s := range group {
+		if total != 0 {
+			s.Percent = 100 * float64(s.Value) / float64(total)
+		}
+		stacks = append(stacks, *s)
+	}
+	sort.Slice(stacks, func(a, b int) bool {
+		if stacks[a].Value != stacks[b].Value {
+			return stacks[a].Value > stacks[b].Value
+		}
+		if stacks[a].Stack != stacks[b].Stack {
+			return stacks[a].Stack < stacks[b].Stack
+		}
+		return stacks[a].Labels < stacks[b].Labels
+	})
+	if len(stacks) > explainedStacksCount {
+		stacks = stacks[:explainedStacksCount]
+	}
+	return stacks
+}
+
+// formatSampleLabels formats sample labels by key, e.g.
+// "thread id=[1] thread name=[main]".
+func formatSampleLabels(labels map[string][]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%v", k, labels[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+// Lines formats the explanation for logs, one line per listed stack.
+func (e *Explanation) Lines() []string {
+	lines := []string{fmt.Sprintf("Matched %d distinct stacks worth %d (%.1f%% of the profile):", e.MatchedStacks, e.MatchingValue, percentOf(e.MatchingValue, e.TotalValue))}
+	lines = append(lines, explainedLines(e.Matched, e.MatchedStacks)...)
+	if e.ExcludedStacks > 0 {
+		lines = append(lines, fmt.Sprintf("Excluded only by labels: %d distinct stacks worth %d (%.1f%% of the profile):", e.ExcludedStacks, e.ExcludedValue, percentOf(e.ExcludedValue, e.TotalValue)))
+		lines = append(lines, explainedLines(e.ExcludedByLabels, e.ExcludedStacks)...)
+	}
+	return lines
+}
+
+// explainedLines formats the listed stacks, out of count.
+func explainedLines(stacks []ExplainedStack, count int) []string {
+	lines := make([]string, len(stacks))
+	for i, s := range stacks {
+		lines[i] = fmt.Sprintf("  %5.1f%%  %d  %s", s.Percent, s.Value, s.Stack)
+		if s.Labels != "" {
+			lines[i] += "  {" + s.Labels + "}"
+		}
+	}
+	if count > len(stacks) {
+		lines = append(lines, fmt.Sprintf("  ... and %d more", count-len(stacks)))
+	}
+	return lines
+}
+
+func percentOf(value, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(value) / float64(total)
+}
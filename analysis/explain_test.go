@@ -0,0 +1,145 @@
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	prof := []StackSample{
+		{Stack: "main;a;b", Val: 50, Labels: map[string][]string{"thread": {"main"}}},
+		{Stack: "main;a;b", Val: 10, Labels: map[string][]string{"thread": {"main"}}},
+		{Stack: "main;x;b", Val: 20, Labels: map[string][]string{"thread": {"main"}}}, // over-matched by .*
+		{Stack: "main;a;b", Val: 15, Labels: map[string][]string{"thread": {"gc"}}},
+		{Stack: "other", Val: 5},
+	}
+	labels := []Labels{{Key: "thread", Values: []string{"main"}}}
+	var logs bytes.Buffer
+	assertions, _, _, err := assertStackWithFailureHandling(NewStdReporter(&logs, &logs), samplesOf(prof), "cpu", ".*main;.*b", compileStackMatcher(".*main;.*b", labels), Optional[float64]{}, NewOptionalFrom[int64](80), 5, labels, false, newExplainer(labels), Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := assertions[0].Explanation
+	if e == nil {
+		t.Fatal("no explanation")
+	}
+	if e.MatchingValue != 80 || e.TotalValue != 100 {
+		t.Errorf("matching=%d total=%d, want 80 and 100", e.MatchingValue, e.TotalValue)
+	}
+	wantMatched := []ExplainedStack{
+		{Stack: "main;a;b", Labels: "thread=[main]", Value: 60, Samples: 2, Percent: 60},
+		{Stack: "main;x;b", Labels: "thread=[main]", Value: 20, Samples: 1, Percent: 20},
+	}
+	if len(e.Matched) != len(wantMatched) || e.Matched[0] != wantMatched[0] || e.Matched[1] != wantMatched[1] {
+		t.Errorf("matched = %+v, want %+v", e.Matched, wantMatched)
+	}
+	wantExcluded := ExplainedStack{Stack: "main;a;b", Labels: "thread=[gc]", Value: 15, Samples: 1, Percent: 15}
+	if len(e.ExcludedByLabels) != 1 || e.ExcludedByLabels[0] != wantExcluded {
+		t.Errorf("excluded = %+v, want %+v", e.ExcludedByLabels, wantExcluded)
+	}
+
+	out := logs.String()
+	for _, want := range []string{
+		"Explain '.*main;.*b':",
+		"Matched 2 distinct stacks worth 80 (80.0% of the profile):",
+		"   20.0%  20  main;x;b  {thread=[main]}",
+		"Excluded only by labels: 1 distinct stacks worth 15 (15.0% of the profile):",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+// TestExplain_GroupsByCheckedLabels checks labels the stack content does not
+// check, like thread and span ids, do not split a stack into many entries, and
+// that only the heaviest explainedStacksCount stacks are listed.
+func TestExplain_GroupsByCheckedLabels(t *testing.T) {
+	var prof []StackSample
+	for i := 0; i < 3; i++ {
+		prof = append(prof, StackSample{Stack: "main;a", Val: 100, Labels: map[string][]string{
+			"thread": {"main"}, LabelThreadID: {fmt.Sprint(i)}, LabelSpanID: {fmt.Sprint(100 + i)},
+		}})
+	}
+	for i := 0; i < explainedStacksCount+2; i++ {
+		prof = append(prof, StackSample{Stack: fmt.Sprintf("main;f%02d", i), Val: int64(20 - i), Labels: map[string][]string{"thread": {"main"}}})
+	}
+	labels := []Labels{{Key: "thread", Values: []string{"main"}}}
+	var logs bytes.Buffer
+	assertions, _, _, err := assertStackWithFailureHandling(NewStdReporter(&logs, &logs), samplesOf(prof), "cpu", "main;.*", compileStackMatcher("main;.*", labels), Optional[float64]{}, NewOptionalFrom[int64](474), 5, labels, false, newExplainer(labels), Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := assertions[0].Explanation
+	want := ExplainedStack{Stack: "main;a", Labels: "thread=[main]", Value: 300, Samples: 3, Percent: 300 * 100 / float64(e.TotalValue)}
+	if len(e.Matched) == 0 || e.Matched[0] != want {
+		t.Errorf("matched = %+v, want %+v first", e.Matched, want)
+	}
+	if len(e.Matched) != explainedStacksCount || e.MatchedStacks != explainedStacksCount+3 {
+		t.Errorf("listed %d of %d stacks, want %d of %d", len(e.Matched), e.MatchedStacks, explainedStacksCount, explainedStacksCount+3)
+	}
+	out := logs.String()
+	for _, want := range []string{
+		fmt.Sprintf("Matched %d distinct stacks", explainedStacksCount+3),
+		"  ... and 3 more",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestExplain_Off(t *testing.T) {
+	prof := []StackSample{{Stack: "main", Val: 1}}
+	assertions, _, _, err := assertStackWithFailureHandling(discardReporter{}, samplesOf(prof), "cpu", "main", compileStackMatcher("main", nil), Optional[float64]{}, NewOptionalFrom[int64](100), 5, nil, false, nil, Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assertions[0].Explanation != nil {
+		t.Errorf("unexpected explanation without explain: %+v", assertions[0].Explanation)
+	}
+}
+
+// TestExplain_ValueMatchingSum checks the value-matching-sum assertion
+// explains the stacks it added up, including those of entries without a value
+// or percent, which have no assertion of their own.
+func TestExplain_ValueMatchingSum(t *testing.T) {
+	prof := []StackSample{
+		{Stack: "main;a", Val: 50},
+		{Stack: "main;b", Val: 30},
+		{Stack: "main;c", Val: 20},
+	}
+	stacks := TypedStacks{
+		ProfileType: "cpu",
+		StackContent: []StackContent{
+			{RegularExpression: "main;a", Percent: NewOptionalFrom[int64](50)},
+			{RegularExpression: "main;[ab]"},
+		},
+		ErrorMargin:      5,
+		ValueMatchingSum: NewOptionalFrom[int64](130),
+	}
+	assertions, err := analyzeProfDataWithFailureHandling(discardReporter{}, samplesOf(prof), stacks, 0, nil, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := assertions[len(assertions)-1]
+	if sum.Kind != AssertValueMatchingSum || sum.Explanation == nil {
+		t.Fatalf("last assertion = %+v, want an explained value-matching-sum", sum)
+	}
+	e := sum.Explanation
+	if e.MatchingValue != 130 || e.TotalValue != 100 {
+		t.Errorf("matching=%d total=%d, want 130 and 100", e.MatchingValue, e.TotalValue)
+	}
+	wantMatched := []ExplainedStack{
+		{Stack: "main;a", Value: 100, Samples: 2, Percent: 100},
+		{Stack: "main;b", Value: 30, Samples: 1, Percent: 30},
+	}
+	if len(e.Matched) != len(wantMatched) || e.Matched[0] != wantMatched[0] || e.Matched[1] != wantMatched[1] {
+		t.Errorf("matched = %+v, want %+v", e.Matched, wantMatched)
+	}
+	if assertions[0].Explanation.MatchingValue != 50 {
+		t.Errorf("the percent assertion's explanation = %+v, want its own stacks", assertions[0].Explanation)
+	}
+}
@@ -0,0 +1,163 @@
+// Flame graphs for HTML reports: the samples of one profile type folded into a
+// tree and drawn as a static SVG, with the frames on the paths of the stacks
+// each assertion matched tagged so the report can highlight them.
+package analysis
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html"
+	"iter"
+	"sort"
+	"strings"
+)
+
+const (
+	flameWidth       = 1200.0 // px
+	flameFrameHeight = 16.0   // px
+	flameCharWidth   = 7.0    // px, approximate width of a 12px monospace glyph
+	// flameMinWidth prunes frames too narrow to see; their value still
+	// counts in their parent's width.
+	flameMinWidth = 0.5 // px
+)
+
+type flameNode struct {
+	name     string
+	value    int64
+	children map[string]*flameNode
+	// matchedBy holds the indexes of the assertions whose matched stacks go
+	// through this frame.
+	matchedBy map[int]bool
+}
+
+func newFlameNode(name string) *flameNode {
+	return &flameNode{name: name, children: map[string]*flameNode{}, matchedBy: map[int]bool{}}
+}
+
+// flameMatcher selects the samples an assertion matched.
+type flameMatcher struct {
+	index int
+	*stackMatcher
+}
+
+func (m flameMatcher) matches(ss StackSample) bool {
+	return m.rx.MatchString(ss.Stack) && m.failingLabel(ss.Labels) < 0
+}
+
+// buildFlameTree folds samples into a tree rooted at a synthetic "all" frame.
+func buildFlameTree(samples iter.Seq[StackSample], matchers []flameMatcher) *flameNode {
+	root := newFlameNode("all")
+	for ss := range samples {
+		var matchedBy []int
+		for _, m := range matchers {
+			if m.matches(ss) {
+				matchedBy = append(matchedBy, m.index)
+			}
+		}
+		node := root
+		node.value += ss.Val
+		for _, i := range matchedBy {
+			node.matchedBy[i] = true
+		}
+		if ss.Stack == "" {
+			continue
+		}
+		for _, frame := range strings.Split(ss.Stack, ";") {
+			child := node.children[frame]
+			if child == nil {
+				child = newFlameNode(frame)
+				node.children[frame] = child
+			}
+			child.value += ss.Val
+			for _, i := range matchedBy {
+				child.matchedBy[i] = true
+			}
+			node = child
+		}
+	}
+	return root
+}
+
+func (n *flameNode) depth() int {
+	d := 0
+	for _, c := range n.children {
+		d = max(d, c.depth())
+	}
+	return d + 1
+}
+
+// renderFlameSVG draws the tree root-at-bottom. Frames get the class "a<i>"
+// for every assertion i whose matched stacks go through them.
+func renderFlameSVG(root *flameNode) string {
+	if root.value <= 0 {
+		return `<p class="empty">No samples.</p>`
+	}
+	depth := root.depth()
+	height := float64(depth) * flameFrameHeight
+	scale := flameWidth / float64(root.value)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="flame" xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f">`, flameWidth, height, flameWidth, height)
+	var draw func(n *flameNode, x float64, level int)
+	draw = func(n *flameNode, x float64, level int) {
+		w := float64(n.value) * scale
+		if w < flameMinWidth {
+			return
+		}
+		y := height - float64(level+1)*flameFrameHeight
+		classes := []string{"f"}
+		for _, i := range sortedKeys(n.matchedBy) {
+			classes = append(classes, fmt.Sprintf("a%d", i))
+		}
+		fmt.Fprintf(&b, `<g class="%s"><title>%s (%d, %.2f%%)</title>`, strings.Join(classes, " "), html.EscapeString(n.name), n.value, 100*float64(n.value)/float64(root.value))
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.0f" width="%.1f" height="%.0f" fill="%s"/>`, x, y, w, flameFrameHeight-1, flameColor(n.name))
+		if label := truncateLabel(n.name, int((w-4)/flameCharWidth)); label != "" {
+			fmt.Fprintf(&b, `<text x="%.1f" y="%.0f">%s</text>`, x+2, y+flameFrameHeight-4, html.EscapeString(label))
+		}
+		b.WriteString(`</g>`)
+
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			c := n.children[name]
+			draw(c, x, level+1)
+			x += float64(c.value) * scale
+		}
+	}
+	draw(root, 0, 0)
+	b.WriteString(`</svg>`)
+	return b.String()
+}
+
+// flameColor picks a stable warm color per frame name, as flame graphs
+// traditionally do.
+func flameColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	v := h.Sum32()
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+v%50, 80+(v>>8)%130, 40+(v>>16)%40)
+}
+
+func truncateLabel(s string, chars int) string {
+	r := []rune(s)
+	switch {
+	case chars < 3:
+		return ""
+	case len(r) <= chars:
+		return s
+	default:
+		return string(r[:chars-2]) + ".."
+	}
+}
+
+func sortedKeys(m map[int]bool) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,171 @@
+// Folded stacks adapter: reads Brendan Gregg's folded (collapsed) stack text,
+// one "a;b;c 123" line per stack, as emitted by perf + stackcollapse, py-spy
+// --format raw or async-profiler -o collapsed. The format has no sample type,
+// unit or duration, so they are declared in a header of "# key: value" lines
+// or in a JSON sidecar file, which lets an external profiler's output serve as
+// the ground truth for ours.
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- format detection & parsing --------------------------------------------
+
+func isFoldedName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".folded") || strings.HasSuffix(name, ".collapsed")
+}
+
+// foldedSidecarSuffix is appended to a folded file's path to name its
+// sidecar, e.g. perf.folded.json.
+const foldedSidecarSuffix = ".json"
+
+// loadFolded reads the folded stacks in content, with the header of the
+// sidecar next to path if there is one.
+func loadFolded(path string, content []byte) (*ProfileSet, error) {
+	var h FoldedHeader
+	sidecar, err := os.ReadFile(path + foldedSidecarSuffix)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(sidecar, &h); err != nil {
+			return nil, fmt.Errorf("%s%s: %w", path, foldedSidecarSuffix, err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	return FromFolded(bytes.NewReader(content), h)
+}
+
+// --- conversion ------------------------------------------------------------
+
+// FoldedHeader declares what the values of folded stacks are.
+type FoldedHeader struct {
+	// Type is the profile type of the samples, "samples" if empty.
+	Type string `json:"type,omitempty"`
+	// Unit is the unit of the values: a count ("samples", "count" or empty),
+	// "bytes", or a time unit ("nanoseconds", "microseconds", "milliseconds",
+	// "seconds" or their abbreviations), converted to nanoseconds so values
+	// compare with the profiles of the other formats.
+	Unit string `json:"unit,omitempty"`
+	// Duration is the duration of the run in seconds; 0 for a snapshot.
+	Duration float64 `json:"duration,omitempty"`
+	// Facts are facts about the run for `when` conditions.
+	Facts map[string]string `json:"facts,omitempty"`
+}
+
+// foldedUnits are the multipliers converting values of each unit to the base
+// unit of its kind.
+var foldedUnits = map[string]int64{
+	"": 1, "samples": 1, "count": 1, "bytes": 1,
+	"nanoseconds": 1, "ns": 1,
+	"microseconds": 1e3, "us": 1e3,
+	"milliseconds": 1e6, "ms": 1e6,
+	"seconds": 1e9, "s": 1e9,
+}
+
+// FromFolded builds a ProfileSet from folded stacks: root-first frames joined
+// by ';', a space, and a value. Frames may contain spaces, the value being
+// the last field; blank lines are skipped. Leading "# key: value" (or
+// "# key=value") lines override h: type, unit, duration (seconds or a Go
+// duration such as "30s") and, for any other key, a fact. Other lines
+// starting with '#' are comments.
+func FromFolded(r io.Reader, h FoldedHeader) (*ProfileSet, error) {
+	ps := newProfileSet()
+	facts := map[string]string{}
+	for k, v := range h.Facts {
+		facts[k] = v
+	}
+	type sample struct {
+		stack string
+		val   int64
+	}
+	var samples []sample
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16<<20) // deep stacks make long lines
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		if comment, ok := strings.CutPrefix(text, "#"); ok {
+			if len(samples) > 0 {
+				continue
+			}
+			k, v, ok := parseFactComment(comment)
+			if !ok {
+				continue
+			}
+			if err := h.set(k, v); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if k != "type" && k != "unit" && k != "duration" {
+				facts[k] = v
+			}
+			continue
+		}
+		sep := strings.LastIndexByte(text, ' ')
+		if sep <= 0 {
+			return nil, fmt.Errorf("line %d: no value after the stack", line)
+		}
+		val, err := strconv.ParseInt(text[sep+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad value %q", line, text[sep+1:])
+		}
+		samples = append(samples, sample{stack: strings.TrimSpace(text[:sep]), val: val})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	mult, ok := foldedUnits[strings.ToLower(h.Unit)]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %q", h.Unit)
+	}
+	profileType := h.Type
+	if profileType == "" {
+		profileType = "samples"
+	}
+	noLabels := ps.internLabels(nil)
+	var total int64
+	for _, s := range samples {
+		ps.addSample(profileType, ps.internStack(s.stack), noLabels, s.val*mult)
+		total += s.val * mult
+	}
+	ps.addProfileDuration(profileType, total, h.Duration)
+	for k, v := range facts {
+		ps.addFact(k, v)
+	}
+	return ps.finalize(), nil
+}
+
+// set sets a header field from a header line.
+func (h *FoldedHeader) set(key, value string) error {
+	switch key {
+	case "type":
+		h.Type = value
+	case "unit":
+		h.Unit = value
+	case "duration":
+		if secs, err := strconv.ParseFloat(value, 64); err == nil {
+			h.Duration = secs
+			return nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("bad duration %q", value)
+		}
+		h.Duration = d.Seconds()
+	}
+	return nil
+}
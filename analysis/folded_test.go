@@ -0,0 +1,119 @@
+package analysis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFromFolded(t *testing.T) {
+	in := `# type: cpu-time
+# unit: ms
+# duration: 10s
+# runtime_version=3.12.1
+# Collected with py-spy.
+main;work (app.py:10) 30
+main;idle 10
+
+main;work (app.py:10) 5
+# not a header anymore: ignored
+`
+	ps, err := FromFolded(strings.NewReader(in), FoldedHeader{Type: "samples", Facts: map[string]string{"profiler": "py-spy", "runtime_version": "3.11"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "main;work (app.py:10)=30000000\nmain;idle=10000000\nmain;work (app.py:10)=5000000"
+	if got := folded(ps, "cpu-time"); got != want {
+		t.Errorf("samples:\n%s\nwant:\n%s", got, want)
+	}
+	if ps.Has("samples") {
+		t.Error("the header's type should override the caller's")
+	}
+	if d := ps.Duration("cpu-time"); d != 10 {
+		t.Errorf("Duration = %v, want 10", d)
+	}
+	for k, v := range map[string]string{"runtime_version": "3.12.1", "profiler": "py-spy"} {
+		if got := ps.facts[k]; got != v {
+			t.Errorf("fact %s = %q, want %q", k, got, v)
+		}
+	}
+	if _, ok := ps.facts["not a header anymore"]; ok {
+		t.Error("comments after the first stack should not be facts")
+	}
+}
+
+func TestFromFolded_Defaults(t *testing.T) {
+	ps, err := FromFolded(strings.NewReader("a;b 2\na 1\n"), FoldedHeader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := folded(ps, "samples"); got != "a;b=2\na=1" {
+		t.Errorf("samples:\n%s", got)
+	}
+	if d := ps.Duration("samples"); d != 0 {
+		t.Errorf("Duration = %v, want 0 for a snapshot", d)
+	}
+}
+
+func TestFromFolded_Errors(t *testing.T) {
+	cases := map[string]struct {
+		in   string
+		h    FoldedHeader
+		want string
+	}{
+		"no value":     {in: "main;work\n", want: "line 1: no value"},
+		"bad value":    {in: "# type: cpu\nmain;work 1.5\n", want: `line 2: bad value "1.5"`},
+		"bad duration": {in: "# duration: soon\n", want: `line 1: bad duration "soon"`},
+		"unknown unit": {in: "main 1\n", h: FoldedHeader{Unit: "furlongs"}, want: `unknown unit "furlongs"`},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := FromFolded(strings.NewReader(c.in), c.h)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("err = %v, want %q", err, c.want)
+			}
+		})
+	}
+}
+
+// TestLoadProfileSet_Folded covers the dispatch by suffix and the sidecar,
+// which the file's own header overrides.
+func TestLoadProfileSet_Folded(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	perf := write("perf.folded", "# duration: 5\nmain;work 50\n")
+	write("perf.folded.json", `{"type": "cpu-samples", "duration": 10, "facts": {"profiler": "perf"}}`)
+	ps, err := LoadProfileSet(perf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ps.Total("cpu-samples"); got != 50 {
+		t.Errorf("cpu-samples total = %d, want 50", got)
+	}
+	if d := ps.Duration("cpu-samples"); d != 5 {
+		t.Errorf("Duration = %v, want 5 from the header", d)
+	}
+	if ps.facts["profiler"] != "perf" {
+		t.Errorf("facts = %v", ps.facts)
+	}
+
+	ps, err = LoadProfileSet(write("async.collapsed", "java.lang.Thread.run;Work.run 7\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ps.Total("samples"); got != 7 {
+		t.Errorf("samples total = %d, want 7", got)
+	}
+
+	write("bad.folded.json", `{"duration": "10s"}`)
+	if _, err := LoadProfileSet(write("bad.folded", "main 1\n")); err == nil || !strings.Contains(err.Error(), "bad.folded.json") {
+		t.Errorf("err = %v, want the sidecar's error", err)
+	}
+}
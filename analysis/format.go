@@ -0,0 +1,270 @@
+// Expectation file formats: besides plain JSON, expectations may be written as
+// JSON with comments (// and /* */, trailing commas) or as YAML, which avoids
+// escaping regexes and makes the `note` field unnecessary. Every format is
+// normalized to JSON before variable resolution and schema validation, so the
+// rest of the pipeline only ever deals with one representation.
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ExpectationFileNames are the file names scenario discovery recognizes as a
+// scenario's expectations, in order of preference.
+var ExpectationFileNames = []string{
+	"expected_profile.json",
+	"expected_profile.jsonc",
+	"expected_profile.yaml",
+	"expected_profile.yml",
+}
+
+// IsExpectationFile reports whether path names a scenario's expectations.
+func IsExpectationFile(path string) bool {
+	return containsStr(ExpectationFileNames, filepath.Base(path))
+}
+
+// expectationFormat is the encoding an expectation file was written in.
+// captureProfData writes its output in the same format, so bootstrapped
+// expectations can be copied back as-is.
+type expectationFormat int
+
+const (
+	formatJSON expectationFormat = iota // JSON, with or without comments
+	formatYAML
+)
+
+// formatOf picks the format from the file extension; anything that is not
+// YAML is read as JSON with comments, a superset of JSON.
+func formatOf(path string) expectationFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	default:
+		return formatJSON
+	}
+}
+
+// name names the format of the file at path for messages: "YAML", or
+// "JSONC" or "JSON" depending on the extension.
+func (f expectationFormat) name(path string) string {
+	switch {
+	case f == formatYAML:
+		return "YAML"
+	case strings.EqualFold(filepath.Ext(path), ".jsonc"):
+		return "JSONC"
+	default:
+		return "JSON"
+	}
+}
+
+// ext is the file extension used for captured data in this format.
+func (f expectationFormat) ext() string {
+	if f == formatYAML {
+		return ".yaml"
+	}
+	return ".json"
+}
+
+// toJSON normalizes an expectation document in format f to plain JSON.
+func (f expectationFormat) toJSON(content []byte) ([]byte, error) {
+	if f == formatYAML {
+		return yamlToJSON(content)
+	}
+	return stripJSONC(content), nil
+}
+
+// marshal encodes data in format f.
+func (f expectationFormat) marshal(data StackTestData) ([]byte, error) {
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil || f != formatYAML {
+		return jsonData, err
+	}
+	node, err := jsonToYAMLNode(json.NewDecoder(bytes.NewReader(jsonData)))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// stripJSONC blanks out // and /* */ comments and trailing commas outside of
+// strings. Removed bytes are replaced with spaces (newlines are kept) so
+// offsets, and therefore line/column positions, are unchanged.
+func stripJSONC(content []byte) []byte {
+	out := append([]byte(nil), content...)
+	inString := false
+	lastSignificant := -1 // index of the last non-space byte kept, for trailing commas
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+				lastSignificant = i
+			}
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			out[i], out[i+1] = ' ', ' '
+			for i += 2; i < len(out) && !(out[i] == '*' && i+1 < len(out) && out[i+1] == '/'); i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			if i < len(out) {
+				out[i], out[i+1] = ' ', ' '
+				i++
+			}
+		case c == '}' || c == ']':
+			if lastSignificant >= 0 && out[lastSignificant] == ',' {
+				out[lastSignificant] = ' '
+			}
+			lastSignificant = i
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			lastSignificant = i
+		}
+	}
+	return out
+}
+
+// yamlToJSON converts a YAML document to JSON. Mapping keys must be strings,
+// as they are in every expectation file.
+func yamlToJSON(content []byte) ([]byte, error) {
+	var doc any
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	doc, err := jsonCompatible(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// jsonCompatible converts the map[any]any values yaml may produce for nested
+// mappings into map[string]any.
+func jsonCompatible(v any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			c, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = c
+		}
+		return v, nil
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", k)
+			}
+			c, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = c
+		}
+		return m, nil
+	case []any:
+		for i, e := range v {
+			c, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = c
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+// jsonToYAMLNode builds a YAML node from a JSON token stream, keeping object
+// keys in their original order (decoding into a map would sort them). Null
+// members (unset Optionals) are dropped so the result passes schema validation
+// when loaded back as an expectation.
+func jsonToYAMLNode(dec *json.Decoder) (*yaml.Node, error) {
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+		if tok == '{' {
+			node.Kind = yaml.MappingNode
+		}
+		for dec.More() {
+			var key *yaml.Node
+			if node.Kind == yaml.MappingNode {
+				tok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				key = &yaml.Node{Kind: yaml.ScalarNode, Value: tok.(string)}
+			}
+			child, err := jsonToYAMLNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			if key != nil {
+				if child.Tag == "!!null" {
+					continue
+				}
+				node.Content = append(node.Content, key)
+			}
+			node.Content = append(node.Content, child)
+		}
+		if _, err := dec.Token(); err != nil { // closing delimiter
+			return nil, err
+		}
+		return node, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: tok}, nil
+	case json.Number:
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: tok.String()}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprint(tok)}, nil
+	default: // nil
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+}
+
+// readExpectationFile reads an expectation file in any supported format and
+// returns it as plain JSON along with its format and the source position of
+// each of its values.
+func readExpectationFile(filePath string) ([]byte, expectationFormat, sourcePositions, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, formatJSON, nil, err
+	}
+	format := formatOf(filePath)
+	jsonData, err := format.toJSON(content)
+	if err != nil {
+		return nil, format, nil, fmt.Errorf("invalid %s syntax in %s: %v", format.name(filePath), filePath, err)
+	}
+	return jsonData, format, format.positions(filePath, content), nil
+}
@@ -0,0 +1,153 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestStripJSONC covers comments, trailing commas and comment-like text inside
+// strings, and checks offsets are preserved (same length, same newlines).
+func TestStripJSONC(t *testing.T) {
+	in := []byte(`{
+  // which thread runs the busy loop
+  "regular_expression": "^main;a//b$", /* not a comment: "//" above is in a string */
+  "labels": [
+    "x",
+  ],
+}`)
+	out := stripJSONC(in)
+	if len(out) != len(in) || bytes.Count(out, []byte("\n")) != bytes.Count(in, []byte("\n")) {
+		t.Fatalf("stripJSONC changed offsets:\n%s", out)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(out, &doc); err != nil {
+		t.Fatalf("stripped document is not JSON: %v\n%s", err, out)
+	}
+	if doc["regular_expression"] != "^main;a//b$" {
+		t.Errorf("string content altered: %q", doc["regular_expression"])
+	}
+}
+
+// TestReadJSONFile_YAMLAndJSONC loads the same expectation written as YAML and
+// as JSON with comments and checks both decode identically.
+func TestReadJSONFile_YAMLAndJSONC(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "expected_profile.yaml")
+	if err := os.WriteFile(yamlPath, []byte(`# Ruby each/times nesting
+test_name: yaml
+stacks:
+  - profile-type: cpu-time
+    stack-content:
+      - regular_expression: ^<main>;each;<main>;times;<main>;a;\*$
+        percent: 50
+        labels:
+          - key: thread name
+            values: [main]
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jsoncPath := filepath.Join(dir, "expected_profile.jsonc")
+	if err := os.WriteFile(jsoncPath, []byte(`{
+  // Ruby each/times nesting
+  "test_name": "yaml",
+  "stacks": [{
+    "profile-type": "cpu-time",
+    "stack-content": [{
+      "regular_expression": "^<main>;each;<main>;times;<main>;a;\\*$",
+      "percent": 50,
+      "labels": [{ "key": "thread name", "values": ["main"] }],
+    }],
+  }],
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fromYAML, err := ReadJSONFile(yamlPath)
+	if err != nil {
+		t.Fatalf("YAML: %v", err)
+	}
+	fromJSONC, err := ReadJSONFile(jsoncPath)
+	if err != nil {
+		t.Fatalf("JSONC: %v", err)
+	}
+	a, _ := json.Marshal(fromYAML)
+	b, _ := json.Marshal(fromJSONC)
+	if !bytes.Equal(a, b) {
+		t.Errorf("YAML and JSONC decode differently:\n%s\n%s", a, b)
+	}
+	if fromYAML.format != formatYAML || fromJSONC.format != formatJSON {
+		t.Errorf("formats = %v/%v, want YAML/JSON", fromYAML.format, fromJSONC.format)
+	}
+
+	// Schema validation still applies to YAML sources.
+	bad := filepath.Join(dir, "bad.yaml")
+	if err := os.WriteFile(bad, []byte("stacks:\n  - profile-type: cpu-time\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadJSONFile(bad); err == nil {
+		t.Error("expected a schema error for a YAML file missing stack-content")
+	}
+}
+
+// TestReadJSONFile_SyntaxErrorNamesFormat checks syntax errors name the
+// format the file was read as.
+func TestReadJSONFile_SyntaxErrorNamesFormat(t *testing.T) {
+	dir := t.TempDir()
+	for name, want := range map[string]string{
+		"expected_profile.json":  "invalid JSON syntax",
+		"expected_profile.jsonc": "invalid JSONC syntax",
+		"expected_profile.yaml":  "invalid YAML syntax",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("{\"stacks\": [\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadJSONFile(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err = %v, want %q", name, err, want)
+		}
+	}
+}
+
+// TestCaptureRoundTripsYAML checks that YAML expectations get a YAML capture
+// which is itself a loadable expectation, and which later runs don't mistake
+// for a profile.
+func TestCaptureRoundTripsYAML(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "profile.pprof"), buildPprof(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	yamlPath := filepath.Join(dir, "expected_profile.yaml")
+	if err := os.WriteFile(yamlPath, []byte(`test_name: round-trip
+stacks:
+  - profile-type: cpu
+    stack-content:
+      - regular_expression: ^pprofFn$
+        value: 42
+        error_margin: 0
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 2; run++ {
+		r := NewStdReporter(os.Stdout, os.Stderr)
+		Run(r, func() { AnalyzeResults(r, yamlPath, dir) })
+		if r.Failed() {
+			t.Fatalf("run %d failed", run)
+		}
+	}
+
+	captured, err := ReadJSONFile(filepath.Join(dir, "profile.yaml"))
+	if err != nil {
+		t.Fatalf("captured YAML does not load: %v", err)
+	}
+	if captured.TestName != "round-trip" || len(captured.Stacks) != 1 || captured.Stacks[0].StackContent[0].RegularExpression != "^pprofFn$" {
+		t.Errorf("unexpected capture: %+v", captured)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "profile.json")); err == nil {
+		t.Error("a JSON capture was written for YAML expectations")
+	}
+}
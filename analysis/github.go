@@ -0,0 +1,120 @@
+// GitHub Actions annotations: a Reporter wrapper that, besides the usual
+// output, prints `::error file=…,line=…::` workflow commands so failures show
+// up on the expectation file's line in the run summary and pull request diff.
+package analysis
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitHubReporter forwards everything to a Reporter and also writes GitHub
+// Actions workflow commands to W: an error annotation at the stack-content
+// entry of every failed assertion, a warning for allowed failures, and an
+// error for other reported errors.
+type GitHubReporter struct {
+	Reporter
+	// W receives the workflow commands. The runner only recognizes them at
+	// the start of a line of the step's output, so this is usually os.Stdout
+	// even when the Reporter prefixes or buffers its own output.
+	W io.Writer
+	// Root is the directory annotation paths are made relative to; GitHub
+	// expects paths relative to the repository root. Defaults to
+	// $GITHUB_WORKSPACE.
+	Root string
+}
+
+// NewGitHubReporter wraps r, writing annotations to w. The result is a
+// ScopedReporter when r is one.
+func NewGitHubReporter(r Reporter, w io.Writer) EventReporter {
+	g := &GitHubReporter{Reporter: r, W: w, Root: os.Getenv("GITHUB_WORKSPACE")}
+	if _, ok := r.(ScopedReporter); ok {
+		return scopedGitHubReporter{g}
+	}
+	return g
+}
+
+// InGitHubActions reports whether the process runs in a GitHub Actions job.
+func InGitHubActions() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true"
+}
+
+// Event forwards e and annotates failures.
+func (g *GitHubReporter) Event(e Event) {
+	emit(g.Reporter, e)
+	switch e := e.(type) {
+	case *AssertionResult:
+		switch e.Verdict {
+		case VerdictFail:
+			g.annotate("error", e.Source, "Profile assertion failed ("+e.ProfileType+")", e.Message())
+		case VerdictAllowedFailure:
+			g.annotate("warning", e.Source, "Profile assertion failed, allowed for the first profile ("+e.ProfileType+")", e.Message())
+		}
+	}
+}
+
+// scopedGitHubReporter is a GitHubReporter around a ScopedReporter.
+type scopedGitHubReporter struct {
+	*GitHubReporter
+}
+
+// Scope runs fn in a scope of the wrapped Reporter, still annotating
+// failures.
+func (g scopedGitHubReporter) Scope(name string, fn func(r Reporter)) bool {
+	return g.Reporter.(ScopedReporter).Scope(name, func(r Reporter) {
+		fn(&GitHubReporter{Reporter: r, W: g.W, Root: g.Root})
+	})
+}
+
+// Errorf forwards the error and annotates it, without a location.
+func (g *GitHubReporter) Errorf(format string, args ...any) {
+	g.Reporter.Errorf(format, args...)
+	g.annotate("error", Position{}, "", fmt.Sprintf(format, args...))
+}
+
+// Fatalf annotates the error before forwarding it, as Fatalf may not return.
+func (g *GitHubReporter) Fatalf(format string, args ...any) {
+	g.annotate("error", Position{}, "", fmt.Sprintf(format, args...))
+	g.Reporter.Fatalf(format, args...)
+}
+
+func (g *GitHubReporter) annotate(level string, pos Position, title, msg string) {
+	var props []string
+	if pos.File != "" {
+		props = append(props, "file="+escapeProperty(g.relative(pos.File)))
+		if pos.IsValid() {
+			props = append(props, fmt.Sprintf("line=%d", pos.Line), fmt.Sprintf("col=%d", pos.Column))
+		}
+	}
+	if title != "" {
+		props = append(props, "title="+escapeProperty(title))
+	}
+	cmd := "::" + level
+	if len(props) > 0 {
+		cmd += " " + strings.Join(props, ",")
+	}
+	fmt.Fprintf(g.W, "%s::%s\n", cmd, escapeData(msg))
+}
+
+func (g *GitHubReporter) relative(path string) string {
+	if g.Root == "" || !filepath.IsAbs(path) {
+		return filepath.ToSlash(path)
+	}
+	if rel, err := filepath.Rel(g.Root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(path)
+}
+
+// escapeData escapes a workflow command message.
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeProperty escapes a workflow command property value.
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
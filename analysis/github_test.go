@@ -0,0 +1,44 @@
+package analysis
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitHubReporter(t *testing.T) {
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;hot": 90, "main;cold": 10})
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "test_name": "annotations",
+  "stacks": [{ "profile-type": "cpu", "error_margin": 5, "stack-content": [
+    { "regular_expression": ";hot$", "percent": 90 },
+    { "regular_expression": ";cold$", "percent": 50 }
+  ]}]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, annotations bytes.Buffer
+	r := &GitHubReporter{Reporter: NewStdReporter(&out, &out), W: &annotations, Root: dir}
+	res, err := Analyze(jsonPath, dir, Options{Reporter: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Failed() || !strings.Contains(out.String(), "Assertion failed") {
+		t.Fatalf("the wrapped reporter should get the usual output:\n%s", out.String())
+	}
+	want := "::error file=expected_profile.json,line=5,col=5,title=Profile assertion failed (cpu)::Assertion failed: stack ';cold$'"
+	if got := annotations.String(); !strings.HasPrefix(got, want) || strings.Count(got, "\n") != 1 {
+		t.Errorf("annotations =\n%s\nwant one starting with\n%s", got, want)
+	}
+
+	annotations.Reset()
+	r.Errorf("No matching files found for %s in %s", "x", "50%, y:z\nmore")
+	if got := annotations.String(); got != "::error::No matching files found for x in 50%25, y:z%0Amore\n" {
+		t.Errorf("unexpected annotation %q", got)
+	}
+}
@@ -0,0 +1,667 @@
+// Java Flight Recorder (JFR) adapter: parses the chunks of a JFR recording and
+// maps its profiling events into the neutral ProfileSet. A chunk describes its
+// own event and value types in a metadata event, so the parser reads any
+// event generically and the mapping below only picks fields by name. Thread
+// names and Datadog span context become canonical labels.
+package analysis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+// --- format detection ------------------------------------------------------
+
+// jfrMagic starts every JFR chunk.
+var jfrMagic = []byte("FLR\x00")
+
+func isJFRName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".jfr")
+}
+
+// --- event mapping ---------------------------------------------------------
+
+// jfrEventType is how the samples of an event type are added to a ProfileSet.
+type jfrEventType struct {
+	samples []jfrSampleType
+}
+
+// jfrSampleType is a profile type an event adds a sample to, and the value of
+// that sample.
+type jfrSampleType struct {
+	profileType string
+	value       func(c *jfrChunk, event any) int64
+}
+
+// jfrEventTypes are the events FromJFR reads, by JFR type name. Profile type
+// names follow the Datadog Java profiler's pprof ones.
+var jfrEventTypes = map[string]jfrEventType{
+	"jdk.ExecutionSample":        {samples: []jfrSampleType{{"cpu-samples", jfrOne}}},
+	"datadog.ExecutionSample":    {samples: []jfrSampleType{{"cpu-samples", jfrWeight}}},
+	"datadog.MethodSample":       {samples: []jfrSampleType{{"wall-samples", jfrWeight}}},
+	"jdk.ObjectAllocationSample": {samples: []jfrSampleType{{"alloc-samples", jfrOne}, {"alloc-space", jfrFieldValue("weight")}}},
+	"datadog.ObjectSample":       {samples: []jfrSampleType{{"alloc-samples", jfrWeight}, {"alloc-space", jfrWeightedSize}}},
+	"jdk.JavaMonitorEnter":       {samples: []jfrSampleType{{"lock-count", jfrOne}, {"lock-time", jfrDuration}}},
+}
+
+// jfrThreadFields are the fields naming the thread an event is about, in
+// order of preference: samplers record the sampled thread apart from the
+// thread that emitted the event.
+var jfrThreadFields = []string{"sampledThread", "eventThread"}
+
+// jfrContextFields are the span context fields of Datadog events, which
+// canonKey maps to the canonical span labels.
+var jfrContextFields = []string{"spanId", "localRootSpanId", "traceId"}
+
+func jfrOne(*jfrChunk, any) int64 { return 1 }
+
+// jfrWeight is the number of occurrences a sampled event stands for: its
+// weight if it has one, 1 otherwise.
+func jfrWeight(c *jfrChunk, event any) int64 {
+	if w, ok := jfrNumber(c.field(event, "weight")); ok {
+		return int64(math.Round(w))
+	}
+	return 1
+}
+
+func jfrFieldValue(name string) func(c *jfrChunk, event any) int64 {
+	return func(c *jfrChunk, event any) int64 {
+		v, _ := jfrNumber(c.field(event, name))
+		return int64(math.Round(v))
+	}
+}
+
+// jfrWeightedSize is the number of bytes a sampled allocation stands for.
+func jfrWeightedSize(c *jfrChunk, event any) int64 {
+	size, _ := jfrNumber(c.field(event, "size"))
+	w, ok := jfrNumber(c.field(event, "weight"))
+	if !ok {
+		w = 1
+	}
+	return int64(math.Round(size * w))
+}
+
+// jfrDuration is the duration of an event, in nanoseconds.
+func jfrDuration(c *jfrChunk, event any) int64 {
+	ticks, _ := jfrNumber(c.field(event, "duration"))
+	if c.ticksPerSecond <= 0 {
+		return 0
+	}
+	return int64(math.Round(ticks * 1e9 / float64(c.ticksPerSecond)))
+}
+
+// FromJFR builds a ProfileSet from a JFR recording: CPU samples
+// (jdk.ExecutionSample, datadog.ExecutionSample), wall-clock samples
+// (datadog.MethodSample), allocation samples (jdk.ObjectAllocationSample,
+// datadog.ObjectSample) and monitor contention (jdk.JavaMonitorEnter). Each
+// chunk's duration is the duration of its samples. The JVM information and
+// the initial system properties become facts, java.version as
+// runtime_version too.
+func FromJFR(data []byte) (*ProfileSet, error) {
+	ps := newProfileSet()
+	for offset := 0; offset < len(data); {
+		c, err := parseJFRChunk(data[offset:])
+		if err != nil {
+			return nil, fmt.Errorf("JFR chunk at offset %d: %w", offset, err)
+		}
+		if err := c.addTo(ps); err != nil {
+			return nil, fmt.Errorf("JFR chunk at offset %d: %w", offset, err)
+		}
+		offset += len(c.r.buf)
+	}
+	return ps.finalize(), nil
+}
+
+// addTo adds the samples and facts of the chunk's events to ps.
+func (c *jfrChunk) addTo(ps *ProfileSet) error {
+	totals := map[string]int64{}
+	var types []string
+	stacks := map[jfrRef]uint32{}
+	c.events(func(class *jfrClass, event *jfrObject) {
+		switch class.name {
+		case "jdk.JVMInformation":
+			ps.addFact("jvm_name", jfrString(c.field(event, "jvmName")))
+			ps.addFact("jvm_version", jfrString(c.field(event, "jvmVersion")))
+			return
+		case "jdk.InitialSystemProperty":
+			key, value := jfrString(c.field(event, "key")), jfrString(c.field(event, "value"))
+			ps.addFact(key, value)
+			if key == "java.version" {
+				ps.addFact("runtime_version", value)
+			}
+			return
+		}
+		et, ok := jfrEventTypes[class.name]
+		if !ok {
+			return
+		}
+		stack := c.stack(ps, stacks, event)
+		labels := ps.internLabels(c.labels(event))
+		for _, st := range et.samples {
+			val := st.value(c, event)
+			if _, seen := totals[st.profileType]; !seen {
+				types = append(types, st.profileType)
+			}
+			totals[st.profileType] += val
+			ps.addSample(st.profileType, stack, labels, val)
+		}
+	})
+	if c.r.err != nil {
+		return c.r.err
+	}
+	for _, t := range types {
+		ps.addProfileDuration(t, totals[t], float64(c.durationNanos)/1e9)
+	}
+	return nil
+}
+
+// stack returns the interned folded stack of an event's stack trace, folding
+// each stack trace of the constant pool once.
+func (c *jfrChunk) stack(ps *ProfileSet, stacks map[jfrRef]uint32, event *jfrObject) uint32 {
+	raw := event.get("stackTrace")
+	ref, isRef := raw.(jfrRef)
+	if isRef {
+		if id, ok := stacks[ref]; ok {
+			return id
+		}
+	}
+	frames, _ := c.field(raw, "frames").([]any)
+	names := make([]string, 0, len(frames)) // leaf-first, reversed below
+	for _, f := range frames {
+		names = append(names, c.frameName(f))
+	}
+	reverse(names)
+	id := ps.internStack(strings.Join(names, ";"))
+	if isRef {
+		stacks[ref] = id
+	}
+	return id
+}
+
+// frameName names a stack frame's method after its class, e.g.
+// "java.lang.Thread.run".
+func (c *jfrChunk) frameName(frame any) string {
+	method := c.field(frame, "method")
+	name := jfrString(c.field(c.field(method, "name"), "string"))
+	class := jfrString(c.field(c.field(c.field(method, "type"), "name"), "string"))
+	if class == "" {
+		return name
+	}
+	return strings.ReplaceAll(class, "/", ".") + "." + name
+}
+
+// labels returns the canonical labels of an event: its thread's name and ID,
+// and its span context.
+func (c *jfrChunk) labels(event *jfrObject) map[string][]string {
+	labels := map[string][]string{}
+	add := func(key, value string) {
+		if value != "" && value != "0" {
+			labels[key] = append(labels[key], value)
+		}
+	}
+	for _, f := range jfrThreadFields {
+		thread := c.field(event, f)
+		if thread == nil {
+			continue
+		}
+		name := jfrString(c.field(thread, "javaName"))
+		if name == "" {
+			name = jfrString(c.field(thread, "osName"))
+		}
+		add(LabelThreadName, name)
+		id, ok := jfrNumber(c.field(thread, "javaThreadId"))
+		if !ok || id == 0 {
+			id, _ = jfrNumber(c.field(thread, "osThreadId"))
+		}
+		add(LabelThreadID, fmt.Sprint(int64(id)))
+		break
+	}
+	for _, f := range jfrContextFields {
+		if v, ok := jfrNumber(c.field(event, f)); ok {
+			add(canonKey(f), fmt.Sprint(int64(v)))
+		}
+	}
+	return labels
+}
+
+// jfrString returns v if it is a string, "" otherwise.
+func jfrString(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+// jfrNumber returns v as a float64 if it is a number.
+func jfrNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// --- chunk parsing ---------------------------------------------------------
+
+// jfrHeaderSize is the size of a chunk header: magic, version, then the
+// chunk size, constant pool and metadata offsets, start time, duration,
+// start ticks and tick frequency as 64-bit integers, then the features.
+const jfrHeaderSize = 68
+
+// jfrCompressedInts is the feature flag of chunks whose integers are LEB128
+// varints rather than fixed-size big-endian.
+const jfrCompressedInts = 1
+
+// jfrMaxDepth bounds the nesting of inline values, which a malformed
+// metadata could make infinite. A chunk holds at most jfrMaxDepth values per
+// byte, which bounds the values of classes without fields.
+const jfrMaxDepth = 32
+
+// jfrChunk is a parsed chunk: its type metadata and constant pools. Events
+// are read from it on demand (see events).
+type jfrChunk struct {
+	r              *jfrReader
+	durationNanos  int64
+	ticksPerSecond int64
+	metadataOffset int64
+	classes        map[int64]*jfrClass
+	stringClass    int64
+	// pools holds the constant pools, by class ID then constant index.
+	pools map[int64]map[int64]any
+	// values counts the values read.
+	values int
+}
+
+// jfrClass describes a type: an event, a compound value or a primitive.
+type jfrClass struct {
+	id        int64
+	name      string
+	superType string
+	fields    []jfrField
+}
+
+type jfrField struct {
+	name  string
+	class int64
+	// constantPool fields hold an index into the pool of their class.
+	constantPool bool
+	array        bool
+}
+
+// jfrObject is a compound value: the values of its class's fields, in order.
+type jfrObject struct {
+	class  *jfrClass
+	fields []any
+}
+
+func (o *jfrObject) get(name string) any {
+	for i, f := range o.class.fields {
+		if f.name == name {
+			return o.fields[i]
+		}
+	}
+	return nil
+}
+
+// jfrRef is a reference to a constant pool entry.
+type jfrRef struct {
+	class, index int64
+}
+
+// Values are int64 (integers, booleans and chars), float64, string, []any
+// (arrays), *jfrObject or jfrRef until resolved.
+
+// resolve returns the constant a jfrRef refers to, or v itself.
+func (c *jfrChunk) resolve(v any) any {
+	if ref, ok := v.(jfrRef); ok {
+		return c.pools[ref.class][ref.index]
+	}
+	return v
+}
+
+// field returns the resolved value of a field of the object v resolves to,
+// or nil.
+func (c *jfrChunk) field(v any, name string) any {
+	o, ok := c.resolve(v).(*jfrObject)
+	if !ok {
+		return nil
+	}
+	return c.resolve(o.get(name))
+}
+
+// parseJFRChunk parses the header, metadata and constant pools of the chunk
+// data starts with.
+func parseJFRChunk(data []byte) (*jfrChunk, error) {
+	if len(data) < jfrHeaderSize || !bytes.HasPrefix(data, jfrMagic) {
+		return nil, fmt.Errorf("not a JFR chunk")
+	}
+	if major := binary.BigEndian.Uint16(data[4:]); major != 2 {
+		return nil, fmt.Errorf("unsupported JFR version %d.%d", major, binary.BigEndian.Uint16(data[6:]))
+	}
+	header := func(i int) int64 { return int64(binary.BigEndian.Uint64(data[8+8*i:])) }
+	size := header(0)
+	if size < jfrHeaderSize || size > int64(len(data)) {
+		return nil, fmt.Errorf("chunk size %d out of bounds", size)
+	}
+	c := &jfrChunk{
+		r:              &jfrReader{buf: data[:size], compressed: binary.BigEndian.Uint32(data[64:])&jfrCompressedInts != 0},
+		durationNanos:  header(4),
+		ticksPerSecond: header(6),
+		metadataOffset: header(2),
+		classes:        map[int64]*jfrClass{},
+		pools:          map[int64]map[int64]any{},
+	}
+	c.readMetadata()
+	c.readConstantPools(header(1))
+	return c, c.r.err
+}
+
+// readMetadata reads the classes of the metadata event.
+func (c *jfrChunk) readMetadata() {
+	r := c.r
+	r.seek(c.metadataOffset)
+	r.int(4) // size
+	if typ := r.int(8); typ != 0 && r.err == nil {
+		r.fail("metadata event has type %d", typ)
+		return
+	}
+	r.int(8) // start time
+	r.int(8) // duration
+	r.int(8) // metadata ID
+	n := r.length()
+	strs := make([]string, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		s, _ := r.string(0).(string)
+		strs = append(strs, s)
+	}
+	root := r.element(strs, 0)
+	for _, m := range root.children {
+		if m.name != "metadata" {
+			continue
+		}
+		for _, e := range m.children {
+			if e.name != "class" {
+				continue
+			}
+			class := &jfrClass{id: e.int("id"), name: e.attrs["name"], superType: e.attrs["superType"]}
+			for _, f := range e.children {
+				if f.name == "field" {
+					class.fields = append(class.fields, jfrField{
+						name:         f.attrs["name"],
+						class:        f.int("class"),
+						constantPool: f.attrs["constantPool"] == "true",
+						array:        f.attrs["dimension"] == "1",
+					})
+				}
+			}
+			c.classes[class.id] = class
+			if class.name == "java.lang.String" {
+				c.stringClass = class.id
+			}
+		}
+	}
+}
+
+// readConstantPools reads the constant pool events, following their chain
+// from the one at offset.
+func (c *jfrChunk) readConstantPools(offset int64) {
+	r := c.r
+	for seen := map[int64]bool{}; offset > 0 && !seen[offset] && r.err == nil; {
+		seen[offset] = true
+		r.seek(offset)
+		r.int(4) // size
+		if typ := r.int(8); typ != 1 && r.err == nil {
+			r.fail("constant pool event has type %d", typ)
+			return
+		}
+		r.int(8) // start time
+		r.int(8) // duration
+		delta := r.int(8)
+		r.byte() // checkpoint type
+		pools := r.length()
+		for i := 0; i < pools && r.err == nil; i++ {
+			classID := r.int(8)
+			pool := c.pools[classID]
+			if pool == nil {
+				pool = map[int64]any{}
+				c.pools[classID] = pool
+			}
+			count := r.length()
+			for j := 0; j < count && r.err == nil; j++ {
+				index := r.int(8)
+				pool[index] = c.value(classID, 0)
+			}
+		}
+		if delta == 0 {
+			return
+		}
+		offset += delta
+	}
+}
+
+// events calls fn for every event of the chunk but metadata and constant
+// pools, in order.
+func (c *jfrChunk) events(fn func(class *jfrClass, event *jfrObject)) {
+	r := c.r
+	r.seek(jfrHeaderSize)
+	for r.pos < len(r.buf) && r.err == nil {
+		start := r.pos
+		size := r.int(4)
+		typ := r.int(8)
+		if size <= 0 || size > int64(len(r.buf)-start) {
+			r.fail("event size %d out of bounds", size)
+			return
+		}
+		if class := c.classes[typ]; class != nil && typ > 1 {
+			if _, wanted := jfrEventTypes[class.name]; wanted || class.name == "jdk.JVMInformation" || class.name == "jdk.InitialSystemProperty" {
+				if event, ok := c.value(typ, 0).(*jfrObject); ok && r.err == nil {
+					fn(class, event)
+				}
+			}
+		}
+		r.pos = start + int(size)
+	}
+}
+
+// value reads a value of a class.
+func (c *jfrChunk) value(classID int64, depth int) any {
+	r := c.r
+	if c.values++; c.values > jfrMaxDepth*len(r.buf) {
+		r.fail("too many values")
+		return nil
+	}
+	class := c.classes[classID]
+	if class == nil {
+		r.fail("unknown class %d", classID)
+		return nil
+	}
+	switch class.name {
+	case "boolean", "byte":
+		return int64(r.byte())
+	case "char", "short":
+		return r.int(2)
+	case "int":
+		return r.int(4)
+	case "long":
+		return r.int(8)
+	case "float":
+		return float64(math.Float32frombits(uint32(r.fixed(4))))
+	case "double":
+		return math.Float64frombits(r.fixed(8))
+	case "java.lang.String":
+		return r.string(c.stringClass)
+	}
+	if depth > jfrMaxDepth {
+		r.fail("values of class %s nested too deep", class.name)
+		return nil
+	}
+	o := &jfrObject{class: class, fields: make([]any, len(class.fields))}
+	for i, f := range class.fields {
+		if f.array {
+			n := r.length()
+			values := make([]any, 0, n)
+			for j := 0; j < n && r.err == nil; j++ {
+				values = append(values, c.fieldValue(f, depth))
+			}
+			o.fields[i] = values
+			continue
+		}
+		o.fields[i] = c.fieldValue(f, depth)
+	}
+	return o
+}
+
+func (c *jfrChunk) fieldValue(f jfrField, depth int) any {
+	if f.constantPool {
+		return jfrRef{class: f.class, index: c.r.int(8)}
+	}
+	return c.value(f.class, depth+1)
+}
+
+// jfrReader reads the integers and strings of a chunk. Its first error is
+// kept in err, after which it only returns zero values.
+type jfrReader struct {
+	buf        []byte
+	pos        int
+	compressed bool
+	err        error
+}
+
+func (r *jfrReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf("offset %d: %s", r.pos, fmt.Sprintf(format, args...))
+	}
+	r.pos = len(r.buf)
+}
+
+func (r *jfrReader) seek(offset int64) {
+	if offset < 0 || offset >= int64(len(r.buf)) {
+		r.fail("offset %d out of bounds", offset)
+		return
+	}
+	r.pos = int(offset)
+}
+
+func (r *jfrReader) byte() byte {
+	if r.pos >= len(r.buf) {
+		r.fail("unexpected end of chunk")
+		return 0
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b
+}
+
+// fixed reads a big-endian unsigned integer of size bytes.
+func (r *jfrReader) fixed(size int) uint64 {
+	var v uint64
+	for range size {
+		v = v<<8 | uint64(r.byte())
+	}
+	return v
+}
+
+// int reads a signed integer of size bytes when uncompressed.
+func (r *jfrReader) int(size int) int64 {
+	if !r.compressed {
+		shift := 64 - 8*size
+		return int64(r.fixed(size)<<shift) >> shift
+	}
+	// LEB128, except that a 9th byte holds 8 bits.
+	var v uint64
+	for i := 0; i < 8; i++ {
+		b := r.byte()
+		v |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			return int64(v)
+		}
+	}
+	return int64(v | uint64(r.byte())<<56)
+}
+
+// length reads a count of items, each at least one byte long.
+func (r *jfrReader) length() int {
+	n := r.int(4)
+	if n < 0 || n > int64(len(r.buf)-r.pos) {
+		r.fail("length %d out of bounds", n)
+		return 0
+	}
+	return int(n)
+}
+
+// string reads a string, or a reference to the pool of stringClass.
+func (r *jfrReader) string(stringClass int64) any {
+	switch enc := r.byte(); enc {
+	case 0, 1: // null, empty
+		return ""
+	case 2:
+		return jfrRef{class: stringClass, index: r.int(8)}
+	case 3: // UTF-8
+		n := r.length()
+		s := string(r.buf[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case 4: // UTF-16 chars
+		n := r.length()
+		chars := make([]uint16, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			chars = append(chars, uint16(r.int(2)))
+		}
+		return string(utf16.Decode(chars))
+	case 5: // Latin-1
+		n := r.length()
+		runes := make([]rune, n)
+		for i := range runes {
+			runes[i] = rune(r.buf[r.pos+i])
+		}
+		r.pos += n
+		return string(runes)
+	default:
+		r.fail("unknown string encoding %d", enc)
+		return ""
+	}
+}
+
+// jfrElement is an element of the metadata event's tree.
+type jfrElement struct {
+	name     string
+	attrs    map[string]string
+	children []*jfrElement
+}
+
+func (e *jfrElement) int(attr string) int64 {
+	var v int64
+	fmt.Sscan(e.attrs[attr], &v)
+	return v
+}
+
+// element reads a metadata element, whose names are indexes into strs.
+func (r *jfrReader) element(strs []string, depth int) *jfrElement {
+	str := func() string {
+		i := r.int(4)
+		if i < 0 || i >= int64(len(strs)) {
+			r.fail("string index %d out of bounds", i)
+			return ""
+		}
+		return strs[i]
+	}
+	e := &jfrElement{name: str(), attrs: map[string]string{}}
+	if depth > jfrMaxDepth {
+		r.fail("metadata nested too deep")
+		return e
+	}
+	attrs := r.length()
+	for i := 0; i < attrs && r.err == nil; i++ {
+		k := str()
+		e.attrs[k] = str()
+	}
+	children := r.length()
+	for i := 0; i < children && r.err == nil; i++ {
+		e.children = append(e.children, r.element(strs, depth+1))
+	}
+	return e
+}
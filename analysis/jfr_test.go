@@ -0,0 +1,466 @@
+package analysis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// jfrWriter encodes JFR chunks for tests, mirroring the parser: the classes
+// it is given are written as the chunk's metadata and describe how pool
+// constants and events are encoded.
+type jfrWriter struct {
+	buf        []byte
+	compressed bool
+	classes    map[int64]*jfrClass
+}
+
+// int writes an integer of size bytes when uncompressed.
+func (w *jfrWriter) int(size int, v int64) {
+	if !w.compressed {
+		for i := size - 1; i >= 0; i-- {
+			w.buf = append(w.buf, byte(v>>(8*i)))
+		}
+		return
+	}
+	u := uint64(v)
+	for range 8 {
+		if u < 0x80 {
+			w.buf = append(w.buf, byte(u))
+			return
+		}
+		w.buf = append(w.buf, byte(u)|0x80)
+		u >>= 7
+	}
+	w.buf = append(w.buf, byte(u))
+}
+
+func (w *jfrWriter) string(s string) {
+	if s == "" {
+		w.buf = append(w.buf, 1)
+		return
+	}
+	w.buf = append(w.buf, 3)
+	w.int(4, int64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// value writes v as a value of a class: an int64, float64, string, jfrRef
+// (a pooled string), or a map of field names to values for compound
+// classes, whose constant pool fields are indexes.
+func (w *jfrWriter) value(classID int64, v any) {
+	class := w.classes[classID]
+	n, _ := v.(int64)
+	switch class.name {
+	case "boolean", "byte":
+		w.buf = append(w.buf, byte(n))
+	case "char", "short":
+		w.int(2, n)
+	case "int":
+		w.int(4, n)
+	case "long":
+		w.int(8, n)
+	case "float":
+		f, _ := v.(float64)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, math.Float32bits(float32(f)))
+	case "java.lang.String":
+		if ref, ok := v.(jfrRef); ok {
+			w.buf = append(w.buf, 2)
+			w.int(8, ref.index)
+			return
+		}
+		s, _ := v.(string)
+		w.string(s)
+	default:
+		o, _ := v.(map[string]any)
+		for _, f := range class.fields {
+			if !f.array {
+				w.field(f, o[f.name])
+				continue
+			}
+			values, _ := o[f.name].([]any)
+			w.int(4, int64(len(values)))
+			for _, e := range values {
+				w.field(f, e)
+			}
+		}
+	}
+}
+
+func (w *jfrWriter) field(f jfrField, v any) {
+	if f.constantPool {
+		n, _ := v.(int64)
+		w.int(8, n)
+		return
+	}
+	w.value(f.class, v)
+}
+
+// event writes an event, its size padded to 4 bytes as the JVM writes it.
+func (w *jfrWriter) event(typ int64, body func()) int64 {
+	start := len(w.buf)
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	w.int(8, typ)
+	body()
+	size := len(w.buf) - start
+	if w.compressed {
+		for i := range 3 {
+			w.buf[start+i] = byte(size>>(7*i)) | 0x80
+		}
+		w.buf[start+3] = byte(size >> 21)
+	} else {
+		binary.BigEndian.PutUint32(w.buf[start:], uint32(size))
+	}
+	return int64(start)
+}
+
+// metadata writes the metadata event describing w.classes, by ascending ID.
+func (w *jfrWriter) metadata(ids []int64) int64 {
+	var strs []string
+	index := map[string]int64{}
+	str := func(s string) int64 {
+		i, ok := index[s]
+		if !ok {
+			i = int64(len(strs))
+			index[s] = i
+			strs = append(strs, s)
+		}
+		return i
+	}
+	type element struct {
+		name     string
+		attrs    [][2]string
+		children []*element
+	}
+	meta := &element{name: "metadata"}
+	for _, id := range ids {
+		c := w.classes[id]
+		e := &element{name: "class", attrs: [][2]string{{"id", fmt.Sprint(id)}, {"name", c.name}}}
+		for _, f := range c.fields {
+			fe := &element{name: "field", attrs: [][2]string{{"name", f.name}, {"class", fmt.Sprint(f.class)}}}
+			if f.constantPool {
+				fe.attrs = append(fe.attrs, [2]string{"constantPool", "true"})
+			}
+			if f.array {
+				fe.attrs = append(fe.attrs, [2]string{"dimension", "1"})
+			}
+			e.children = append(e.children, fe)
+		}
+		meta.children = append(meta.children, e)
+	}
+	root := &element{name: "root", children: []*element{meta, {name: "region"}}}
+	var collect func(e *element)
+	collect = func(e *element) {
+		str(e.name)
+		for _, a := range e.attrs {
+			str(a[0])
+			str(a[1])
+		}
+		for _, c := range e.children {
+			collect(c)
+		}
+	}
+	collect(root)
+	var write func(e *element)
+	write = func(e *element) {
+		w.int(4, str(e.name))
+		w.int(4, int64(len(e.attrs)))
+		for _, a := range e.attrs {
+			w.int(4, str(a[0]))
+			w.int(4, str(a[1]))
+		}
+		w.int(4, int64(len(e.children)))
+		for _, c := range e.children {
+			write(c)
+		}
+	}
+	return w.event(0, func() {
+		w.int(8, 0) // start time
+		w.int(8, 0) // duration
+		w.int(8, 1) // metadata ID
+		w.int(4, int64(len(strs)))
+		for _, s := range strs {
+			w.string(s)
+		}
+		write(root)
+	})
+}
+
+// constantPool writes a constant pool event with the constants of the
+// classes listed, linked to the previous one at prev (0 for none).
+func (w *jfrWriter) constantPool(prev int64, pools map[int64]map[int64]any, classIDs ...int64) int64 {
+	start := int64(len(w.buf))
+	return w.event(1, func() {
+		w.int(8, 0) // start time
+		w.int(8, 0) // duration
+		if prev == 0 {
+			w.int(8, 0)
+		} else {
+			w.int(8, prev-start)
+		}
+		w.buf = append(w.buf, 0) // checkpoint type
+		w.int(4, int64(len(classIDs)))
+		for _, id := range classIDs {
+			w.int(8, id)
+			w.int(4, int64(len(pools[id])))
+			for i := int64(1); i <= int64(len(pools[id])); i++ {
+				w.int(8, i)
+				w.value(id, pools[id][i])
+			}
+		}
+	})
+}
+
+type jfrTestEvent struct {
+	typ    int64
+	fields map[string]any
+}
+
+// Class IDs of jfrTestClasses.
+const (
+	jfrTestString      = 20
+	jfrTestThread      = 21
+	jfrTestSymbol      = 22
+	jfrTestClass       = 23
+	jfrTestMethod      = 24
+	jfrTestStackTrace  = 26
+	jfrTestExecution   = 100
+	jfrTestDDExecution = 101
+	jfrTestDDMethod    = 102
+	jfrTestAllocation  = 103
+	jfrTestDDObject    = 104
+	jfrTestMonitor     = 105
+	jfrTestJVM         = 106
+	jfrTestProperty    = 107
+	jfrTestGCPause     = 108
+)
+
+// jfrTestClasses are the types of a JDK chunk, trimmed to the fields the
+// adapter reads plus a few it must skip over.
+func jfrTestClasses() map[int64]*jfrClass {
+	const long, integer, boolean, float = 10, 11, 12, 13
+	f := func(name string, class int64) jfrField { return jfrField{name: name, class: class} }
+	cp := func(name string, class int64) jfrField { return jfrField{name: name, class: class, constantPool: true} }
+	sampled := func(thread string, extra ...jfrField) []jfrField {
+		return append([]jfrField{f("startTime", long), cp(thread, jfrTestThread), cp("stackTrace", jfrTestStackTrace)}, extra...)
+	}
+	classes := map[int64]*jfrClass{
+		long:          {name: "long"},
+		integer:       {name: "int"},
+		boolean:       {name: "boolean"},
+		float:         {name: "float"},
+		jfrTestString: {name: "java.lang.String"},
+		jfrTestThread: {name: "java.lang.Thread", fields: []jfrField{f("osName", jfrTestString), f("osThreadId", long), f("javaName", jfrTestString), f("javaThreadId", long)}},
+		jfrTestSymbol: {name: "jdk.types.Symbol", fields: []jfrField{f("string", jfrTestString)}},
+		jfrTestClass:  {name: "java.lang.Class", fields: []jfrField{cp("name", jfrTestSymbol)}},
+		jfrTestMethod: {name: "jdk.types.Method", fields: []jfrField{cp("type", jfrTestClass), cp("name", jfrTestSymbol)}},
+		25:            {name: "jdk.types.StackFrame", fields: []jfrField{cp("method", jfrTestMethod), f("lineNumber", integer)}},
+		jfrTestStackTrace: {name: "jdk.types.StackTrace", fields: []jfrField{
+			f("truncated", boolean), {name: "frames", class: 25, array: true},
+		}},
+		jfrTestExecution:   {name: "jdk.ExecutionSample", fields: sampled("sampledThread")},
+		jfrTestDDExecution: {name: "datadog.ExecutionSample", fields: sampled("eventThread", f("spanId", long), f("localRootSpanId", long))},
+		jfrTestDDMethod:    {name: "datadog.MethodSample", fields: sampled("eventThread", f("spanId", long), f("localRootSpanId", long), f("weight", long))},
+		jfrTestAllocation:  {name: "jdk.ObjectAllocationSample", fields: sampled("eventThread", cp("objectClass", jfrTestClass), f("weight", long))},
+		jfrTestDDObject:    {name: "datadog.ObjectSample", fields: sampled("eventThread", f("size", long), f("weight", float))},
+		jfrTestMonitor: {name: "jdk.JavaMonitorEnter", fields: []jfrField{
+			f("startTime", long), f("duration", long), cp("eventThread", jfrTestThread), cp("stackTrace", jfrTestStackTrace), cp("monitorClass", jfrTestClass),
+		}},
+		jfrTestJVM:      {name: "jdk.JVMInformation", fields: []jfrField{f("startTime", long), f("jvmName", jfrTestString), f("jvmVersion", jfrTestString)}},
+		jfrTestProperty: {name: "jdk.InitialSystemProperty", fields: []jfrField{f("startTime", long), f("key", jfrTestString), f("value", jfrTestString)}},
+		jfrTestGCPause:  {name: "jdk.GCPhasePause", fields: []jfrField{f("startTime", long), f("duration", long), f("name", jfrTestString)}},
+	}
+	for id, c := range classes {
+		c.id = id
+	}
+	return classes
+}
+
+// jfrTestPools are the constants of a chunk: two threads, the second one
+// with only an OS name and ID, and two stack traces,
+// Thread.run;App.main;App.work and Thread.run;App.main;App.alloc.
+func jfrTestPools() map[int64]map[int64]any {
+	frame := func(method int64) any { return map[string]any{"method": method, "lineNumber": int64(10)} }
+	return map[int64]map[int64]any{
+		jfrTestString: {1: "java/lang/Thread"},
+		jfrTestSymbol: {
+			1: map[string]any{"string": jfrRef{class: jfrTestString, index: 1}},
+			2: map[string]any{"string": "run"},
+			3: map[string]any{"string": "com/example/App"},
+			4: map[string]any{"string": "main"},
+			5: map[string]any{"string": "work"},
+			6: map[string]any{"string": "alloc"},
+		},
+		jfrTestClass: {1: map[string]any{"name": int64(1)}, 2: map[string]any{"name": int64(3)}},
+		jfrTestMethod: {
+			1: map[string]any{"type": int64(1), "name": int64(2)},
+			2: map[string]any{"type": int64(2), "name": int64(4)},
+			3: map[string]any{"type": int64(2), "name": int64(5)},
+			4: map[string]any{"type": int64(2), "name": int64(6)},
+		},
+		jfrTestStackTrace: {
+			1: map[string]any{"frames": []any{frame(3), frame(2), frame(1)}},
+			2: map[string]any{"frames": []any{frame(4), frame(2), frame(1)}},
+		},
+		jfrTestThread: {
+			1: map[string]any{"osName": "main", "osThreadId": int64(100), "javaName": "main", "javaThreadId": int64(1)},
+			2: map[string]any{"osName": "worker-os", "osThreadId": int64(101)},
+		},
+	}
+}
+
+// encodeJFRChunk encodes a chunk of durationSecs with the test classes and
+// pools, ticking in microseconds. Metadata and constant pools follow the
+// events, the pools split in two linked events, as the JVM writes them.
+func encodeJFRChunk(compressed bool, durationSecs int64, events ...jfrTestEvent) []byte {
+	w := &jfrWriter{buf: make([]byte, jfrHeaderSize), compressed: compressed, classes: jfrTestClasses()}
+	for _, e := range events {
+		w.event(e.typ, func() { w.value(e.typ, e.fields) })
+	}
+	ids := []int64{10, 11, 12, 13, 20, 21, 22, 23, 24, 25, 26, 100, 101, 102, 103, 104, 105, 106, 107, 108}
+	metadata := w.metadata(ids)
+	pools := jfrTestPools()
+	first := w.constantPool(0, pools, jfrTestString, jfrTestSymbol, jfrTestClass, jfrTestMethod)
+	last := w.constantPool(first, pools, jfrTestStackTrace, jfrTestThread)
+
+	h := w.buf[:jfrHeaderSize]
+	copy(h, jfrMagic)
+	binary.BigEndian.PutUint16(h[4:], 2)
+	binary.BigEndian.PutUint16(h[6:], 1)
+	for i, v := range []int64{int64(len(w.buf)), last, metadata, 0, durationSecs * 1e9, 0, 1e6} {
+		binary.BigEndian.PutUint64(h[8+8*i:], uint64(v))
+	}
+	if compressed {
+		binary.BigEndian.PutUint32(h[64:], jfrCompressedInts)
+	}
+	return w.buf
+}
+
+// jfrTestEvents are one of each event the adapter reads, and some it skips.
+func jfrTestEvents() []jfrTestEvent {
+	sample := func(typ, thread, stack int64, fields map[string]any) jfrTestEvent {
+		if fields == nil {
+			fields = map[string]any{}
+		}
+		fields["startTime"] = int64(1)
+		fields["sampledThread"], fields["eventThread"] = thread, thread
+		fields["stackTrace"] = stack
+		return jfrTestEvent{typ: typ, fields: fields}
+	}
+	return []jfrTestEvent{
+		{typ: jfrTestJVM, fields: map[string]any{"jvmName": "OpenJDK 64-Bit Server VM", "jvmVersion": "21.0.1+12"}},
+		{typ: jfrTestProperty, fields: map[string]any{"key": "java.version", "value": "21.0.1"}},
+		sample(jfrTestExecution, 1, 1, nil),
+		sample(jfrTestExecution, 1, 1, nil),
+		{typ: jfrTestGCPause, fields: map[string]any{"duration": int64(300), "name": "pause"}},
+		sample(jfrTestDDExecution, 2, 1, map[string]any{"spanId": int64(42), "localRootSpanId": int64(7)}),
+		sample(jfrTestDDMethod, 1, 1, map[string]any{"weight": int64(3)}),
+		sample(jfrTestAllocation, 1, 2, map[string]any{"objectClass": int64(2), "weight": int64(4096)}),
+		sample(jfrTestDDObject, 1, 2, map[string]any{"size": int64(100), "weight": 2.5}),
+		{typ: jfrTestMonitor, fields: map[string]any{"duration": int64(5000), "eventThread": int64(2), "stackTrace": int64(1), "monitorClass": int64(2)}},
+	}
+}
+
+func TestFromJFR(t *testing.T) {
+	const work, alloc = "java.lang.Thread.run;com.example.App.main;com.example.App.work", "java.lang.Thread.run;com.example.App.main;com.example.App.alloc"
+	main := " thread id=[1] thread name=[main]"
+	worker := " thread id=[101] thread name=[worker-os]"
+	want := map[string]string{
+		"cpu-samples":   work + "=1" + main + "\n" + work + "=1" + main + "\n" + work + "=1 local root span id=[7] span id=[42]" + worker,
+		"wall-samples":  work + "=3" + main,
+		"alloc-samples": alloc + "=3" + main + "\n" + alloc + "=1" + main,
+		"alloc-space":   alloc + "=4096" + main + "\n" + alloc + "=250" + main,
+		"lock-count":    work + "=1" + worker,
+		"lock-time":     work + "=5000000" + worker,
+	}
+	for _, compressed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("compressed=%v", compressed), func(t *testing.T) {
+			ps, err := FromJFR(encodeJFRChunk(compressed, 10, jfrTestEvents()...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(ps.SampleTypes(), ","); got != "cpu-samples,wall-samples,alloc-samples,alloc-space,lock-count,lock-time" {
+				t.Errorf("SampleTypes = %s", got)
+			}
+			for typ, w := range want {
+				if got := folded(ps, typ); got != w {
+					t.Errorf("%s:\n%s\nwant:\n%s", typ, got, w)
+				}
+				if d := ps.Duration(typ); d != 10 {
+					t.Errorf("Duration(%s) = %v, want 10", typ, d)
+				}
+			}
+			for k, v := range map[string]string{"jvm_name": "OpenJDK 64-Bit Server VM", "jvm_version": "21.0.1+12", "java.version": "21.0.1", "runtime_version": "21.0.1"} {
+				if got := ps.facts[k]; got != v {
+					t.Errorf("fact %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+// TestFromJFR_Chunks covers recordings of several chunks, each repeating the
+// metadata and constant pools, whose samples add up.
+func TestFromJFR_Chunks(t *testing.T) {
+	events := jfrTestEvents()[2:4] // two CPU samples
+	data := append(encodeJFRChunk(true, 10, events...), encodeJFRChunk(true, 30, events[0])...)
+	ps, err := FromJFR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ps.Total("cpu-samples"); got != 3 {
+		t.Errorf("Total = %d, want 3", got)
+	}
+	// 3 samples at 2/10 + 1/30 samples per second.
+	if d := ps.Duration("cpu-samples"); math.Abs(d-3/(2.0/10+1.0/30)) > 1e-9 {
+		t.Errorf("Duration = %v", d)
+	}
+}
+
+func TestFromJFR_Errors(t *testing.T) {
+	chunk := encodeJFRChunk(true, 10, jfrTestEvents()...)
+	version := append([]byte(nil), chunk...)
+	binary.BigEndian.PutUint16(version[4:], 1)
+	cases := map[string]struct {
+		data []byte
+		want string
+	}{
+		"not JFR":     {[]byte("not a recording, but long enough to hold a JFR chunk header of 68 bytes"), "not a JFR chunk"},
+		"version":     {version, "unsupported JFR version 1.1"},
+		"truncated":   {chunk[:len(chunk)-10], "out of bounds"},
+		"second":      {append(append([]byte(nil), chunk...), "FLR"...), "chunk at offset"},
+		"header only": {chunk[:jfrHeaderSize], "out of bounds"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := FromJFR(c.data)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("err = %v, want %q", err, c.want)
+			}
+		})
+	}
+}
+
+// TestLoadProfileSet_JFR covers the dispatch to FromJFR by suffix and, for
+// other names, by content.
+func TestLoadProfileSet_JFR(t *testing.T) {
+	dir := t.TempDir()
+	data := encodeJFRChunk(true, 10, jfrTestEvents()...)
+	for _, name := range []string{"recording.jfr", "profile"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ps, err := LoadProfileSet(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := ps.Total("cpu-samples"); got != 3 {
+			t.Errorf("%s: cpu-samples total = %d, want 3", name, got)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// JUnit XML output: CI systems (GitHub Actions, GitLab, Jenkins) render JUnit
+// natively, so each analysis Result can be written as a test suite with one
+// test case per assertion.
+package analysis
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes results to w as JUnit XML: one test suite per Result,
+// named after its test_name, and one test case per assertion, named after
+// the profile type, file and regex. Skipped assertions and profile types are
+// reported as skipped, allowed failures as passing (with the failure in
+// system-out), and the result's Errors as test cases in error.
+func WriteJUnit(w io.Writer, results ...*Result) error {
+	var doc junitTestSuites
+	var total time.Duration
+	for _, res := range results {
+		suite := junitSuite(res)
+		doc.Tests += suite.Tests
+		doc.Failures += suite.Failures
+		doc.Errors += suite.Errors
+		doc.Skipped += suite.Skipped
+		total += res.Elapsed
+		doc.Suites = append(doc.Suites, suite)
+	}
+	doc.Time = junitSeconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteJUnitFile writes results as JUnit XML to path, creating its directory
+// if needed.
+func WriteJUnitFile(path string, results ...*Result) error {
+	return writeReportFile(path, os.O_TRUNC, func(w io.Writer) error { return WriteJUnit(w, results...) })
+}
+
+func junitSuite(res *Result) junitTestSuite {
+	suite := junitTestSuite{Name: res.TestName, Time: junitSeconds(res.Elapsed)}
+	if suite.Name == "" {
+		suite.Name = filepath.Base(filepath.Dir(res.Expectations))
+	}
+	add := func(c junitTestCase) {
+		suite.Tests++
+		switch {
+		case c.Failure != nil:
+			suite.Failures++
+		case c.Error != nil:
+			suite.Errors++
+		case c.Skipped != nil:
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	for _, f := range res.Files {
+		file := filepath.Base(f.Path)
+		for _, t := range f.Types {
+			classname := suite.Name + "." + t.ProfileType
+			if t.Skipped {
+				add(junitTestCase{
+					Name:      fmt.Sprintf("[%s] %s", t.ProfileType, file),
+					Classname: classname,
+					Time:      junitSeconds(t.Elapsed),
+					Skipped:   &junitMessage{Message: t.SkipReason},
+				})
+				continue
+			}
+			for _, a := range t.Assertions {
+				c := junitTestCase{
+					Name:      junitCaseName(a, file),
+					Classname: classname,
+					Time:      junitSeconds(a.Elapsed),
+				}
+				switch a.Verdict {
+				case VerdictFail:
+					c.Failure = &junitMessage{Message: a.Message(), Body: junitFailureBody(a)}
+				case VerdictSkipped:
+					c.Skipped = &junitMessage{Message: a.SkipReason}
+				case VerdictAllowedFailure:
+					c.SystemOut = junitFailureBody(a)
+				}
+				add(c)
+			}
+		}
+	}
+	for _, e := range res.Errors {
+		add(junitTestCase{
+			Name:      "analysis",
+			Classname: suite.Name,
+			Time:      junitSeconds(0),
+			Error:     &junitMessage{Message: e, Body: e},
+		})
+	}
+	return suite
+}
+
+// junitCaseName names an assertion's test case, e.g.
+// "[cpu-time] profile.pprof: ^main;hot$ (percent)".
+func junitCaseName(a *AssertionResult, file string) string {
+	if a.Regex == "" {
+		return fmt.Sprintf("[%s] %s: %s", a.ProfileType, file, a.Kind)
+	}
+	name := fmt.Sprintf("[%s] %s: %s", a.ProfileType, file, a.Regex)
+	if len(a.Labels) > 0 {
+		name += fmt.Sprintf(" labels=%v", a.Labels)
+	}
+	return name + " (" + string(a.Kind) + ")"
+}
+
+// junitFailureBody is the message of a failed assertion followed by its
+// diagnosis, if any.
+func junitFailureBody(a *AssertionResult) string {
+	if a.Diagnosis == nil {
+		return a.Message()
+	}
+	return a.Message() + "\n" + a.Diagnosis.String()
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,58 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+// TestWriteJUnit checks the suite counters and the naming, failure and skip
+// mapping of test cases.
+func TestWriteJUnit(t *testing.T) {
+	res := &Result{
+		TestName:     "my-scenario",
+		Expectations: "scenarios/my-scenario/expected_profile.json",
+		Files: []*FileResult{{
+			Path: "/tmp/data/profile.pprof",
+			Types: []*TypeResult{
+				{ProfileType: "cpu-time", Assertions: []*AssertionResult{
+					{Kind: AssertPercent, ProfileType: "cpu-time", Regex: "^main;hot$", Expected: 90, Actual: 90, Verdict: VerdictPass},
+					{Kind: AssertValue, ProfileType: "cpu-time", Regex: "^main;cold$", Expected: 10, Actual: 0, Error: 100, Verdict: VerdictFail},
+					{Kind: AssertValue, ProfileType: "cpu-time", Regex: "^main;new$", Verdict: VerdictSkipped, SkipReason: `fact "runtime_version" is not set`},
+					{Kind: AssertValueMatchingSum, ProfileType: "cpu-time", Expected: 100, Actual: 90, Error: 10, Verdict: VerdictAllowedFailure},
+				}},
+				{ProfileType: "wall-time", Skipped: true, SkipReason: "not on this runtime"},
+			},
+		}},
+		Errors: []string{"No matching files found for alloc in /tmp/data"},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteJUnit(&buf, res); err != nil {
+		t.Fatal(err)
+	}
+	var doc junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, buf.String())
+	}
+	if doc.Tests != 6 || doc.Failures != 1 || doc.Errors != 1 || doc.Skipped != 2 {
+		t.Errorf("counters = %d tests, %d failures, %d errors, %d skipped\n%s", doc.Tests, doc.Failures, doc.Errors, doc.Skipped, buf.String())
+	}
+	suite := doc.Suites[0]
+	if suite.Name != "my-scenario" {
+		t.Errorf("suite name = %q", suite.Name)
+	}
+	if got := suite.Cases[0].Name; got != "[cpu-time] profile.pprof: ^main;hot$ (percent)" {
+		t.Errorf("case name = %q", got)
+	}
+	if c := suite.Cases[1]; c.Failure == nil || !strings.Contains(c.Failure.Message, "should have been 10.0") {
+		t.Errorf("failing case = %+v", c)
+	}
+	if c := suite.Cases[3]; c.Failure != nil || !strings.Contains(c.SystemOut, "failed (allowed)") {
+		t.Errorf("allowed failure case = %+v", c)
+	}
+	if c := suite.Cases[4]; c.Skipped == nil || c.Name != "[wall-time] profile.pprof" {
+		t.Errorf("skipped type case = %+v", c)
+	}
+}
@@ -0,0 +1,380 @@
+// Expectation linting: static checks on an expected_profile.json that catch
+// mistakes schema validation cannot, before a scenario ever runs. Without it a
+// bad regex only surfaces when AnalyzeResults compiles it, and contradictory
+// expectations (percents summing above 100, overlapping regexes double-counted
+// by value-matching-sum) only show up as confusing assertion failures.
+package analysis
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"unicode"
+
+	"github.com/hashicorp/go-version"
+)
+
+// LintSeverity tells whether a LintIssue makes the expectation wrong (an
+// error) or merely suspicious (a warning).
+type LintSeverity int
+
+const (
+	LintWarning LintSeverity = iota
+	LintError
+)
+
+func (s LintSeverity) String() string {
+	if s == LintError {
+		return "error"
+	}
+	return "warning"
+}
+
+// LintIssue is one finding of Lint. Path locates it in the document, e.g.
+// "stacks[0].stack-content[2].regular_expression".
+type LintIssue struct {
+	Severity LintSeverity
+	Path     string
+	Message  string
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.Severity, i.Path, i.Message)
+}
+
+// LintFile loads the expectation file at path (see ReadJSONFileWithVars) and
+// lints it. Loading failures, schema violations included, are returned as the
+// error.
+func LintFile(path string, vars map[string]string) ([]LintIssue, error) {
+	data, err := ReadJSONFileWithVars(path, vars)
+	if err != nil {
+		return nil, err
+	}
+	return Lint(&data), nil
+}
+
+// Lint statically checks data:
+//   - every regex (stack contents, label values, pprof-regex, when conditions)
+//     compiles, and every version constraint parses;
+//   - a pprof-regex does not repeat the one it would inherit anyway;
+//   - the percents of stack contents that cannot match the same samples do not
+//     sum above 100 within a profile type;
+//   - in a profile type with value-matching-sum, no two stack contents can
+//     match the same sample, which would count its value twice.
+//
+// Stack contents with a `when` clause are only checked individually, as
+// whether they apply together depends on the run.
+func Lint(data *StackTestData) []LintIssue {
+	l := linter{}
+
+	inherited := defaultPprofRegex
+	if data.PprofRegex != "" {
+		l.compile("pprof-regex", data.PprofRegex)
+		if data.PprofRegex == defaultPprofRegex {
+			l.warnf("pprof-regex", "same as the default, remove it")
+		}
+		inherited = data.PprofRegex
+	}
+
+	for i, typed := range data.Stacks {
+		path := fmt.Sprintf("stacks[%d]", i)
+		if typed.PprofRegex != "" {
+			l.compile(path+".pprof-regex", typed.PprofRegex)
+			if typed.PprofRegex == inherited {
+				l.warnf(path+".pprof-regex", "same as the one inherited from the top level, remove it")
+			}
+		}
+		l.conditions(path+".when", typed.When)
+		if t := typed.Transform; t != nil {
+			for _, f := range []struct {
+				name   string
+				filter *SampleFilter
+			}{{"filter", t.Filter}, {"exclude", t.Exclude}} {
+				if f.filter == nil {
+					continue
+				}
+				fpath := path + ".transform." + f.name
+				if f.filter.RegularExpression != "" {
+					l.compile(fpath+".regular_expression", f.filter.RegularExpression)
+				}
+				for k, label := range f.filter.Labels {
+					if label.ValuesRegex != "" {
+						l.compile(fmt.Sprintf("%s.labels[%d].values_regex", fpath, k), label.ValuesRegex)
+					}
+				}
+			}
+		}
+
+		// Compiled matchers of the stack contents that always apply, for the
+		// cross-entry checks below.
+		var entries []lintEntry
+		for j, content := range typed.StackContent {
+			cpath := fmt.Sprintf("%s.stack-content[%d]", path, j)
+			l.conditions(cpath+".when", content.When)
+			prog := l.compileProg(cpath+".regular_expression", content.RegularExpression)
+			for k, label := range content.Labels {
+				if label.ValuesRegex != "" {
+					l.compile(fmt.Sprintf("%s.labels[%d].values_regex", cpath, k), label.ValuesRegex)
+				}
+			}
+			if prog != nil && len(content.When) == 0 {
+				entries = append(entries, lintEntry{index: j, prog: prog, content: content})
+			}
+		}
+
+		// Greedily pick stack contents that cannot overlap each other: their
+		// percents are shares of disjoint sets of samples.
+		var disjoint []lintEntry
+		var sum int64
+		for _, e := range entries {
+			pct, ok := e.content.Percent.Value()
+			if !ok || overlapsAny(e, disjoint) {
+				continue
+			}
+			disjoint = append(disjoint, e)
+			sum += pct
+		}
+		if sum > 100 {
+			l.errorf(path+".stack-content", "percents of stack contents matching disjoint samples sum to %d%%, more than 100%%", sum)
+		}
+
+		if _, ok := typed.ValueMatchingSum.Value(); ok {
+			for a := range entries {
+				for b := a + 1; b < len(entries); b++ {
+					if entries[a].overlaps(entries[b]) {
+						l.errorf(path+".stack-content", "entries %d ('%s') and %d ('%s') can match the same samples, which value_matching_sum would count twice",
+							entries[a].index, entries[a].content.RegularExpression, entries[b].index, entries[b].content.RegularExpression)
+					}
+				}
+			}
+		}
+	}
+	return l.issues
+}
+
+type linter struct {
+	issues []LintIssue
+}
+
+func (l *linter) errorf(path, format string, args ...any) {
+	l.issues = append(l.issues, LintIssue{Severity: LintError, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warnf(path, format string, args ...any) {
+	l.issues = append(l.issues, LintIssue{Severity: LintWarning, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) compile(path, expr string) {
+	if _, err := regexp.Compile(expr); err != nil {
+		l.errorf(path, "%v", err)
+	}
+}
+
+// compileProg compiles expr to the program used for overlap checks, or
+// reports why it does not compile.
+func (l *linter) compileProg(path, expr string) *syntax.Prog {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		l.errorf(path, "%v", err)
+		return nil
+	}
+	// MatchString is unanchored: make that explicit so the program describes
+	// every stack the regex matches.
+	prog, err := syntax.Compile(&syntax.Regexp{
+		Op:    syntax.OpConcat,
+		Flags: syntax.Perl,
+		Sub:   []*syntax.Regexp{anyString, re.Simplify(), anyString},
+	})
+	if err != nil {
+		l.errorf(path, "%v", err)
+		return nil
+	}
+	return prog
+}
+
+var anyString = &syntax.Regexp{Op: syntax.OpStar, Sub: []*syntax.Regexp{{Op: syntax.OpAnyChar}}}
+
+func (l *linter) conditions(path string, when []Condition) {
+	for i, c := range when {
+		cpath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case c.Regex != "":
+			l.compile(cpath+".regex", c.Regex)
+		case c.Version != "":
+			if _, err := version.NewConstraint(c.Version); err != nil {
+				l.errorf(cpath+".version", "%v", err)
+			}
+		}
+	}
+}
+
+type lintEntry struct {
+	index   int
+	prog    *syntax.Prog
+	content StackContent
+}
+
+// overlaps reports whether some sample can satisfy both entries: a stack
+// matched by both regexes, with labels accepted by both label checks.
+func (e lintEntry) overlaps(o lintEntry) bool {
+	return !labelsDisjoint(e.content.Labels, o.content.Labels) && progsIntersect(e.prog, o.prog)
+}
+
+func overlapsAny(e lintEntry, others []lintEntry) bool {
+	for _, o := range others {
+		if e.overlaps(o) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelsDisjoint reports whether no label set can pass both checks, i.e. some
+// key is required by both to take values from sets with nothing in common.
+func labelsDisjoint(a, b []Labels) bool {
+	for _, la := range a {
+		for _, lb := range b {
+			if la.Key != lb.Key {
+				continue
+			}
+			switch {
+			case la.Values != nil && lb.Values != nil:
+				if !anyValue(la.Values, func(v string) bool { return containsStr(lb.Values, v) }) {
+					return true
+				}
+			case la.Values != nil:
+				if rx, err := regexp.Compile(lb.ValuesRegex); err == nil && !anyValue(la.Values, rx.MatchString) {
+					return true
+				}
+			case lb.Values != nil:
+				if rx, err := regexp.Compile(la.ValuesRegex); err == nil && !anyValue(lb.Values, rx.MatchString) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func anyValue(values []string, pred func(string) bool) bool {
+	for _, v := range values {
+		if pred(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// progState is a state of the product of two regex programs: a program
+// counter in each, and whether input has started (for ^) or must have ended
+// (after $).
+type progState struct {
+	a, b           uint32
+	started, ended bool
+}
+
+// progsIntersect reports whether some string is matched by both programs, by
+// searching their product automaton. Word boundaries and multi-line anchors
+// are assumed satisfiable, so the answer errs on the side of overlapping.
+func progsIntersect(a, b *syntax.Prog) bool {
+	start := progState{a: uint32(a.Start), b: uint32(b.Start)}
+	seen := map[progState]bool{start: true}
+	queue := []progState{start}
+	push := func(s progState) {
+		if !seen[s] {
+			seen[s] = true
+			queue = append(queue, s)
+		}
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		ia, ib := &a.Inst[s.a], &b.Inst[s.b]
+		if ia.Op == syntax.InstMatch && ib.Op == syntax.InstMatch {
+			return true
+		}
+
+		// Empty-width steps, taken by one side at a time.
+		for side, inst := range []*syntax.Inst{ia, ib} {
+			for _, next := range emptySteps(inst, &s) {
+				n := s
+				if side == 0 {
+					n.a = next.pc
+				} else {
+					n.b = next.pc
+				}
+				n.ended = next.ended
+				push(n)
+			}
+		}
+
+		// Rune steps, taken together on a rune both sides accept.
+		if !s.ended && isRuneInst(ia) && isRuneInst(ib) && runesIntersect(ia, ib) {
+			push(progState{a: ia.Out, b: ib.Out, started: true})
+		}
+	}
+	return false
+}
+
+type emptyStep struct {
+	pc    uint32
+	ended bool
+}
+
+// emptySteps lists the states reachable from inst without consuming input.
+func emptySteps(inst *syntax.Inst, s *progState) []emptyStep {
+	switch inst.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		return []emptyStep{{inst.Out, s.ended}, {inst.Arg, s.ended}}
+	case syntax.InstCapture, syntax.InstNop:
+		return []emptyStep{{inst.Out, s.ended}}
+	case syntax.InstEmptyWidth:
+		op := syntax.EmptyOp(inst.Arg)
+		if op&syntax.EmptyBeginText != 0 && s.started {
+			return nil
+		}
+		return []emptyStep{{inst.Out, s.ended || op&syntax.EmptyEndText != 0}}
+	}
+	return nil
+}
+
+func isRuneInst(inst *syntax.Inst) bool {
+	switch inst.Op {
+	case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+		return true
+	}
+	return false
+}
+
+// runesIntersect reports whether some rune is accepted by both instructions.
+// If two sets of ranges intersect, the intersection starts at the low end of
+// one of the ranges, so checking every range bound (and their case folds) is
+// enough.
+func runesIntersect(a, b *syntax.Inst) bool {
+	candidates := []rune{'a', ';'}
+	for _, inst := range []*syntax.Inst{a, b} {
+		for _, r := range inst.Rune {
+			candidates = append(candidates, r)
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				candidates = append(candidates, f)
+			}
+		}
+	}
+	for _, r := range candidates {
+		if acceptsRune(a, r) && acceptsRune(b, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsRune(inst *syntax.Inst, r rune) bool {
+	switch inst.Op {
+	case syntax.InstRuneAny:
+		return true
+	case syntax.InstRuneAnyNotNL:
+		return r != '\n'
+	default:
+		return inst.MatchRune(r)
+	}
+}
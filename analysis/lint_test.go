@@ -0,0 +1,166 @@
+package analysis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lintDoc(t *testing.T, doc string) []LintIssue {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "expected_profile.json")
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	issues, err := LintFile(path, nil)
+	if err != nil {
+		t.Fatalf("LintFile: %v", err)
+	}
+	return issues
+}
+
+func hasIssue(issues []LintIssue, severity LintSeverity, path, substr string) bool {
+	for _, i := range issues {
+		if i.Severity == severity && i.Path == path && strings.Contains(i.Message, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLint_Regexes(t *testing.T) {
+	issues := lintDoc(t, `{
+  "schema_version": 2,
+  "pprof-regex": "profile(",
+  "stacks": [{
+    "profile-type": "cpu-time",
+    "pprof-regex": "cpu[",
+    "when": [{ "fact": "runtime.version", "regex": "3.(1" }],
+    "stack-content": [
+      { "regular_expression": "^main;a(", "percent": 10 },
+      { "regular_expression": "^main;b$", "percent": 10,
+        "labels": [{ "key": "thread name", "values_regex": "worker-[" }],
+        "when": [{ "fact": "runtime.version", "version": "not a constraint" }] }
+    ]
+  }]
+}`)
+	for _, path := range []string{
+		"pprof-regex",
+		"stacks[0].pprof-regex",
+		"stacks[0].when[0].regex",
+		"stacks[0].stack-content[0].regular_expression",
+		"stacks[0].stack-content[1].labels[0].values_regex",
+		"stacks[0].stack-content[1].when[0].version",
+	} {
+		if !hasIssue(issues, LintError, path, "") {
+			t.Errorf("no error reported at %s: %v", path, issues)
+		}
+	}
+}
+
+func TestLint_RedundantPprofRegex(t *testing.T) {
+	issues := lintDoc(t, `{
+  "schema_version": 2,
+  "stacks": [
+    { "profile-type": "cpu-time", "pprof-regex": "`+strings.ReplaceAll(defaultPprofRegex, `\`, `\\`)+`",
+      "stack-content": [{ "regular_expression": "a", "percent": 1 }] },
+    { "profile-type": "wall-time", "pprof-regex": "wall.*\\.pprof$",
+      "stack-content": [{ "regular_expression": "a", "percent": 1 }] }
+  ]
+}`)
+	if !hasIssue(issues, LintWarning, "stacks[0].pprof-regex", "inherited") {
+		t.Errorf("redundant pprof-regex not reported: %v", issues)
+	}
+	if hasIssue(issues, LintWarning, "stacks[1].pprof-regex", "") {
+		t.Errorf("meaningful pprof-regex reported: %v", issues)
+	}
+}
+
+func TestLint_PercentSum(t *testing.T) {
+	// Nested regexes may sum above 100; disjoint ones may not.
+	nested := lintDoc(t, `{
+  "schema_version": 2,
+  "stacks": [{ "profile-type": "cpu-time", "stack-content": [
+    { "regular_expression": "^main;", "percent": 100 },
+    { "regular_expression": "^main;a$", "percent": 60 }
+  ]}]
+}`)
+	if len(nested) != 0 {
+		t.Errorf("nested regexes reported: %v", nested)
+	}
+
+	disjoint := lintDoc(t, `{
+  "schema_version": 2,
+  "stacks": [{ "profile-type": "cpu-time", "stack-content": [
+    { "regular_expression": "^main;a$", "percent": 60 },
+    { "regular_expression": "^main;b$", "percent": 30 },
+    { "regular_expression": "^main;a$", "percent": 30,
+      "labels": [{ "key": "thread name", "values": ["worker"] }] },
+    { "regular_expression": "^main;c$", "percent": 20,
+      "when": [{ "fact": "runtime.version", "version": ">= 3.12" }] }
+  ]}]
+}`)
+	if len(disjoint) != 0 {
+		t.Errorf("90%% of disjoint samples reported: %v", disjoint)
+	}
+
+	over := lintDoc(t, `{
+  "schema_version": 2,
+  "stacks": [{ "profile-type": "cpu-time", "stack-content": [
+    { "regular_expression": "^main;a$", "percent": 60,
+      "labels": [{ "key": "thread name", "values": ["main"] }] },
+    { "regular_expression": "^main;a$", "percent": 60,
+      "labels": [{ "key": "thread name", "values": ["worker"] }] }
+  ]}]
+}`)
+	if !hasIssue(over, LintError, "stacks[0].stack-content", "120%") {
+		t.Errorf("percent sum above 100 not reported: %v", over)
+	}
+}
+
+func TestLint_ValueMatchingSumOverlap(t *testing.T) {
+	issues := lintDoc(t, `{
+  "schema_version": 2,
+  "stacks": [{ "profile-type": "alloc-space", "value_matching_sum": 1000, "error_margin": 10,
+    "stack-content": [
+      { "regular_expression": "^main;a$" },
+      { "regular_expression": ";a$" },
+      { "regular_expression": "^main;b$" }
+    ]}]
+}`)
+	if !hasIssue(issues, LintError, "stacks[0].stack-content", "entries 0 ('^main;a$') and 1 (';a$')") {
+		t.Errorf("overlap not reported: %v", issues)
+	}
+	if len(issues) != 1 {
+		t.Errorf("want exactly one issue, got %v", issues)
+	}
+}
+
+func TestProgsIntersect(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{`^main;a$`, `^main;a$`, true},
+		{`^main;a$`, `^main;b$`, false},
+		{`^main;.*;leaf$`, `;foo;`, true},
+		{`^main;.*;leaf$`, `^worker;`, false},
+		{`leaf$`, `^leaf;child$`, false},
+		{`leaf$`, `leaf;child`, true},
+		{`^[a-c]x$`, `^[c-e]x$`, true},
+		{`^[a-c]x$`, `^[d-f]x$`, false},
+		{`(?i)Leaf`, `^leaf$`, true},
+		{`^a|^b`, `^b;c`, true},
+	}
+	for _, c := range cases {
+		l := linter{}
+		pa, pb := l.compileProg("a", c.a), l.compileProg("b", c.b)
+		if pa == nil || pb == nil {
+			t.Fatalf("compile %q / %q: %v", c.a, c.b, l.issues)
+		}
+		if got := progsIntersect(pa, pb); got != c.want {
+			t.Errorf("progsIntersect(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
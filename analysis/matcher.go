@@ -0,0 +1,148 @@
+// Compiled matchers: a stack content's regex and label checks are compiled
+// once, when the expectations are loaded, and evaluated once per distinct
+// interned stack and label set of a profile type rather than once per sample,
+// so big profiles cost O(entries × distinct stacks) regex runs.
+package analysis
+
+import (
+	"fmt"
+	"iter"
+	"regexp"
+)
+
+// stackMatcher is the compiled form of a stack content's regex and labels.
+type stackMatcher struct {
+	labels []Labels
+	rx     *regexp.Regexp
+	// labelRx holds the compiled values_regex of each of labels, nil for
+	// labels checked by values.
+	labelRx []*regexp.Regexp
+	// err is the compile error, reported when the stack content is
+	// evaluated so other entries still are.
+	err error
+}
+
+func compileStackMatcher(regex string, labels []Labels) *stackMatcher {
+	m := &stackMatcher{labels: labels, labelRx: make([]*regexp.Regexp, len(labels))}
+	if m.rx, m.err = regexp.Compile(regex); m.err != nil {
+		m.err = fmt.Errorf("Error compiling regex: %v, %s", m.err, regex)
+		return m
+	}
+	for i, l := range labels {
+		if l.Values != nil {
+			continue
+		}
+		if m.labelRx[i], m.err = regexp.Compile(l.ValuesRegex); m.err != nil {
+			m.err = fmt.Errorf("Error compiling values_regex of label %s: %v", l.Key, m.err)
+			return m
+		}
+	}
+	return m
+}
+
+// matcher returns the stack content's compiled matcher, compiling it if the
+// stack content was not loaded by ReadJSONFile.
+func (s *StackContent) matcher() *stackMatcher {
+	if s.compiled == nil {
+		return compileStackMatcher(s.RegularExpression, s.Labels)
+	}
+	return s.compiled
+}
+
+// compileMatchers compiles the matchers of every stack content.
+func (data *StackTestData) compileMatchers() {
+	for i := range data.Stacks {
+		for j := range data.Stacks[i].StackContent {
+			s := &data.Stacks[i].StackContent[j]
+			s.compiled = compileStackMatcher(s.RegularExpression, s.Labels)
+		}
+	}
+}
+
+// failingLabel returns the index of the first expected label that labels do
+// not satisfy, or -1 if they satisfy all of them.
+func (m *stackMatcher) failingLabel(labels map[string][]string) int {
+	for i, expectedLabel := range m.labels {
+		values, ok := labels[expectedLabel.Key]
+		if !ok {
+			return i
+		}
+		if rx := m.labelRx[i]; rx != nil {
+			// Sample values and expected values are sorted when read from profile/json file
+			for _, v := range values {
+				if !rx.MatchString(v) {
+					return i
+				}
+			}
+			continue
+		}
+		// Right now all values should be present.
+		if len(values) != len(expectedLabel.Values) {
+			return i
+		}
+		for j, v := range expectedLabel.Values {
+			if values[j] != v {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// typedSamples are the samples of one profile type, with the interned IDs
+// matchers memoize their results by.
+type typedSamples struct {
+	all iter.Seq2[sampleRef, StackSample]
+	// stacks and labelSets are the sizes of the interned tables.
+	stacks, labelSets int
+}
+
+func (ps *ProfileSet) typedSamples(profileType string) typedSamples {
+	return typedSamples{all: ps.indexed(profileType), stacks: len(ps.stacks), labelSets: len(ps.labelSets)}
+}
+
+// values iterates over the samples without their IDs.
+func (s typedSamples) values() iter.Seq[StackSample] {
+	return func(yield func(StackSample) bool) {
+		for _, ss := range s.all {
+			if !yield(ss) {
+				return
+			}
+		}
+	}
+}
+
+// matchMemo caches a stackMatcher's results over one typedSamples.
+type matchMemo struct {
+	m *stackMatcher
+	// stacks is 0 while a stack is unknown, then 1 if the regex matches it
+	// and -1 otherwise; labels is 0 while a label set is unknown, then the
+	// failing label index + 2.
+	stacks []int8
+	labels []int32
+}
+
+func (m *stackMatcher) memo(s typedSamples) *matchMemo {
+	return &matchMemo{m: m, stacks: make([]int8, s.stacks), labels: make([]int32, s.labelSets)}
+}
+
+// match reports whether the stack of a sample matches, and if it does, the
+// index of the first label it fails, or -1.
+func (mm *matchMemo) match(ref sampleRef, ss StackSample) (matched bool, failing int) {
+	if mm.stacks[ref.stack] == 0 {
+		mm.stacks[ref.stack] = -1
+		if mm.m.rx.MatchString(ss.Stack) {
+			mm.stacks[ref.stack] = 1
+		}
+	}
+	if mm.stacks[ref.stack] < 0 {
+		return false, -1
+	}
+	if len(mm.m.labels) == 0 {
+		return true, -1
+	}
+	if mm.labels[ref.labels] == 0 {
+		mm.labels[ref.labels] = int32(mm.m.failingLabel(ss.Labels)) + 2
+	}
+	return true, int(mm.labels[ref.labels]) - 2
+}
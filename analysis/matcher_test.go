@@ -0,0 +1,81 @@
+package analysis
+
+import "testing"
+
+// samplesOf interns samples into a ProfileSet, as adapters do, and returns
+// them as the cpu profile type.
+func samplesOf(prof []StackSample) typedSamples {
+	ps := newProfileSet()
+	for _, ss := range prof {
+		ps.addSample("cpu", ps.internStack(ss.Stack), ps.internLabels(ss.Labels), ss.Val)
+	}
+	return ps.typedSamples("cpu")
+}
+
+// TestMatchMemo checks each distinct stack and label set is evaluated once,
+// however many samples share it.
+func TestMatchMemo(t *testing.T) {
+	var prof []StackSample
+	for i := range 100 {
+		prof = append(prof,
+			StackSample{Stack: "main;work", Val: 1, Labels: map[string][]string{"thread name": {"worker"}}},
+			StackSample{Stack: "main;work", Val: 1, Labels: map[string][]string{"thread name": {"main"}}},
+			StackSample{Stack: "main;idle", Val: int64(i)})
+	}
+	m := compileStackMatcher("^main;work$", []Labels{{Key: "thread name", ValuesRegex: "^work"}})
+	if m.err != nil {
+		t.Fatal(m.err)
+	}
+	samples := samplesOf(prof)
+	memo := m.memo(samples)
+	runs := 0
+	var matching, excluded int64
+	for ref, ss := range samples.all {
+		if memo.stacks[ref.stack] == 0 {
+			runs++
+		}
+		switch matched, failing := memo.match(ref, ss); {
+		case matched && failing < 0:
+			matching += ss.Val
+		case matched:
+			excluded += ss.Val
+		}
+	}
+	if runs != 2 {
+		t.Errorf("regex ran %d times, want once per distinct stack", runs)
+	}
+	if matching != 100 || excluded != 100 {
+		t.Errorf("matching = %d, excluded = %d, want 100 each", matching, excluded)
+	}
+}
+
+func TestCompileStackMatcher_Errors(t *testing.T) {
+	if m := compileStackMatcher("(", nil); m.err == nil {
+		t.Error("expected an error for an invalid regex")
+	}
+	if m := compileStackMatcher("main", []Labels{{Key: "k", ValuesRegex: "["}}); m.err == nil {
+		t.Error("expected an error for an invalid values_regex")
+	}
+}
+
+// TestReadJSONFile_CompilesMatchers checks loaded expectations come with
+// their matchers.
+func TestReadJSONFile_CompilesMatchers(t *testing.T) {
+	path := writeExpectations(t, "expected_profile.json", `{
+  "stacks": [{ "profile-type": "cpu", "stack-content": [
+    { "regular_expression": "^main;work$", "percent": 50,
+      "labels": [{ "key": "thread name", "values_regex": "^work" }] }
+  ]}]
+}`)
+	data, err := ReadJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := data.Stacks[0].StackContent[0].compiled
+	if m == nil || m.rx == nil || m.labelRx[0] == nil {
+		t.Fatalf("matcher not compiled: %+v", m)
+	}
+	if got := data.Stacks[0].StackContent[0].matcher(); got != m {
+		t.Error("matcher() should return the compiled matcher")
+	}
+}
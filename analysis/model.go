@@ -12,7 +12,15 @@
 //	otlp.go   FromOTLP  - OpenTelemetry profiles (trace/span from the LinkTable,
 //	                      other attributes from the per-sample / resource
 //	                      attribute tables) - no pprof round-trip
-//	(future)  FromJFR   - Java Flight Recorder
+//	jfr.go    FromJFR   - Java Flight Recorder (execution, allocation and
+//	                      monitor events; thread names and Datadog span
+//	                      context from the event fields)
+//	folded.go FromFolded - folded stack text (type, unit and duration
+//	                      declared in a header or sidecar file)
+//	v8.go     FromV8CPUProfile, FromV8HeapProfile - V8's DevTools
+//	                      .cpuprofile and .heapprofile JSON
+//	builder.go ProfileSetBuilder - any other format, from outside this
+//	                      package, or synthetic data
 //
 // The point of the neutral model is that a single semantic expectation in
 // expected_profile.json - e.g. label "span id" matches X - is verified
@@ -22,15 +30,21 @@
 package analysis
 
 import (
+	"bytes"
+	"fmt"
+	"iter"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strings"
 
 	"github.com/google/pprof/profile"
 )
 
 // Canonical label keys. Adapters normalize each format's native key names to
 // these so expected_profile.json can assert on one vocabulary across pprof,
-// OTLP and (later) JFR. The values intentionally match the keys Datadog pprof
+// OTLP and JFR. The values intentionally match the keys Datadog pprof
 // profilers already emit, so existing scenarios keep working unchanged.
 const (
 	LabelTraceID      = "trace id"
@@ -55,11 +69,11 @@ func canonKey(k string) string {
 		return LabelProcessID
 	case "service.name":
 		return LabelService
-	case "trace.id", "trace_id":
+	case "trace.id", "trace_id", "traceId":
 		return LabelTraceID
-	case "span.id", "span_id":
+	case "span.id", "span_id", "spanId":
 		return LabelSpanID
-	case "local_root_span_id", "local.root.span.id":
+	case "local_root_span_id", "local.root.span.id", "localRootSpanId":
 		return LabelLocalRootSID
 	default:
 		return k
@@ -70,10 +84,38 @@ func canonKey(k string) string {
 // single file may contain several profile types (e.g. an OTLP export carrying
 // alloc_space + alloc_objects, or a pprof profile with multiple sample types),
 // each with its own duration.
+//
+// Host-wide profiles hold millions of samples sharing far fewer stacks and
+// label sets, so those are interned once per file in shared tables, and each
+// profile type stores its samples as columns of table IDs and values. A pprof
+// sample carrying several sample types thus costs one stack and one label set,
+// whatever the number of types.
 type ProfileSet struct {
 	order []string // sample-type names, in first-seen order
-	typed map[string][]StackSample
+	typed map[string]*sampleColumns
 	dur   map[string]*durAgg
+	facts map[string]string // run metadata for `when` conditions, see FactsFor
+
+	stacks    []string              // interned folded stacks, by stack ID
+	stackIDs  map[string]uint32     // stack -> ID
+	labelSets []map[string][]string // interned label sets, by label-set ID
+	labelIDs  map[string]uint32     // labelSetKey -> ID
+}
+
+// sampleColumns holds the samples of one profile type: the i-th sample has
+// stack stacks[stack[i]], labels labelSets[labels[i]] and value val[i].
+type sampleColumns struct {
+	stack  []uint32
+	labels []uint32
+	val    []int64
+}
+
+func (c *sampleColumns) Len() int           { return len(c.val) }
+func (c *sampleColumns) Less(i, j int) bool { return c.val[i] > c.val[j] }
+func (c *sampleColumns) Swap(i, j int) {
+	c.stack[i], c.stack[j] = c.stack[j], c.stack[i]
+	c.labels[i], c.labels[j] = c.labels[j], c.labels[i]
+	c.val[i], c.val[j] = c.val[j], c.val[i]
 }
 
 // durAgg accumulates, per profile type, the total value and total rate
@@ -88,14 +130,84 @@ type durAgg struct {
 }
 
 func newProfileSet() *ProfileSet {
-	return &ProfileSet{typed: map[string][]StackSample{}, dur: map[string]*durAgg{}}
+	return &ProfileSet{
+		typed:    map[string]*sampleColumns{},
+		dur:      map[string]*durAgg{},
+		facts:    map[string]string{},
+		stackIDs: map[string]uint32{},
+		labelIDs: map[string]uint32{},
+	}
+}
+
+// addFact records a fact about the run (e.g. the runtime version). The first
+// value seen for a key wins: a file with several resources (one per PID) keeps
+// a single, stable value.
+func (ps *ProfileSet) addFact(k, v string) {
+	if _, ok := ps.facts[k]; !ok && k != "" {
+		ps.facts[k] = v
+	}
 }
 
-func (ps *ProfileSet) add(profileType string, s StackSample) {
-	if _, ok := ps.typed[profileType]; !ok {
+// internStack returns the ID of a folded stack, adding it to the table if
+// needed.
+func (ps *ProfileSet) internStack(stack string) uint32 {
+	if id, ok := ps.stackIDs[stack]; ok {
+		return id
+	}
+	id := uint32(len(ps.stacks))
+	ps.stacks = append(ps.stacks, stack)
+	ps.stackIDs[stack] = id
+	return id
+}
+
+// internLabels returns the ID of a label set, adding it to the table if
+// needed. Adapters must sort each key's values first, so equal sets are
+// recognized; the interned map must not be modified afterwards.
+func (ps *ProfileSet) internLabels(labels map[string][]string) uint32 {
+	key := labelSetKey(labels)
+	if id, ok := ps.labelIDs[key]; ok {
+		return id
+	}
+	if labels == nil {
+		labels = map[string][]string{}
+	}
+	id := uint32(len(ps.labelSets))
+	ps.labelSets = append(ps.labelSets, labels)
+	ps.labelIDs[key] = id
+	return id
+}
+
+// labelSetKey encodes a label set as a string, the same for equal sets.
+func labelSetKey(labels map[string][]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		for _, v := range labels[k] {
+			b.WriteByte(0)
+			b.WriteString(v)
+		}
+		b.WriteByte(1)
+	}
+	return b.String()
+}
+
+// addSample appends a sample of interned stack and label set to a profile
+// type.
+func (ps *ProfileSet) addSample(profileType string, stack, labels uint32, val int64) {
+	c := ps.typed[profileType]
+	if c == nil {
+		c = &sampleColumns{}
+		ps.typed[profileType] = c
 		ps.order = append(ps.order, profileType)
 	}
-	ps.typed[profileType] = append(ps.typed[profileType], s)
+	c.stack = append(c.stack, stack)
+	c.labels = append(c.labels, labels)
+	c.val = append(c.val, val)
 }
 
 // addProfileDuration folds one profile's (total value, duration) into the
@@ -128,28 +240,93 @@ func (ps *ProfileSet) Duration(profileType string) float64 {
 // SampleTypes returns the profile-type names present, in first-seen order.
 func (ps *ProfileSet) SampleTypes() []string { return ps.order }
 
-// Samples returns the samples for a profile type, and whether that type exists.
+// Has reports whether the profile type is present.
+func (ps *ProfileSet) Has(profileType string) bool {
+	_, ok := ps.typed[profileType]
+	return ok
+}
+
+// Len returns the number of samples of a profile type.
+func (ps *ProfileSet) Len(profileType string) int {
+	if c := ps.typed[profileType]; c != nil {
+		return c.Len()
+	}
+	return 0
+}
+
+// Total returns the sum of the sample values of a profile type.
+func (ps *ProfileSet) Total(profileType string) int64 {
+	var total int64
+	if c := ps.typed[profileType]; c != nil {
+		for _, v := range c.val {
+			total += v
+		}
+	}
+	return total
+}
+
+// All iterates over the samples of a profile type, heaviest first, without
+// copying them: samples sharing a stack or label set share its string and
+// map, which must not be modified. It yields nothing for an absent type.
+func (ps *ProfileSet) All(profileType string) iter.Seq[StackSample] {
+	return func(yield func(StackSample) bool) {
+		for _, ss := range ps.indexed(profileType) {
+			if !yield(ss) {
+				return
+			}
+		}
+	}
+}
+
+// sampleRef holds the interned stack and label-set IDs of a sample.
+type sampleRef struct {
+	stack, labels uint32
+}
+
+// indexed is All, also yielding the interned IDs of each sample.
+func (ps *ProfileSet) indexed(profileType string) iter.Seq2[sampleRef, StackSample] {
+	return func(yield func(sampleRef, StackSample) bool) {
+		c := ps.typed[profileType]
+		if c == nil {
+			return
+		}
+		for i, v := range c.val {
+			ref := sampleRef{stack: c.stack[i], labels: c.labels[i]}
+			if !yield(ref, StackSample{Stack: ps.stacks[ref.stack], Val: v, Labels: ps.labelSets[ref.labels]}) {
+				return
+			}
+		}
+	}
+}
+
+// Samples returns the samples for a profile type, and whether that type
+// exists. It allocates a slice of every sample: prefer All for large
+// profiles.
 func (ps *ProfileSet) Samples(profileType string) ([]StackSample, bool) {
-	s, ok := ps.typed[profileType]
-	return s, ok
+	if !ps.Has(profileType) {
+		return nil, false
+	}
+	return slices.Collect(ps.All(profileType)), true
 }
 
 // finalize sorts each type's samples by descending value for stable, readable
 // capture output (assertions sum, so ordering is cosmetic there).
 func (ps *ProfileSet) finalize() *ProfileSet {
-	for _, s := range ps.typed {
-		sort.SliceStable(s, func(i, j int) bool { return s[i].Val > s[j].Val })
+	for _, c := range ps.typed {
+		sort.Stable(c)
 	}
 	return ps
 }
 
-// LoadProfileSet reads a profile file (pprof or OTLP) and returns the neutral
-// ProfileSet. Format is chosen by filename suffix (.otlp/.otlp.pb -> OTLP
-// proto, .otlp.json -> OTLP JSON, else pprof) with an OTLP fallback if pprof
-// parsing fails. Ambiguous suffixes such as .pb (used by both pprof and OTLP)
-// go through the content-based fallback rather than being forced to a format.
-// The per-format parsing lives in the respective adapter file (pprof.go /
-// otlp.go).
+// LoadProfileSet reads a profile file (pprof, OTLP, JFR, folded stacks or V8)
+// and returns the neutral ProfileSet. Format is chosen by filename suffix
+// (.otlp/.otlp.pb -> OTLP proto, .otlp.json -> OTLP JSON, .jfr -> JFR,
+// .folded/.collapsed -> folded stacks, .cpuprofile/.heapprofile -> V8, else
+// pprof) with an OTLP fallback if pprof parsing fails. Ambiguous suffixes
+// such as .pb (used by both pprof and OTLP) go through the content-based
+// fallback rather than being forced to a format; JFR recordings are also
+// recognized by content. The per-format parsing lives in the respective
+// adapter file (pprof.go / otlp.go / jfr.go / folded.go / v8.go).
 func LoadProfileSet(path string) (*ProfileSet, error) {
 	content, err := readAndDecompress(path)
 	if err != nil {
@@ -162,6 +339,14 @@ func LoadProfileSet(path string) (*ProfileSet, error) {
 		return loadOTLP(content, true)
 	case isOTLPProtoName(name):
 		return loadOTLP(content, false)
+	case isJFRName(name) || bytes.HasPrefix(content, jfrMagic):
+		return FromJFR(content)
+	case isFoldedName(name):
+		return loadFolded(path, content)
+	case isV8CPUProfileName(name):
+		return FromV8CPUProfile(content)
+	case isV8HeapProfileName(name):
+		return FromV8HeapProfile(content)
 	}
 
 	// Unknown suffix: try pprof first, then OTLP (proto, then JSON).
@@ -178,3 +363,31 @@ func LoadProfileSet(path string) (*ProfileSet, error) {
 	_, perr := profile.ParseData(content)
 	return nil, perr
 }
+
+// LoadProfileDir loads the profile files under dir, those Analyze picks when
+// the expectations set no pprof-regex plus OTLP, JFR, folded stacks and V8
+// files, and merges them (see Merge).
+func LoadProfileDir(dir string) (*ProfileSet, error) {
+	files, err := getAllFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	pprofRegex := regexp.MustCompile(defaultPprofRegex)
+	var sets []*ProfileSet
+	for _, path := range files {
+		name := filepath.Base(path)
+		if !pprofRegex.MatchString(name) && !isOTLPProtoName(name) && !isOTLPJSONName(name) && !isJFRName(name) && !isFoldedName(name) &&
+			!isV8CPUProfileName(name) && !isV8HeapProfileName(name) {
+			continue
+		}
+		ps, err := LoadProfileSet(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		sets = append(sets, ps)
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("no profile files in %s", dir)
+	}
+	return Merge(sets...), nil
+}
@@ -1,6 +1,7 @@
 package analysis
 
 import (
+	"fmt"
 	"os"
 	"strings"
 	"testing"
@@ -23,6 +24,9 @@ func TestCanonKey(t *testing.T) {
 		"span_id":            LabelSpanID,
 		"local_root_span_id": LabelLocalRootSID,
 		"local.root.span.id": LabelLocalRootSID,
+		"traceId":            LabelTraceID,
+		"spanId":             LabelSpanID,
+		"localRootSpanId":    LabelLocalRootSID,
 		"some.custom.key":    "some.custom.key", // passthrough
 		"span id":            "span id",         // already canonical
 	}
@@ -225,3 +229,51 @@ func TestCaptureIgnoresVolatileOTLPKeys(t *testing.T) {
 		}
 	}
 }
+
+// TestProfileSet_Interning checks stacks and label sets are stored once per
+// file, whatever the number of samples and sample types using them, and that
+// the accessors agree with the Samples shim.
+func TestProfileSet_Interning(t *testing.T) {
+	ps := newProfileSet()
+	a := ps.internStack("main;a")
+	if ps.internStack("main;b") == a || ps.internStack("main;a") != a {
+		t.Error("equal stacks should share an ID, distinct ones not")
+	}
+	l := ps.internLabels(map[string][]string{"thread name": {"main"}, "span id": {"1", "2"}})
+	if ps.internLabels(map[string][]string{"span id": {"1", "2"}, "thread name": {"main"}}) != l {
+		t.Error("equal label sets should share an ID")
+	}
+	if ps.internLabels(map[string][]string{"span id": {"1"}, "thread name": {"main"}}) == l {
+		t.Error("distinct label sets should not share an ID")
+	}
+	empty := ps.internLabels(nil)
+	for i, v := range []int64{1, 5, 3} {
+		ps.addSample("cpu", a, l, v)
+		ps.addSample("wall", a, empty, 10*int64(i))
+	}
+	ps.finalize()
+
+	if len(ps.stacks) != 2 || len(ps.labelSets) != 3 {
+		t.Errorf("got %d stacks and %d label sets, want 2 and 3", len(ps.stacks), len(ps.labelSets))
+	}
+	if !ps.Has("cpu") || ps.Has("alloc") || ps.Len("cpu") != 3 || ps.Total("cpu") != 9 {
+		t.Errorf("cpu: has=%v len=%d total=%d", ps.Has("cpu"), ps.Len("cpu"), ps.Total("cpu"))
+	}
+	var vals []int64
+	for ss := range ps.All("cpu") {
+		if ss.Stack != "main;a" || ss.Labels["thread name"][0] != "main" {
+			t.Errorf("sample = %+v", ss)
+		}
+		vals = append(vals, ss.Val)
+	}
+	if fmt.Sprint(vals) != "[5 3 1]" {
+		t.Errorf("values = %v, want heaviest first", vals)
+	}
+	samples, ok := ps.Samples("wall")
+	if !ok || len(samples) != 3 || samples[0].Val != 20 || samples[0].Labels == nil {
+		t.Errorf("Samples(wall) = %+v", samples)
+	}
+	if _, ok := ps.Samples("alloc"); ok {
+		t.Error("Samples should report absent types")
+	}
+}
@@ -60,11 +60,21 @@ func loadOTLP(content []byte, asJSON bool) (*ProfileSet, error) {
 func FromOTLP(profiles pprofile.Profiles) *ProfileSet {
 	ps := newProfileSet()
 	d := newOTLPDict(profiles.Dictionary())
+	// Stacks are folded once per dictionary stack.
+	stackIDs := map[int32]uint32{}
 
 	rps := profiles.ResourceProfiles()
 	for i := 0; i < rps.Len(); i++ {
 		rp := rps.At(i)
 		resLabels := d.resourceLabels(rp.Resource().Attributes())
+		// Resource attributes (process.runtime.version, telemetry.sdk.version,
+		// ...) describe the run: expose them as facts under both their raw and
+		// canonical keys.
+		rp.Resource().Attributes().Range(func(k string, v pcommon.Value) bool {
+			ps.addFact(k, v.AsString())
+			ps.addFact(canonKey(k), v.AsString())
+			return true
+		})
 
 		sps := rp.ScopeProfiles()
 		for j := 0; j < sps.Len(); j++ {
@@ -79,11 +89,12 @@ func FromOTLP(profiles pprofile.Profiles) *ProfileSet {
 					smp := samples.At(si)
 					val := sampleValue(smp)
 					profileTotal += val
-					ps.add(profileType, StackSample{
-						Stack:  d.foldStack(smp.StackIndex()),
-						Val:    val,
-						Labels: d.sampleLabels(smp, resLabels),
-					})
+					stack, ok := stackIDs[smp.StackIndex()]
+					if !ok {
+						stack = ps.internStack(d.foldStack(smp.StackIndex()))
+						stackIDs[smp.StackIndex()] = stack
+					}
+					ps.addSample(profileType, stack, ps.internLabels(d.sampleLabels(smp, resLabels)), val)
 				}
 				// Fold this profile's duration into the per-type aggregate so
 				// mixed same-type durations scale to the correct rate.
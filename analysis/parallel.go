@@ -0,0 +1,231 @@
+// Parallel analysis: Analyze plans one job per (profile type, file) pair, file
+// by file, loads each file once through a ProfileCache and runs the jobs on a
+// pool of workers. Each job reports to a recorder, and the recordings are replayed to
+// the real Reporter in plan order, so output does not depend on scheduling.
+package analysis
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// ProfileCache loads profile files once, however many profile types are
+// asserted against them. It is safe for concurrent use: concurrent loads of
+// the same path wait for a single LoadProfileSet.
+type ProfileCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	once sync.Once
+	ps   *ProfileSet
+	err  error
+}
+
+// NewProfileCache returns an empty cache.
+func NewProfileCache() *ProfileCache {
+	return &ProfileCache{entries: map[string]*cacheEntry{}}
+}
+
+// Load returns the ProfileSet of path, loading it on first use. Errors are
+// cached too.
+func (c *ProfileCache) Load(path string) (*ProfileSet, error) {
+	c.mu.Lock()
+	e := c.entries[path]
+	if e == nil {
+		e = &cacheEntry{}
+		c.entries[path] = e
+	}
+	c.mu.Unlock()
+	e.once.Do(func() { e.ps, e.err = LoadProfileSet(path) })
+	return e.ps, e.err
+}
+
+// Forget drops path from the cache, releasing its ProfileSet once no caller
+// uses it anymore.
+func (c *ProfileCache) Forget(path string) {
+	c.mu.Lock()
+	delete(c.entries, path)
+	c.mu.Unlock()
+}
+
+// analysisJob is the analysis of one profile type against one file, or
+// against several merged ones (see Transform.Merge).
+type analysisJob struct {
+	typedStacks TypedStacks
+	// name is the file, or the name of the merged files (see mergedName).
+	name         string
+	files        []string
+	captureData  bool
+	allowFailure bool
+
+	rec    recorder
+	result *TypeResult
+	err    error
+	done   chan struct{}
+}
+
+// typeFiles are the files a profile type of the expectations is checked
+// against, sorted.
+type typeFiles struct {
+	typedStacks TypedStacks
+	files       []string
+}
+
+// planJobs plans the analysis of each profile type against its files, file
+// by file: every type of the first file, in the expectations' order, then
+// every type of the next one, so that a file's jobs are done, and the file
+// can leave the cache, before the next files are loaded. A merged type (see
+// Transform.Merge) runs after the jobs of the last of its files. The first
+// job of each file captures it; with allowFirstProfileFailure, each type may
+// fail on its first file.
+func planJobs(types []typeFiles, allowFirstProfileFailure bool) []*analysisJob {
+	var files []string
+	byFile := map[string][]*analysisJob{}
+	// Merged jobs, by the last of their files.
+	mergedAfter := map[string][]*analysisJob{}
+	for _, t := range types {
+		for _, file := range t.files {
+			if _, ok := byFile[file]; !ok {
+				byFile[file] = nil
+				files = append(files, file)
+			}
+		}
+		if t.typedStacks.Transform != nil && t.typedStacks.Transform.Merge {
+			// Not captured: the files are captured by the profile types
+			// that check them one by one, if any.
+			last := slices.Max(t.files)
+			mergedAfter[last] = append(mergedAfter[last], &analysisJob{typedStacks: t.typedStacks, name: mergedName(t.files), files: t.files})
+			continue
+		}
+		for i, file := range t.files {
+			byFile[file] = append(byFile[file], &analysisJob{
+				typedStacks:  t.typedStacks,
+				name:         file,
+				files:        []string{file},
+				allowFailure: allowFirstProfileFailure && i == 0,
+			})
+		}
+	}
+	sort.Strings(files)
+	var jobs []*analysisJob
+	for _, file := range files {
+		for i, j := range byFile[file] {
+			j.captureData = i == 0
+			jobs = append(jobs, j)
+		}
+		jobs = append(jobs, mergedAfter[file]...)
+	}
+	return jobs
+}
+
+// runJobs runs jobs on up to workers goroutines (GOMAXPROCS if workers <= 0)
+// and calls replay for each, in order, as soon as it and the jobs before it
+// are done. When cache is owned, files are dropped from it after their last
+// job, so only the files in use stay in memory.
+func runJobs(jobs []*analysisJob, workers int, cache *ProfileCache, owned bool, run func(r Reporter, j *analysisJob) (*TypeResult, error), replay func(j *analysisJob)) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	remaining := map[string]int{}
+	for _, j := range jobs {
+		j.done = make(chan struct{})
+		for _, file := range j.files {
+			remaining[file]++
+		}
+	}
+	var mu sync.Mutex
+	release := func(files []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, file := range files {
+			if remaining[file]--; remaining[file] == 0 && owned {
+				cache.Forget(file)
+			}
+		}
+	}
+
+	queue := make(chan *analysisJob)
+	go func() {
+		for _, j := range jobs {
+			queue <- j
+		}
+		close(queue)
+	}()
+	for range min(workers, len(jobs)) {
+		go func() {
+			for j := range queue {
+				runJob(j, run)
+				release(j.files)
+				close(j.done)
+			}
+		}()
+	}
+	for _, j := range jobs {
+		<-j.done
+		replay(j)
+	}
+}
+
+func runJob(j *analysisJob, run func(r Reporter, j *analysisJob) (*TypeResult, error)) {
+	defer func() {
+		if v := recover(); v != nil {
+			if _, ok := v.(fatalSentinel); !ok {
+				panic(v)
+			}
+		}
+	}()
+	j.result, j.err = run(&j.rec, j)
+}
+
+// recorder is an EventReporter that keeps what it is given, to be replayed
+// later to another Reporter. Like StdReporter, its Fatalf unwinds with a
+// fatalSentinel panic.
+type recorder struct {
+	entries []recorded
+}
+
+type recorded struct {
+	kind  byte // 'l'og, 'e'rror, 'f'atal or 'v' (event)
+	msg   string
+	event Event
+}
+
+func (r *recorder) Logf(format string, args ...any) {
+	r.entries = append(r.entries, recorded{kind: 'l', msg: fmt.Sprintf(format, args...)})
+}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.entries = append(r.entries, recorded{kind: 'e', msg: fmt.Sprintf(format, args...)})
+}
+
+func (r *recorder) Fatalf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	r.entries = append(r.entries, recorded{kind: 'f', msg: msg})
+	panic(fatalSentinel{msg: msg})
+}
+
+func (r *recorder) Event(e Event) {
+	r.entries = append(r.entries, recorded{kind: 'v', event: e})
+}
+
+// replay reports the recorded calls to to, in order. A recorded Fatalf is
+// replayed as a Fatalf, and may not return.
+func (r *recorder) replay(to Reporter) {
+	for _, e := range r.entries {
+		switch e.kind {
+		case 'l':
+			to.Logf("%s", e.msg)
+		case 'e':
+			to.Errorf("%s", e.msg)
+		case 'f':
+			to.Fatalf("%s", e.msg)
+		case 'v':
+			emit(to, e.event)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestProfileCache(t *testing.T) {
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;hot": 90})
+	path := filepath.Join(dir, "profile.pprof")
+
+	c := NewProfileCache()
+	first, err := c.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := c.Load(path); again != first {
+		t.Error("a cached file should not be loaded again")
+	}
+	c.Forget(path)
+	if again, _ := c.Load(path); again == first {
+		t.Error("a forgotten file should be loaded again")
+	}
+	if _, err := c.Load(filepath.Join(dir, "missing.pprof")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+// TestRunJobs_ReleasesFiles checks jobs are planned file by file, and an
+// owned cache drops each file after its last job, before the next file is
+// loaded.
+func TestRunJobs_ReleasesFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;hot": 90})
+	a, b := filepath.Join(dir, "a.pprof"), filepath.Join(dir, "b.pprof")
+	content, err := os.ReadFile(filepath.Join(dir, "profile.pprof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{a, b} {
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobs := planJobs([]typeFiles{
+		{typedStacks: TypedStacks{ProfileType: "cpu"}, files: []string{a, b}},
+		{typedStacks: TypedStacks{ProfileType: "alloc"}, files: []string{a, b}},
+		{typedStacks: TypedStacks{ProfileType: "wall", Transform: &Transform{Merge: true}}, files: []string{a}},
+	}, false)
+
+	cache := NewProfileCache()
+	cached := func() []string {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		var paths []string
+		for path := range cache.entries {
+			paths = append(paths, filepath.Base(path))
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	var got []string
+	runJobs(jobs, 1, cache, true, func(r Reporter, j *analysisJob) (*TypeResult, error) {
+		for _, file := range j.files {
+			if _, err := cache.Load(file); err != nil {
+				return nil, err
+			}
+		}
+		got = append(got, fmt.Sprintf("%s/%s capture=%v cached=%v", j.typedStacks.ProfileType, filepath.Base(j.name), j.captureData, cached()))
+		return nil, nil
+	}, func(*analysisJob) {})
+	want := []string{
+		"cpu/a.pprof capture=true cached=[a.pprof]",
+		"alloc/a.pprof capture=false cached=[a.pprof]",
+		"wall/a.pprof capture=false cached=[a.pprof]",
+		"cpu/b.pprof capture=true cached=[b.pprof]",
+		"alloc/b.pprof capture=false cached=[b.pprof]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("jobs:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if c := cached(); len(c) != 0 {
+		t.Errorf("cached after the last jobs: %v", c)
+	}
+}
+
+// TestAnalyze_Workers checks the output and results do not depend on how
+// many files are analyzed concurrently.
+func TestAnalyze_Workers(t *testing.T) {
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;hot": 90, "main;cold": 10})
+	content, err := os.ReadFile(filepath.Join(dir, "profile.pprof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.pprof", "b.pprof", "c.pprof", "d.pprof"} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "stacks": [
+    { "profile-type": "cpu", "error_margin": 5, "stack-content": [{ "regular_expression": ";hot$", "percent": 90 }] },
+    { "profile-type": "cpu", "error_margin": 5, "stack-content": [{ "regular_expression": ";cold$", "percent": 50 }] },
+    { "profile-type": "alloc", "stack-content": [{ "regular_expression": "main", "percent": 100 }] }
+  ]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	elapsed := regexp.MustCompile(`\(\d+\.\d+s\)`)
+	analyze := func(workers int) (string, *Result) {
+		var out bytes.Buffer
+		r := NewStdReporter(&out, &out)
+		r.Style = StylePlain
+		res, _ := Analyze(jsonPath, dir, Options{Reporter: r, Workers: workers})
+		return elapsed.ReplaceAllString(out.String(), "(…)"), res
+	}
+	want, wantRes := analyze(1)
+	for range 5 {
+		got, res := analyze(8)
+		if got != want {
+			t.Fatalf("output with 8 workers:\n%s\nwant, as with 1:\n%s", got, want)
+		}
+		if len(res.Files) != len(wantRes.Files) || len(res.Errors) != len(wantRes.Errors) {
+			t.Fatalf("results differ: %d files, %v", len(res.Files), res.Errors)
+		}
+		for i, f := range res.Files {
+			if f.Path != wantRes.Files[i].Path || len(f.Types) != 3 {
+				t.Errorf("file %d = %s with %d types", i, f.Path, len(f.Types))
+			}
+		}
+	}
+	if len(wantRes.Files) != 5 || len(wantRes.Errors) != 5 {
+		t.Errorf("got %d files and errors %q, want 5 files with a missing alloc type each", len(wantRes.Files), wantRes.Errors)
+	}
+}
@@ -0,0 +1,221 @@
+// Source positions: ReadJSONFile records where every value of an expectation
+// file starts, by JSON pointer, so failing assertions, schema violations and
+// Validate errors can point at the line to fix rather than at an index path.
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Position is a location in an expectation file. The zero Position is
+// unknown.
+type Position struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`   // 1-based
+	Column int    `json:"column"` // 1-based, in bytes
+}
+
+// IsValid reports whether the position is known.
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+// String formats the position as file:line:column.
+func (p Position) String() string {
+	if !p.IsValid() {
+		return p.File
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// sourcePositions maps JSON pointers (RFC 6901, e.g.
+// "/stacks/0/stack-content/1") to where their value starts.
+type sourcePositions map[string]Position
+
+// lookup returns the position of pointer, or of its closest ancestor with a
+// known position.
+func (p sourcePositions) lookup(pointer string) Position {
+	for {
+		if pos, ok := p[pointer]; ok {
+			return pos
+		}
+		i := strings.LastIndexByte(pointer, '/')
+		if i < 0 {
+			return Position{}
+		}
+		pointer = pointer[:i]
+	}
+}
+
+// schemaFieldPointer converts a gojsonschema field ("stacks.0.when", or
+// "(root)") to a JSON pointer.
+func schemaFieldPointer(field string) string {
+	if field == "(root)" || field == "" {
+		return ""
+	}
+	return "/" + strings.ReplaceAll(field, ".", "/")
+}
+
+func escapePointerToken(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// positions locates the values of an expectation document in format f. An
+// unparsable document yields the positions found before the error.
+func (f expectationFormat) positions(file string, content []byte) sourcePositions {
+	positions := sourcePositions{}
+	if f == formatYAML {
+		var doc yaml.Node
+		if err := yaml.Unmarshal(content, &doc); err == nil && len(doc.Content) > 0 {
+			yamlPositions(file, doc.Content[0], "", positions)
+		}
+		return positions
+	}
+	// Comments are blanked out in place, so offsets are those of the file.
+	s := jsonPosScanner{data: stripJSONC(content), file: file, positions: positions}
+	for i, c := range s.data {
+		if c == '\n' {
+			s.lineStarts = append(s.lineStarts, i+1)
+		}
+	}
+	s.value("")
+	return positions
+}
+
+func yamlPositions(file string, n *yaml.Node, pointer string, positions sourcePositions) {
+	positions[pointer] = Position{File: file, Line: n.Line, Column: n.Column}
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			yamlPositions(file, n.Content[i+1], pointer+"/"+escapePointerToken(n.Content[i].Value), positions)
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			yamlPositions(file, item, pointer+"/"+strconv.Itoa(i), positions)
+		}
+	}
+}
+
+// jsonPosScanner walks a JSON document recording the offset of every value.
+// It gives up quietly on malformed input, which is reported elsewhere.
+type jsonPosScanner struct {
+	data       []byte
+	i          int
+	file       string
+	lineStarts []int // offsets of the lines after the first
+	positions  sourcePositions
+}
+
+func (s *jsonPosScanner) skipSpace() {
+	for s.i < len(s.data) && strings.IndexByte(" \t\r\n", s.data[s.i]) >= 0 {
+		s.i++
+	}
+}
+
+func (s *jsonPosScanner) position(offset int) Position {
+	line := sort.SearchInts(s.lineStarts, offset+1) // lines starting at or before offset
+	start := 0
+	if line > 0 {
+		start = s.lineStarts[line-1]
+	}
+	return Position{File: s.file, Line: line + 1, Column: offset - start + 1}
+}
+
+// fail stops the scan.
+func (s *jsonPosScanner) fail() { s.i = len(s.data) }
+
+func (s *jsonPosScanner) value(pointer string) {
+	s.skipSpace()
+	if s.i >= len(s.data) {
+		return
+	}
+	s.positions[pointer] = s.position(s.i)
+	switch s.data[s.i] {
+	case '{':
+		s.i++
+		for s.i < len(s.data) {
+			s.skipSpace()
+			if s.i >= len(s.data) {
+				return
+			}
+			switch s.data[s.i] {
+			case '}':
+				s.i++
+				return
+			case ',':
+				s.i++
+			case '"':
+				key := s.string()
+				s.skipSpace()
+				if s.i >= len(s.data) || s.data[s.i] != ':' {
+					s.fail()
+					return
+				}
+				s.i++
+				s.value(pointer + "/" + escapePointerToken(key))
+			default:
+				s.fail()
+			}
+		}
+	case '[':
+		s.i++
+		for index := 0; s.i < len(s.data); {
+			s.skipSpace()
+			if s.i >= len(s.data) {
+				return
+			}
+			switch s.data[s.i] {
+			case ']':
+				s.i++
+				return
+			case ',':
+				s.i++
+			default:
+				s.value(pointer + "/" + strconv.Itoa(index))
+				index++
+			}
+		}
+	case '"':
+		s.string()
+	default:
+		for s.i < len(s.data) && strings.IndexByte(",}] \t\r\n", s.data[s.i]) < 0 {
+			s.i++
+		}
+	}
+}
+
+// string consumes a string literal and returns its value.
+func (s *jsonPosScanner) string() string {
+	start := s.i
+	for s.i++; s.i < len(s.data) && s.data[s.i] != '"'; s.i++ {
+		if s.data[s.i] == '\\' {
+			s.i++
+		}
+	}
+	s.i++
+	if s.i > len(s.data) {
+		s.i = len(s.data)
+		return ""
+	}
+	var v string
+	if err := json.Unmarshal(s.data[start:s.i], &v); err != nil {
+		return string(s.data[start+1 : s.i-1])
+	}
+	return v
+}
+
+// setPositions records in data where its stacks and stack contents are.
+func (data *StackTestData) setPositions(positions sourcePositions) {
+	for i := range data.Stacks {
+		stacks := &data.Stacks[i]
+		pointer := fmt.Sprintf("/stacks/%d", i)
+		stacks.Pos = positions.lookup(pointer)
+		for j := range stacks.StackContent {
+			stacks.StackContent[j].Pos = positions.lookup(fmt.Sprintf("%s/stack-content/%d", pointer, j))
+		}
+	}
+}
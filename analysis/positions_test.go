@@ -0,0 +1,118 @@
+package analysis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeExpectations(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadJSONFile_Positions(t *testing.T) {
+	tests := map[string]string{
+		"expected_profile.json": `{
+  "test_name": "positions",
+  "stacks": [
+    {
+      "profile-type": "cpu",
+      "stack-content": [
+        { "regular_expression": "a", "percent": 50 },
+        { "regular_expression": "b", "percent": 50 }
+      ]
+    }
+  ]
+}`,
+		"expected_profile.jsonc": `{
+  "test_name": "positions", /* a comment
+  spanning lines */
+  "stacks": [
+    {
+      "profile-type": "cpu",
+      "stack-content": [
+        { "regular_expression": "a", "percent": 50 }, // trailing comment
+        { "regular_expression": "b", "percent": 50 },
+      ]
+    }
+  ]
+}`,
+		"expected_profile.yaml": `test_name: positions
+stacks:
+  - profile-type: cpu
+    # comment
+    stack-content:
+      - { regular_expression: a, percent: 50 }
+      - regular_expression: b
+        percent: 50
+`,
+	}
+	want := map[string][3]Position{ // stacks[0], stack-content[0], stack-content[1]
+		"expected_profile.json":  {{Line: 4, Column: 5}, {Line: 7, Column: 9}, {Line: 8, Column: 9}},
+		"expected_profile.jsonc": {{Line: 5, Column: 5}, {Line: 8, Column: 9}, {Line: 9, Column: 9}},
+		"expected_profile.yaml":  {{Line: 3, Column: 5}, {Line: 6, Column: 9}, {Line: 7, Column: 9}},
+	}
+	for name, content := range tests {
+		path := writeExpectations(t, name, content)
+		data, err := ReadJSONFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := [3]Position{data.Stacks[0].Pos, data.Stacks[0].StackContent[0].Pos, data.Stacks[0].StackContent[1].Pos}
+		for i := range got {
+			w := want[name][i]
+			w.File = path
+			if got[i] != w {
+				t.Errorf("%s: position %d = %v, want %v", name, i, got[i], w)
+			}
+		}
+	}
+}
+
+func TestReadJSONFile_ErrorLines(t *testing.T) {
+	path := writeExpectations(t, "expected_profile.json", `{
+  "test_name": "positions",
+  "stacks": [
+    {
+      "profile-type": "cpu",
+      "stack-content": [
+        { "regular_expression": 5, "percent": 50 }
+      ]
+    }
+  ]
+}`)
+	_, err := ReadJSONFile(path)
+	if err == nil || !strings.Contains(err.Error(), "line 7: stacks.0.stack-content.0.regular_expression:") {
+		t.Errorf("schema error should name the line, got %v", err)
+	}
+
+	path = writeExpectations(t, "expected_profile.yaml", `test_name: positions
+stacks:
+  - profile-type: cpu
+    stack-content:
+      - regular_expression: a
+`)
+	_, err = ReadJSONFile(path)
+	if err == nil || !strings.Contains(err.Error(), "line 5: stacks[0].stack-content[0]: must have 'value' or 'percent'") {
+		t.Errorf("validation error should name the line, got %v", err)
+	}
+}
+
+func TestSourcePositionsLookup(t *testing.T) {
+	positions := sourcePositions{"": {Line: 1}, "/stacks/0": {Line: 3}}
+	if got := positions.lookup("/stacks/0/when/1"); got.Line != 3 {
+		t.Errorf("lookup should fall back to the closest ancestor, got %v", got)
+	}
+	if got := positions.lookup(schemaFieldPointer("(root)")); got.Line != 1 {
+		t.Errorf("(root) should map to the document, got %v", got)
+	}
+	if got := (sourcePositions(nil)).lookup("/stacks"); got.IsValid() {
+		t.Errorf("nil positions should be unknown, got %v", got)
+	}
+}
@@ -11,10 +11,16 @@ import (
 
 // FromPprof builds a ProfileSet from a google/pprof profile. pprof carries its
 // labels in Sample.Label / NumLabel; keys are run through canonKey (a no-op for
-// the space-form keys Datadog pprof profilers already emit).
+// the space-form keys Datadog pprof profilers already emit). Comments of the
+// form "key=value" or "key: value" become facts for `when` conditions.
 func FromPprof(prof *profile.Profile) *ProfileSet {
 	ps := newProfileSet()
 	durSecs := float64(prof.DurationNanos) / 1e9
+	for _, c := range prof.Comments {
+		if k, v, ok := parseFactComment(c); ok {
+			ps.addFact(k, v)
+		}
+	}
 
 	// Merge identical locations/samples so counts are consistent.
 	_ = prof.Aggregate(true, true, false, false, false, false)
@@ -22,10 +28,11 @@ func FromPprof(prof *profile.Profile) *ProfileSet {
 
 	typeTotals := make([]int64, len(prof.SampleType))
 	for _, sample := range prof.Sample {
-		stack := foldPprofStack(sample)
-		labels := pprofLabels(sample)
+		// Interned once, shared by the sample's values of every type.
+		stack := ps.internStack(foldPprofStack(sample))
+		labels := ps.internLabels(pprofLabels(sample))
 		for i, st := range prof.SampleType {
-			ps.add(st.Type, StackSample{Stack: stack, Val: sample.Value[i], Labels: labels})
+			ps.addSample(st.Type, stack, labels, sample.Value[i])
 			typeTotals[i] += sample.Value[i]
 		}
 	}
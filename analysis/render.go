@@ -0,0 +1,289 @@
+// Human-readable reports of a Result: a self-contained HTML page with each
+// assertion's verdict, expected vs actual bars and a flame graph per profile
+// type highlighting the stacks each regex matched, and a Markdown summary for
+// $GITHUB_STEP_SUMMARY. Used by prof-analyze and the docker scenario harness,
+// so a failing CI run can be investigated without downloading the profiles.
+package analysis
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//go:embed templates/report.html.tmpl
+var reportHTMLTemplate string
+
+var reportHTML = template.Must(template.New("report").Parse(reportHTMLTemplate))
+
+type htmlReport struct {
+	Title          string
+	Expectations   string
+	Passed         bool
+	Summary        string
+	Errors         []string
+	Types          []htmlType
+	HighlightRules []template.CSS
+}
+
+type htmlType struct {
+	ID          string
+	ProfileType string
+	File        string
+	Verdict     Verdict
+	SkipReason  string
+	Assertions  []htmlAssertion
+	Flame       template.HTML
+	LoadError   string
+}
+
+type htmlAssertion struct {
+	Index            int
+	Kind             AssertionKind
+	Regex            string
+	Labels           []Labels
+	Verdict          Verdict
+	Message          string
+	Expected, Actual string
+	HasBars          bool
+	ExpectedWidth    string
+	ActualWidth      string
+}
+
+// RenderHTML writes a self-contained HTML report of res to w. Flame graphs are
+// drawn from the profile each type was asserted on: the transformed (or
+// merged) one kept in res, or else the file named in res, which is read again;
+// a file that cannot be read only loses its flame graph.
+func RenderHTML(w io.Writer, res *Result) error {
+	report := htmlReport{
+		Title:        reportTitle(res),
+		Expectations: res.Expectations,
+		Passed:       !res.Failed(),
+		Summary:      summarize(res),
+		Errors:       res.Errors,
+	}
+
+	index := 0
+	for _, f := range res.Files {
+		load := sync.OnceValues(func() (*ProfileSet, error) { return LoadProfileSet(f.Path) })
+		for _, t := range f.Types {
+			typ := htmlType{
+				ID:          fmt.Sprintf("t%d", len(report.Types)),
+				ProfileType: t.ProfileType,
+				File:        filepath.Base(f.Path),
+				Verdict:     t.Verdict(),
+				SkipReason:  t.SkipReason,
+			}
+
+			var matchers []flameMatcher
+			var regexMatchers []flameMatcher // for value-matching-sum: every stack content
+			for _, a := range t.Assertions {
+				typ.Assertions = append(typ.Assertions, newHTMLAssertion(index, a))
+				if a.Regex != "" && a.Verdict != VerdictSkipped {
+					if sm := compileStackMatcher(a.Regex, a.Labels); sm.err == nil {
+						m := flameMatcher{index: index, stackMatcher: sm}
+						matchers = append(matchers, m)
+						regexMatchers = append(regexMatchers, m)
+					}
+				}
+				if a.Kind == AssertValueMatchingSum {
+					for _, m := range regexMatchers {
+						matchers = append(matchers, flameMatcher{index: index, stackMatcher: m.stackMatcher})
+					}
+				}
+				report.HighlightRules = append(report.HighlightRules, template.CSS(fmt.Sprintf(
+					`.flame[data-hl="%d"] g.a%d rect { opacity: 1; stroke: #0969da; stroke-width: 1; }`, index, index)))
+				index++
+			}
+
+			if !t.Skipped {
+				ps := t.profile
+				var err error
+				if ps == nil {
+					ps, err = load()
+				}
+				if err != nil {
+					typ.LoadError = err.Error()
+				} else if ps.Has(t.ProfileType) {
+					typ.Flame = template.HTML(renderFlameSVG(buildFlameTree(ps.All(t.ProfileType), matchers)))
+				}
+			}
+			report.Types = append(report.Types, typ)
+		}
+	}
+	return reportHTML.Execute(w, report)
+}
+
+func newHTMLAssertion(index int, a *AssertionResult) htmlAssertion {
+	h := htmlAssertion{
+		Index:   index,
+		Kind:    a.Kind,
+		Regex:   a.Regex,
+		Labels:  a.Labels,
+		Verdict: a.Verdict,
+		Message: a.Message(),
+	}
+	if a.Verdict == VerdictSkipped {
+		h.Expected, h.Actual = "-", "-"
+		return h
+	}
+	h.Expected, h.Actual = formatExpected(a), formatActual(a)
+
+	scale := max(a.Expected, a.Actual)
+	if a.Kind == AssertPercent || a.Kind == AssertBaselineShare {
+		scale = max(scale, 100)
+	}
+	if scale > 0 {
+		h.HasBars = true
+		h.ExpectedWidth = fmt.Sprintf("%.1f", 100*a.Expected/scale)
+		h.ActualWidth = fmt.Sprintf("%.1f", 100*a.Actual/scale)
+	}
+	return h
+}
+
+func formatExpected(a *AssertionResult) string {
+	switch a.Kind {
+	case AssertPercent:
+		return fmt.Sprintf("%.0f%% ± %d", a.Expected, a.Tolerance)
+	case AssertBaselineShare:
+		return fmt.Sprintf("%.1f%% ± %d", a.Expected, a.Tolerance)
+	case AssertBaseline:
+		return fmt.Sprintf("distance ≤ %d%%", a.Tolerance)
+	}
+	return fmt.Sprintf("%.0f ± %d%%", a.Expected, a.Tolerance)
+}
+
+func formatActual(a *AssertionResult) string {
+	switch a.Kind {
+	case AssertPercent:
+		return fmt.Sprintf("%.0f%%", a.Actual)
+	case AssertBaselineShare:
+		return fmt.Sprintf("%.1f%%", a.Actual)
+	case AssertBaseline:
+		return fmt.Sprintf("distance %.1f%%", a.Actual)
+	}
+	return fmt.Sprintf("%.0f (%.1f%% error)", a.Actual, a.Error)
+}
+
+func reportTitle(res *Result) string {
+	if res.TestName != "" {
+		return res.TestName
+	}
+	return filepath.Base(filepath.Dir(res.Expectations))
+}
+
+// summarize counts assertions by verdict, e.g. "12 assertions: 10 passed,
+// 1 failed, 1 skipped".
+func summarize(res *Result) string {
+	counts := map[Verdict]int{}
+	total := 0
+	for _, f := range res.Files {
+		for _, t := range f.Types {
+			for _, a := range t.Assertions {
+				counts[a.Verdict]++
+				total++
+			}
+		}
+	}
+	parts := []string{fmt.Sprintf("%d passed", counts[VerdictPass]), fmt.Sprintf("%d failed", counts[VerdictFail])}
+	if n := counts[VerdictAllowedFailure]; n > 0 {
+		parts = append(parts, fmt.Sprintf("%d allowed failures", n))
+	}
+	if n := counts[VerdictSkipped]; n > 0 {
+		parts = append(parts, fmt.Sprintf("%d skipped", n))
+	}
+	return fmt.Sprintf("%d assertions: %s", total, strings.Join(parts, ", "))
+}
+
+var verdictEmoji = map[Verdict]string{
+	VerdictPass:           "✅",
+	VerdictFail:           "❌",
+	VerdictAllowedFailure: "⚠️",
+	VerdictSkipped:        "⏭️",
+}
+
+// RenderMarkdown writes a GitHub-flavored Markdown summary of res to w: the
+// failing assertions, then every assertion in a collapsed section.
+func RenderMarkdown(w io.Writer, res *Result) error {
+	var b strings.Builder
+	status := verdictEmoji[VerdictPass]
+	if res.Failed() {
+		status = verdictEmoji[VerdictFail]
+	}
+	fmt.Fprintf(&b, "### %s %s\n\n%s\n\n", status, markdownEscape(reportTitle(res)), summarize(res))
+	for _, e := range res.Errors {
+		fmt.Fprintf(&b, "- %s %s\n", verdictEmoji[VerdictFail], markdownEscape(e))
+	}
+	if len(res.Errors) > 0 {
+		b.WriteString("\n")
+	}
+
+	var failing []string
+	var all []string
+	for _, f := range res.Files {
+		file := filepath.Base(f.Path)
+		for _, t := range f.Types {
+			if t.Skipped {
+				all = append(all, fmt.Sprintf("| %s | %s | `%s` | all (%s) | | |", verdictEmoji[VerdictSkipped], t.ProfileType, file, markdownEscape(t.SkipReason)))
+				continue
+			}
+			for _, a := range t.Assertions {
+				row := markdownRow(a, file)
+				all = append(all, row)
+				if a.Verdict == VerdictFail || a.Verdict == VerdictAllowedFailure {
+					failing = append(failing, row)
+				}
+			}
+		}
+	}
+
+	const header = "| | Profile type | File | Assertion | Expected | Actual |\n|---|---|---|---|---|---|\n"
+	if len(failing) > 0 {
+		b.WriteString(header + strings.Join(failing, "\n") + "\n\n")
+	}
+	if len(all) > 0 {
+		fmt.Fprintf(&b, "<details><summary>All assertions</summary>\n\n%s%s\n\n</details>\n\n", header, strings.Join(all, "\n"))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func markdownRow(a *AssertionResult, file string) string {
+	assertion := string(a.Kind)
+	if a.Regex != "" {
+		assertion = fmt.Sprintf("`%s` (%s)", markdownEscape(a.Regex), a.Kind)
+		if len(a.Labels) > 0 {
+			assertion += markdownEscape(fmt.Sprintf(" labels=%v", a.Labels))
+		}
+	}
+	expected, actual := "", ""
+	if a.Verdict == VerdictSkipped {
+		actual = markdownEscape(a.SkipReason)
+	} else {
+		expected, actual = formatExpected(a), formatActual(a)
+	}
+	return fmt.Sprintf("| %s | %s | `%s` | %s | %s | %s |", verdictEmoji[a.Verdict], a.ProfileType, file, assertion, expected, actual)
+}
+
+// markdownEscape keeps table cells intact: pipes split cells, newlines end
+// rows.
+func markdownEscape(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+// WriteHTMLReportFile writes the HTML report of res to path, creating its
+// directory if needed.
+func WriteHTMLReportFile(path string, res *Result) error {
+	return writeReportFile(path, os.O_TRUNC, func(w io.Writer) error { return RenderHTML(w, res) })
+}
+
+// AppendMarkdownReportFile appends the Markdown summary of res to path, so
+// several runs can share a file such as $GITHUB_STEP_SUMMARY.
+func AppendMarkdownReportFile(path string, res *Result) error {
+	return writeReportFile(path, os.O_APPEND, func(w io.Writer) error { return RenderMarkdown(w, res) })
+}
@@ -0,0 +1,160 @@
+package analysis
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+// writeFoldedPprof writes a cpu/count pprof with one sample per folded stack
+// (root-first, ';'-separated) to dir/profile.pprof.
+func writeFoldedPprof(t *testing.T, dir string, stacks map[string]int64) {
+	t.Helper()
+	p := &profile.Profile{SampleType: []*profile.ValueType{{Type: "cpu", Unit: "count"}}}
+	funcs := map[string]*profile.Location{}
+	for stack, v := range stacks {
+		frames := strings.Split(stack, ";")
+		var locs []*profile.Location
+		for i := len(frames) - 1; i >= 0; i-- { // leaf first
+			loc := funcs[frames[i]]
+			if loc == nil {
+				fn := &profile.Function{ID: uint64(len(funcs) + 1), Name: frames[i]}
+				loc = &profile.Location{ID: fn.ID, Line: []profile.Line{{Function: fn}}}
+				funcs[frames[i]] = loc
+				p.Function = append(p.Function, fn)
+				p.Location = append(p.Location, loc)
+			}
+			locs = append(locs, loc)
+		}
+		p.Sample = append(p.Sample, &profile.Sample{Location: locs, Value: []int64{v}})
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "profile.pprof"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// analyzeHotColdExpectations writes expectations for a 90/10 hot/cold
+// profile where the cold assertion fails, and returns their path.
+func analyzeHotColdExpectations(t *testing.T, dir string) string {
+	t.Helper()
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "test_name": "hot-cold",
+  "stacks": [{ "profile-type": "cpu", "error_margin": 5, "stack-content": [
+    { "regular_expression": ";hot$", "percent": 90 },
+    { "regular_expression": ";cold$", "percent": 50 }
+  ]}]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return jsonPath
+}
+
+func analyzeHotCold(t *testing.T) *Result {
+	t.Helper()
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;hot": 90, "main;cold": 10})
+	res, err := Analyze(analyzeHotColdExpectations(t, dir), dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// TestRenderHTML checks the report embeds a flame graph whose frames are
+// tagged with the assertions that matched them.
+func TestRenderHTML(t *testing.T) {
+	var buf bytes.Buffer
+	if err := RenderHTML(&buf, analyzeHotCold(t)); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, want := range []string{
+		"FAILED",
+		"<svg",
+		`<g class="f a0 a1"><title>all (100, 100.00%)</title>`, // the root is on every matched path
+		`<g class="f a0"><title>hot (90, 90.00%)</title>`,
+		`<g class="f a1"><title>cold (10, 10.00%)</title>`,
+		`.flame[data-hl="1"] g.a1 rect`,
+		"2 assertions: 1 passed, 1 failed",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("missing %q in HTML report", want)
+		}
+	}
+}
+
+// TestRenderHTML_Transformed checks the flame graphs of merged and focused
+// types are drawn from the profile the assertions ran on.
+func TestRenderHTML_Transformed(t *testing.T) {
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;warmup": 50, "main;handle;parse": 30, "main;handle;write": 20})
+	content, err := os.ReadFile(filepath.Join(dir, "profile.pprof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "worker2.pprof"), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "schema_version": 2,
+  "stacks": [
+    { "profile-type": "cpu", "error_margin": 1, "transform": { "merge": true },
+      "stack-content": [{ "regular_expression": ";warmup$", "percent": 50 }] },
+    { "profile-type": "cpu", "error_margin": 1, "pprof-regex": "^profile", "transform": { "focus": "handle" },
+      "stack-content": [{ "regular_expression": "^handle;parse$", "percent": 60 }] }
+  ]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Analyze(jsonPath, dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := RenderHTML(&buf, res); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, want := range []string{
+		`<g class="f a0"><title>handle (50, 100.00%)</title>`, // re-rooted at handle
+		`<g class="f a0"><title>parse (30, 60.00%)</title>`,
+		`<g class="f a1"><title>warmup (100, 50.00%)</title>`, // both files merged
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("missing %q in HTML report", want)
+		}
+	}
+	if strings.Contains(html, "no such file") {
+		t.Error("the merged profile was read again from its made-up path")
+	}
+}
+
+// TestRenderMarkdown checks failures are listed up front and every assertion
+// in the collapsed table.
+func TestRenderMarkdown(t *testing.T) {
+	var buf bytes.Buffer
+	if err := RenderMarkdown(&buf, analyzeHotCold(t)); err != nil {
+		t.Fatal(err)
+	}
+	md := buf.String()
+	if !strings.HasPrefix(md, "### ❌ hot-cold\n") {
+		t.Errorf("unexpected heading:\n%s", md)
+	}
+	failing := "| ❌ | cpu | `profile.pprof` | `;cold$` (percent) | 50% ± 5 | 10% |"
+	if strings.Count(md, failing) != 2 {
+		t.Errorf("failing row should appear in both tables:\n%s", md)
+	}
+	if strings.Count(md, "| ✅ |") != 1 {
+		t.Errorf("passing row should only appear in the collapsed table:\n%s", md)
+	}
+}
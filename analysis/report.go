@@ -0,0 +1,188 @@
+// JSON reports: a stable, versioned encoding of a Result for other tools and
+// repositories to post-process (dashboards, history, the Windows harness)
+// without scraping log lines.
+//
+// Compatibility: within a ReportVersion, fields are only ever added. Renaming
+// or removing a field, or changing its meaning, bumps ReportVersion.
+package analysis
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ReportVersion is the version of the Report format written by WriteJSONReport.
+const ReportVersion = 1
+
+// Report is the top-level object of a JSON report.
+type Report struct {
+	// Version is ReportVersion at the time the report was written.
+	Version int `json:"version"`
+	// TestName is the expectation's test_name.
+	TestName string `json:"test_name"`
+	// Expectations describes the expectation file the profiles were checked
+	// against.
+	Expectations ReportSource `json:"expectations"`
+	// Passed is false when any assertion failed or any error was recorded.
+	Passed         bool    `json:"passed"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// Errors lists problems outside any single assertion (no file matching a
+	// profile type, unreadable profile, ...).
+	Errors []string     `json:"errors,omitempty"`
+	Files  []ReportFile `json:"files"`
+}
+
+// ReportSource identifies the expectations of a report.
+type ReportSource struct {
+	Path string `json:"path"`
+	// Variables are the effective values of the declared variables, after
+	// environment and -var overrides.
+	Variables map[string]float64 `json:"variables,omitempty"`
+}
+
+// ReportFile holds the results for one profile file.
+type ReportFile struct {
+	Path   string       `json:"path"`
+	Passed bool         `json:"passed"`
+	Types  []ReportType `json:"types"`
+}
+
+// ReportType holds the results of one profile type within a file.
+type ReportType struct {
+	ProfileType string `json:"profile_type"`
+	// Verdict is the worst verdict of the type's assertions, or "skipped"
+	// when its `when` clause does not hold.
+	Verdict    Verdict `json:"verdict"`
+	SkipReason string  `json:"skip_reason,omitempty"`
+	// DurationSeconds is the profile duration values were scaled by (0 when
+	// values are absolute).
+	DurationSeconds float64 `json:"duration_seconds"`
+	// TotalValue and Samples describe the whole profile type.
+	TotalValue     int64             `json:"total_value"`
+	Samples        int               `json:"samples"`
+	AllowFailure   bool              `json:"allow_failure,omitempty"`
+	ElapsedSeconds float64           `json:"elapsed_seconds"`
+	Assertions     []ReportAssertion `json:"assertions"`
+}
+
+// ReportAssertion is one assertion. Expected and Actual are in the profile's
+// unit for "value" and "value-matching-sum" assertions, and in percent of the
+// profile for "percent" ones.
+type ReportAssertion struct {
+	// Kind is "value", "percent", "value-matching-sum", "baseline" or
+	// "baseline-share".
+	Kind AssertionKind `json:"kind"`
+	// Regex and Labels identify the stack content (absent for
+	// value-matching-sum).
+	Regex    string   `json:"regex,omitempty"`
+	Labels   []Labels `json:"labels,omitempty"`
+	Expected float64  `json:"expected"`
+	Actual   float64  `json:"actual"`
+	// TolerancePercent is the error margin; ErrorPercent the observed error
+	// (relative for values, in percentage points for percents).
+	TolerancePercent int64   `json:"tolerance_percent"`
+	ErrorPercent     float64 `json:"error_percent"`
+	MatchedSamples   int     `json:"matched_samples"`
+	// Verdict is "pass", "fail", "allowed-failure" or "skipped".
+	Verdict        Verdict `json:"verdict"`
+	SkipReason     string  `json:"skip_reason,omitempty"`
+	Message        string  `json:"message"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// Diagnosis explains a failed stack assertion (see Diagnosis).
+	Diagnosis *Diagnosis `json:"diagnosis,omitempty"`
+	// Explanation lists what the stack content matched, or what
+	// value-matching-sum added up (prof-analyze -explain).
+	Explanation *Explanation `json:"explanation,omitempty"`
+	// Source is where the assertion's entry is in the expectation file.
+	Source *Position `json:"source,omitempty"`
+}
+
+// NewReport converts res to its JSON report form.
+func NewReport(res *Result) Report {
+	report := Report{
+		Version:        ReportVersion,
+		TestName:       res.TestName,
+		Expectations:   ReportSource{Path: res.Expectations, Variables: res.Variables},
+		Passed:         !res.Failed(),
+		ElapsedSeconds: res.Elapsed.Seconds(),
+		Errors:         res.Errors,
+		Files:          []ReportFile{},
+	}
+	for _, f := range res.Files {
+		file := ReportFile{Path: f.Path, Passed: !f.Failed(), Types: []ReportType{}}
+		for _, t := range f.Types {
+			typ := ReportType{
+				ProfileType:     t.ProfileType,
+				Verdict:         t.Verdict(),
+				SkipReason:      t.SkipReason,
+				DurationSeconds: t.Duration,
+				TotalValue:      t.TotalValue,
+				Samples:         t.Samples,
+				AllowFailure:    t.AllowFailure,
+				ElapsedSeconds:  t.Elapsed.Seconds(),
+				Assertions:      []ReportAssertion{},
+			}
+			for _, a := range t.Assertions {
+				typ.Assertions = append(typ.Assertions, ReportAssertion{
+					Kind:             a.Kind,
+					Regex:            a.Regex,
+					Labels:           a.Labels,
+					Expected:         a.Expected,
+					Actual:           a.Actual,
+					TolerancePercent: a.Tolerance,
+					ErrorPercent:     a.Error,
+					MatchedSamples:   a.MatchedSamples,
+					Verdict:          a.Verdict,
+					SkipReason:       a.SkipReason,
+					Message:          a.Message(),
+					ElapsedSeconds:   a.Elapsed.Seconds(),
+					Diagnosis:        a.Diagnosis,
+					Explanation:      a.Explanation,
+					Source:           reportPosition(a.Source),
+				})
+			}
+			file.Types = append(file.Types, typ)
+		}
+		report.Files = append(report.Files, file)
+	}
+	return report
+}
+
+func reportPosition(p Position) *Position {
+	if !p.IsValid() {
+		return nil
+	}
+	return &p
+}
+
+// WriteJSONReport writes res to w as an indented JSON Report.
+func WriteJSONReport(w io.Writer, res *Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(NewReport(res))
+}
+
+// WriteJSONReportFile writes res as a JSON Report to path, creating its
+// directory if needed.
+func WriteJSONReportFile(path string, res *Result) error {
+	return writeReportFile(path, os.O_TRUNC, func(w io.Writer) error { return WriteJSONReport(w, res) })
+}
+
+// writeReportFile creates path (and its directory) with the given extra open
+// flag, os.O_TRUNC or os.O_APPEND, and renders a report into it.
+func writeReportFile(path string, mode int, render func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|mode, 0644)
+	if err != nil {
+		return err
+	}
+	if err := render(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,48 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWriteJSONReport checks the report's field names, verdict encoding and
+// that it decodes back into the documented Go types.
+func TestWriteJSONReport(t *testing.T) {
+	res := &Result{
+		TestName:     "my-scenario",
+		Expectations: "scenarios/my-scenario/expected_profile.json",
+		Variables:    map[string]float64{"THREADS": 4},
+		Elapsed:      1500 * time.Millisecond,
+		Files: []*FileResult{{
+			Path: "/tmp/data/profile.pprof",
+			Types: []*TypeResult{{ProfileType: "cpu-time", Duration: 10, TotalValue: 100, Samples: 2, Assertions: []*AssertionResult{
+				{Kind: AssertPercent, ProfileType: "cpu-time", Regex: "^main;hot$", Labels: []Labels{{Key: "thread name", Values: []string{"main"}}}, Expected: 90, Actual: 80, Tolerance: 5, Error: 10, MatchedSamples: 1, Verdict: VerdictFail},
+			}}},
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteJSONReport(&buf, res); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"version": 1`, `"verdict": "fail"`, `"profile_type": "cpu-time"`, `"passed": false`, `"THREADS": 4`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %s in report:\n%s", want, buf.String())
+		}
+	}
+
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("report does not decode: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, NewReport(res)) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", decoded, NewReport(res))
+	}
+	if a := decoded.Files[0].Types[0].Assertions[0]; a.Verdict != VerdictFail || a.Expected != 90 || a.Actual != 80 || a.Message == "" {
+		t.Errorf("assertion = %+v", a)
+	}
+}
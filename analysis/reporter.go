@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 )
 
 // Reporter is the minimal interface used by the analyzer to log progress and
@@ -20,16 +22,47 @@ type Reporter interface {
 // stack. Run() recognises it and returns normally instead of propagating.
 type fatalSentinel struct{ msg string }
 
+// ScopedReporter is a Reporter that can run part of the work in a named
+// scope with its own pass/fail status, like testing.T.Run. Analyze runs each
+// (profile type, file) pair in its own scope when its Reporter is one.
+type ScopedReporter interface {
+	Reporter
+	// Scope runs fn with the scope's Reporter and reports whether the scope
+	// passed. A Fatalf inside the scope only stops fn.
+	Scope(name string, fn func(r Reporter)) bool
+}
+
 // StdReporter is a Reporter that writes to plain io.Writers and tracks whether
 // any error/fatal was reported. It mimics testing.T semantics: Fatalf stops
 // execution (via panic), Errorf records a failure but lets execution continue.
 //
 // Use Run() to invoke analyzer code under a StdReporter — it recovers the
-// Fatalf panic so callers can inspect Failed() and exit cleanly.
+// Fatalf panic so callers can inspect Failed() and exit cleanly. The Run
+// method runs a named sub-scope, the way t.Run runs a subtest: its output is
+// indented under a header, its failures also fail the parent, and a Fatalf
+// only aborts that scope. PrintSummary lists every scope's outcome.
+//
+// StdReporter is an EventReporter: events are colored according to Style,
+// which defaults to StyleAuto (ANSI colors only on a terminal, and never when
+// NO_COLOR is set).
 type StdReporter struct {
 	Out    io.Writer
 	Err    io.Writer
+	Style  Style
 	failed bool
+
+	name   string       // scope path, "" for the top-level reporter
+	depth  int          // nesting level, for indentation
+	root   *StdReporter // top-level reporter, holding the scope results
+	scopes []ScopeResult
+}
+
+// ScopeResult is the outcome of a scope run with StdReporter.Run.
+type ScopeResult struct {
+	// Name is the scope's path, e.g. "cpu-time/profile.pprof".
+	Name    string
+	Failed  bool
+	Elapsed time.Duration
 }
 
 // NewStdReporter writes informational output to out and error output to err.
@@ -44,25 +77,108 @@ func NewStdReporter(out, err io.Writer) *StdReporter {
 	return &StdReporter{Out: out, Err: err}
 }
 
+// indent prefixes every line of msg according to the scope depth.
+func (r *StdReporter) indent(msg string) string {
+	if r.depth == 0 {
+		return msg
+	}
+	prefix := strings.Repeat("    ", r.depth)
+	return prefix + strings.ReplaceAll(msg, "\n", "\n"+prefix)
+}
+
 func (r *StdReporter) Logf(format string, args ...any) {
-	fmt.Fprintln(r.Out, fmt.Sprintf(format, args...))
+	fmt.Fprintln(r.Out, r.indent(fmt.Sprintf(format, args...)))
 }
 
 func (r *StdReporter) Errorf(format string, args ...any) {
 	r.failed = true
-	fmt.Fprintln(r.Err, fmt.Sprintf(format, args...))
+	fmt.Fprintln(r.Err, r.indent(fmt.Sprintf(format, args...)))
 }
 
 func (r *StdReporter) Fatalf(format string, args ...any) {
 	msg := fmt.Sprintf(format, args...)
 	r.failed = true
-	fmt.Fprintln(r.Err, msg)
+	fmt.Fprintln(r.Err, r.indent(msg))
 	panic(fatalSentinel{msg: msg})
 }
 
-// Failed returns true if Errorf or Fatalf was called.
+// Event renders e to Out, or Err for failures, in the reporter's Style.
+func (r *StdReporter) Event(e Event) {
+	for _, l := range eventLines(e) {
+		if l.error {
+			r.Errorf("%s", l.format(r.Style.resolve(r.Err)))
+		} else {
+			r.Logf("%s", l.format(r.Style.resolve(r.Out)))
+		}
+	}
+}
+
+// Failed returns true if Errorf or Fatalf was called, in this scope or any of
+// its sub-scopes.
 func (r *StdReporter) Failed() bool { return r.failed }
 
+// Run runs fn in a sub-scope named name and reports whether it passed. The
+// sub-scope's Fatalf stops fn only; its failures mark r as failed too.
+func (r *StdReporter) Run(name string, fn func(r *StdReporter)) bool {
+	root := r.root
+	if root == nil {
+		root = r
+	}
+	sub := &StdReporter{Out: r.Out, Err: r.Err, Style: r.Style, name: name, depth: r.depth + 1, root: root}
+	if r.name != "" {
+		sub.name = r.name + "/" + name
+	}
+	r.Logf("=== RUN   %s", sub.name)
+	start := time.Now()
+	Run(sub, func() { fn(sub) })
+	res := ScopeResult{Name: sub.name, Failed: sub.failed, Elapsed: time.Since(start)}
+
+	status := "PASS"
+	if sub.failed {
+		status = "FAIL"
+		r.failed = true
+	}
+	r.Logf("--- %s: %s (%.2fs)", status, sub.name, res.Elapsed.Seconds())
+	root.scopes = append(root.scopes, res)
+	return !sub.failed
+}
+
+// Scope implements ScopedReporter with Run.
+func (r *StdReporter) Scope(name string, fn func(r Reporter)) bool {
+	return r.Run(name, func(sub *StdReporter) { fn(sub) })
+}
+
+// Scopes returns the results of every scope run so far, nested ones
+// included, in the order they completed.
+func (r *StdReporter) Scopes() []ScopeResult {
+	if r.root != nil {
+		return r.root.Scopes()
+	}
+	return r.scopes
+}
+
+// PrintSummary writes a table of the scopes' outcomes to Out, if any scope
+// was run.
+func (r *StdReporter) PrintSummary() {
+	scopes := r.Scopes()
+	if len(scopes) == 0 {
+		return
+	}
+	failed := 0
+	var b strings.Builder
+	b.WriteString("Summary:\n")
+	for _, s := range scopes {
+		status := "PASS"
+		if s.Failed {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(&b, "  %s  %7.2fs  %s\n", status, s.Elapsed.Seconds(), s.Name)
+	}
+	fmt.Fprintf(&b, "%d scopes: %d passed, %d failed", len(scopes), len(scopes)-failed, failed)
+	fmt.Fprintln(r.Out, b.String())
+}
+
 // Run invokes fn under the given StdReporter, recovering Fatalf panics so the
 // caller can check r.Failed() and exit appropriately. Other panics propagate.
 func Run(r *StdReporter, fn func()) {
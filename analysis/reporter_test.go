@@ -0,0 +1,68 @@
+package analysis
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStdReporterRun(t *testing.T) {
+	var out bytes.Buffer
+	r := NewStdReporter(&out, &out)
+	ranAfterFatal := false
+	r.Run("cpu", func(r *StdReporter) {
+		r.Run("a.pprof", func(r *StdReporter) { r.Logf("fine") })
+		r.Run("b.pprof", func(r *StdReporter) {
+			r.Fatalf("broken\nprofile")
+			t.Error("Fatalf should stop the scope")
+		})
+		ranAfterFatal = true
+	})
+	passed := r.Run("wall", func(r *StdReporter) { r.Logf("fine") })
+
+	if !ranAfterFatal || !passed {
+		t.Error("a Fatalf should only abort its own scope")
+	}
+	if !r.Failed() {
+		t.Error("a failed scope should fail its parents")
+	}
+	var got []string
+	for _, s := range r.Scopes() {
+		got = append(got, s.Name+"="+map[bool]string{true: "FAIL", false: "PASS"}[s.Failed])
+	}
+	if want := "cpu/a.pprof=PASS cpu/b.pprof=FAIL cpu=FAIL wall=PASS"; strings.Join(got, " ") != want {
+		t.Errorf("scopes = %v, want %s", got, want)
+	}
+
+	for _, want := range []string{
+		"=== RUN   cpu\n    === RUN   cpu/a.pprof\n        fine\n    --- PASS: cpu/a.pprof (",
+		"        broken\n        profile\n    --- FAIL: cpu/b.pprof (",
+		"--- FAIL: cpu (",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in output:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	r.PrintSummary()
+	for _, want := range []string{"Summary:\n", "  FAIL ", "s  cpu/b.pprof\n", "4 scopes: 2 passed, 2 failed\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in summary:\n%s", want, out.String())
+		}
+	}
+}
+
+// TestAnalyze_Scopes checks Analyze runs each profile type and file in its own
+// scope of a ScopedReporter.
+func TestAnalyze_Scopes(t *testing.T) {
+	dir := t.TempDir()
+	writeFoldedPprof(t, dir, map[string]int64{"main;hot": 90, "main;cold": 10})
+	var out bytes.Buffer
+	r := NewStdReporter(&out, &out)
+	Run(r, func() { AnalyzeResults(r, analyzeHotColdExpectations(t, dir), dir) })
+	scopes := r.Scopes()
+	if len(scopes) != 1 || scopes[0].Name != "cpu/profile.pprof" || !scopes[0].Failed {
+		t.Errorf("unexpected scopes %+v\n%s", scopes, out.String())
+	}
+}
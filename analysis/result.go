@@ -0,0 +1,259 @@
+// Analysis results: Analyze returns a tree describing every assertion it
+// evaluated (Result → FileResult → TypeResult → AssertionResult), with the
+// expected and actual numbers and a verdict. The Reporter-based entry points
+// (AnalyzeResults, AnalyzePprofFile) print these same results as they are
+// produced, so reports, history and dashboards can be built from the tree
+// instead of scraping log lines.
+package analysis
+
+import (
+	"fmt"
+	"time"
+)
+
+// Verdict is the outcome of an assertion.
+type Verdict int
+
+const (
+	VerdictPass Verdict = iota
+	VerdictFail
+	// VerdictAllowedFailure is a failure tolerated because the profile is the
+	// first one and allow_first_profile_failure is set.
+	VerdictAllowedFailure
+	// VerdictSkipped is an assertion whose `when` clause does not hold.
+	VerdictSkipped
+)
+
+var verdictNames = [...]string{
+	VerdictPass:           "pass",
+	VerdictFail:           "fail",
+	VerdictAllowedFailure: "allowed-failure",
+	VerdictSkipped:        "skipped",
+}
+
+func (v Verdict) String() string {
+	if int(v) < len(verdictNames) {
+		return verdictNames[v]
+	}
+	return fmt.Sprintf("Verdict(%d)", int(v))
+}
+
+// MarshalText encodes the verdict by name ("pass", "fail", ...), as in JSON
+// reports.
+func (v Verdict) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+func (v *Verdict) UnmarshalText(text []byte) error {
+	for i, name := range verdictNames {
+		if name == string(text) {
+			*v = Verdict(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown verdict %q", text)
+}
+
+// AssertionKind tells which field of the expectations an assertion checks.
+type AssertionKind string
+
+const (
+	AssertValue            AssertionKind = "value"              // StackContent.Value
+	AssertPercent          AssertionKind = "percent"            // StackContent.Percent
+	AssertValueMatchingSum AssertionKind = "value-matching-sum" // TypedStacks.ValueMatchingSum
+	AssertBaseline         AssertionKind = "baseline"           // Baseline.MaxDistance
+	AssertBaselineShare    AssertionKind = "baseline-share"     // Baseline.MaxShareDelta
+)
+
+// AssertionResult is one evaluated (or skipped) assertion.
+type AssertionResult struct {
+	Kind        AssertionKind
+	ProfileType string
+	// Regex and Labels identify the stack content; both are empty for
+	// value-matching-sum and baseline. For baseline-share, Regex matches the
+	// stack exactly.
+	Regex  string
+	Labels []Labels
+	// Expected and Actual are in the profile's unit (values, scaled by the
+	// profile duration when scale_by_duration is set) or in percent of the
+	// profile for AssertPercent and AssertBaselineShare. For AssertBaseline,
+	// Actual is the distance in percent and Expected is 0.
+	Expected float64
+	Actual   float64
+	// Tolerance is the error margin in percent. Error is the observed error:
+	// relative, in percent, for values; in percentage points for percents.
+	Tolerance int64
+	Error     float64
+	// MatchedSamples is the number of samples whose stack and labels matched.
+	MatchedSamples int
+	Verdict        Verdict
+	// SkipReason says which `when` condition did not hold, for VerdictSkipped.
+	SkipReason string
+	// Elapsed is the time spent matching the profile's stacks.
+	Elapsed time.Duration
+	// Diagnosis explains a failed stack assertion: the actual stacks closest
+	// to the regex and the label checks that excluded matching stacks. It is
+	// nil for passing, skipped and value-matching-sum assertions.
+	Diagnosis *Diagnosis
+	// Explanation lists what the stack content matched, when Options.Explain
+	// is set. The assertions of one stack content share it; that of
+	// value-matching-sum lists the stacks of every stack content it added up.
+	Explanation *Explanation
+	// Source is where the stack-content entry (the stacks entry for
+	// value-matching-sum) is in the expectation file, if known.
+	Source Position
+}
+
+// Message describes the assertion the way the analyzer logs it.
+func (a *AssertionResult) Message() string {
+	var prefix string
+	switch a.Verdict {
+	case VerdictSkipped:
+		return fmt.Sprintf("Assertion skipped: stack '%s' (labels=%v) does not apply (%s)", a.Regex, a.Labels, a.SkipReason)
+	case VerdictPass:
+		prefix = "Assertion succeeded"
+	case VerdictAllowedFailure:
+		prefix = "Assertion failed (allowed)"
+	default:
+		prefix = "Assertion failed"
+	}
+	pass := a.Verdict == VerdictPass
+
+	switch a.Kind {
+	case AssertPercent:
+		if pass {
+			return fmt.Sprintf("%s: stack '%s' (labels=%v) is %d%% +/- %d%% of the profile (was %d%% with %d%% error)", prefix, a.Regex, a.Labels, int64(a.Expected), a.Tolerance, int64(a.Actual), int64(a.Error))
+		}
+		return fmt.Sprintf("%s: stack '%s' (labels=%v) should have been %d%% +/- %d%% of the profile but was %d%% with %d%% error", prefix, a.Regex, a.Labels, int64(a.Expected), a.Tolerance, int64(a.Actual), int64(a.Error))
+	case AssertBaseline:
+		if pass {
+			return fmt.Sprintf("%s: profile '%s' is within %d%% of the baseline (distance was %.1f%%)", prefix, a.ProfileType, a.Tolerance, a.Actual)
+		}
+		return fmt.Sprintf("%s: profile '%s' should have been within %d%% of the baseline but its distance was %.1f%%", prefix, a.ProfileType, a.Tolerance, a.Actual)
+	case AssertBaselineShare:
+		if a.Regex == "" {
+			return fmt.Sprintf("%s: profile '%s' has the same stacks as the baseline", prefix, a.ProfileType)
+		}
+		if pass {
+			return fmt.Sprintf("%s: stack '%s' is %.1f%% +/- %d%% of the profile as in the baseline (was %.1f%%)", prefix, a.Regex, a.Expected, a.Tolerance, a.Actual)
+		}
+		return fmt.Sprintf("%s: stack '%s' should have been %.1f%% +/- %d%% of the profile as in the baseline but was %.1f%%", prefix, a.Regex, a.Expected, a.Tolerance, a.Actual)
+	case AssertValueMatchingSum:
+		if pass {
+			return fmt.Sprintf("%s: profile '%s' has total matching sum of %1.f +/- %d%% (was %d with %.1f%% error)", prefix, a.ProfileType, a.Expected, a.Tolerance, int64(a.Actual), a.Error)
+		}
+		return fmt.Sprintf("%s: profile '%s' should have total matching sum of %1.f +/- %d%% but was %d with %.1f%% error", prefix, a.ProfileType, a.Expected, a.Tolerance, int64(a.Actual), a.Error)
+	default:
+		if pass {
+			return fmt.Sprintf("%s: stack '%s' (labels=%v) is %.1f +/- %d%% of the profile (was %d with %.1f%% error)", prefix, a.Regex, a.Labels, a.Expected, a.Tolerance, int64(a.Actual), a.Error)
+		}
+		return fmt.Sprintf("%s: stack '%s' (labels=%v) should have been %.1f +/- %d%% of the profile but was %d with %.1f%% error", prefix, a.Regex, a.Labels, a.Expected, a.Tolerance, int64(a.Actual), a.Error)
+	}
+}
+
+// TypeResult holds the assertions of one profile type against one file.
+type TypeResult struct {
+	ProfileType string
+	// Duration is the profile duration in seconds values were scaled by (0
+	// when scale_by_duration is off or the profile is a snapshot).
+	Duration float64
+	// TotalValue and Samples describe the whole profile type in the file.
+	TotalValue int64
+	Samples    int
+	// AllowFailure is set when failures are tolerated for this file (see
+	// VerdictAllowedFailure).
+	AllowFailure bool
+	// Skipped is set, with SkipReason, when the type's `when` clause does not
+	// hold; Assertions is then empty.
+	Skipped    bool
+	SkipReason string
+	Assertions []*AssertionResult
+	// Elapsed is the time spent loading the file and asserting on the type.
+	Elapsed time.Duration
+	// Source is where the stacks entry is in the expectation file, if known.
+	Source Position
+	// profile is the profile type as asserted on when a transform made it
+	// differ from the file's (or when it merges several files), for
+	// RenderHTML to draw what the assertions matched.
+	profile *ProfileSet
+}
+
+// Verdict summarizes the type's assertions: the worst of them.
+func (t *TypeResult) Verdict() Verdict {
+	if t.Skipped {
+		return VerdictSkipped
+	}
+	v := VerdictPass
+	for _, a := range t.Assertions {
+		switch a.Verdict {
+		case VerdictFail:
+			return VerdictFail
+		case VerdictAllowedFailure:
+			v = VerdictAllowedFailure
+		}
+	}
+	return v
+}
+
+// FileResult holds the results of every profile type asserted on one file.
+type FileResult struct {
+	Path  string
+	Types []*TypeResult
+}
+
+// Failed reports whether any assertion on the file failed.
+func (f *FileResult) Failed() bool {
+	for _, t := range f.Types {
+		if t.Verdict() == VerdictFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Result is the outcome of analyzing a folder of profiles against an
+// expectation file.
+type Result struct {
+	TestName     string
+	Expectations string // path of the expectation file
+	// Variables holds the effective values of the expectation's variables.
+	Variables map[string]float64
+	Files     []*FileResult
+	// Errors lists problems outside any single assertion, such as a profile
+	// type no file matched, an unreadable profile or an invalid regex.
+	Errors  []string
+	Elapsed time.Duration
+}
+
+// Failed reports whether any assertion failed or any error was recorded.
+func (r *Result) Failed() bool {
+	if len(r.Errors) > 0 {
+		return true
+	}
+	for _, f := range r.Files {
+		if f.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// file returns the FileResult for path, adding it on first use so files keep
+// the order they were first analyzed in.
+func (r *Result) file(path string) *FileResult {
+	for _, f := range r.Files {
+		if f.Path == path {
+			return f
+		}
+	}
+	f := &FileResult{Path: path}
+	r.Files = append(r.Files, f)
+	return f
+}
+
+// discardReporter drops everything; Analyze uses it when no Reporter is set.
+type discardReporter struct{}
+
+func (discardReporter) Logf(string, ...any)   {}
+func (discardReporter) Errorf(string, ...any) {}
+func (discardReporter) Fatalf(string, ...any) {}
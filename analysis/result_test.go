@@ -0,0 +1,155 @@
+package analysis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAnalyze_ResultTree checks Analyze returns every assertion with its
+// numbers and verdict, without needing a Reporter.
+func TestAnalyze_ResultTree(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "profile.pprof"), buildPprof(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "test_name": "tree",
+  "stacks": [{
+    "profile-type": "cpu",
+    "error_margin": 10,
+    "value-matching-sum": 42,
+    "stack-content": [
+      { "regular_expression": "^pprofFn$", "value": 40, "percent": 100 },
+      { "regular_expression": "^missing$", "value": 5, "error_margin": 0 },
+      { "regular_expression": "^pprofFn$", "value": 1,
+        "when": [{ "fact": "runtime_version", "equals": "never" }] }
+    ]
+  }]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Analyze(jsonPath, dir, Options{})
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+	if res.TestName != "tree" || len(res.Files) != 1 || len(res.Files[0].Types) != 1 {
+		t.Fatalf("unexpected result shape: %+v", res)
+	}
+	typ := res.Files[0].Types[0]
+	if typ.ProfileType != "cpu" || typ.TotalValue != 42 || typ.Samples != 1 {
+		t.Errorf("type totals = %+v", typ)
+	}
+
+	type want struct {
+		kind     AssertionKind
+		expected float64
+		actual   float64
+		matched  int
+		verdict  Verdict
+	}
+	wants := []want{
+		{AssertValue, 40, 42, 1, VerdictPass},
+		{AssertPercent, 100, 100, 1, VerdictPass},
+		{AssertValue, 5, 0, 0, VerdictFail},
+		{AssertValue, 0, 0, 0, VerdictSkipped},
+		{AssertValueMatchingSum, 42, 42, 1, VerdictPass},
+	}
+	if len(typ.Assertions) != len(wants) {
+		t.Fatalf("got %d assertions, want %d", len(typ.Assertions), len(wants))
+	}
+	for i, w := range wants {
+		a := typ.Assertions[i]
+		if a.Kind != w.kind || a.Expected != w.expected || a.Actual != w.actual || a.MatchedSamples != w.matched || a.Verdict != w.verdict {
+			t.Errorf("assertion %d = %+v, want %+v", i, a, w)
+		}
+	}
+	if a := typ.Assertions[0]; a.Tolerance != 10 || a.Error != 5 {
+		t.Errorf("tolerance/error = %d/%v, want 10/5", a.Tolerance, a.Error)
+	}
+	if !strings.Contains(typ.Assertions[3].SkipReason, "runtime_version") {
+		t.Errorf("skip reason = %q", typ.Assertions[3].SkipReason)
+	}
+
+	if typ.Verdict() != VerdictFail || !res.Failed() {
+		t.Error("a failing assertion must fail the type and the result")
+	}
+}
+
+// TestAnalyze_Errors checks unrecoverable problems are returned as errors,
+// and profile types no file matches are recorded on the result.
+func TestAnalyze_Errors(t *testing.T) {
+	if _, err := Analyze("/does/not/exist.json", t.TempDir(), Options{}); err == nil {
+		t.Error("expected an error for missing expectations")
+	}
+
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "stacks": [{ "profile-type": "cpu", "pprof-regex": "nothing-matches",
+    "stack-content": [{ "regular_expression": "a", "percent": 1 }] }]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Analyze(jsonPath, dir, Options{})
+	if err != nil {
+		t.Fatalf("Analyze: %v", err)
+	}
+	if len(res.Errors) != 1 || !strings.Contains(res.Errors[0], "No matching files") || !res.Failed() {
+		t.Errorf("Errors = %v", res.Errors)
+	}
+}
+
+// TestAnalyze_ContinuesAfterErrors checks a missing sample type and an
+// invalid regex are each recorded and returned, while the other assertions
+// still run.
+func TestAnalyze_ContinuesAfterErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "profile.pprof"), buildPprof(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(jsonPath, []byte(`{
+  "stacks": [
+    { "profile-type": "alloc",
+      "stack-content": [{ "regular_expression": "^pprofFn$", "percent": 100 }] },
+    { "profile-type": "cpu", "error_margin": 10,
+      "stack-content": [
+        { "regular_expression": "(", "percent": 100 },
+        { "regular_expression": "^pprofFn$", "percent": 100 }
+      ] }
+  ]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Analyze(jsonPath, dir, Options{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(res.Errors) != 2 || !strings.Contains(res.Errors[0], "alloc") || !strings.Contains(res.Errors[1], "cpu") {
+		t.Errorf("Errors = %q", res.Errors)
+	}
+	if n := len(splitErrors(err)); n != 2 {
+		t.Errorf("returned %d errors, want 2: %v", n, err)
+	}
+	var passed int
+	for _, f := range res.Files {
+		for _, typ := range f.Types {
+			for _, a := range typ.Assertions {
+				if a.Verdict == VerdictPass {
+					passed++
+				}
+			}
+		}
+	}
+	if passed != 1 {
+		t.Errorf("%d assertions passed, want the valid cpu one", passed)
+	}
+	if !res.Failed() {
+		t.Error("errors must fail the result")
+	}
+}
@@ -0,0 +1,607 @@
+// Expectation schema versions and migrations.
+//
+// Files declare the schema they are written against with `schema_version`
+// (absent means 1). Version 1 is the original, lax schema: unknown properties
+// are ignored, so a typo silently does nothing. Version 2 is strict
+// (additionalProperties: false everywhere, validated labels and conditions),
+// spells the profile-type error margin `error_margin` like the stack-content
+// one and `value_matching_sum` with an underscore too, and has `note` fields
+// where version 1 files used ad-hoc comment keys.
+//
+// Older files keep loading: they are validated against their own schema and
+// migrated in memory. `prof-analyze migrate` rewrites them to the latest
+// version, reporting what the strict schema rejects.
+package analysis
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentSchemaVersion is the schema_version written by captures and by
+// MigrateFile.
+const CurrentSchemaVersion = 2
+
+//go:embed schema/expected_profile.v2.schema.json
+var expectedProfileSchemaV2 string
+
+// ExpectedProfileSchema returns the JSON Schema of the current expectation
+// format, for editors to provide validation and autocompletion.
+func ExpectedProfileSchema() string { return expectedProfileSchemaV2 }
+
+// schemaFor returns the JSON Schema a document of the given version is
+// validated against.
+func schemaFor(version int) (string, error) {
+	switch version {
+	case 1:
+		return expectedProfileSchema, nil
+	case 2:
+		return expectedProfileSchemaV2, nil
+	default:
+		return "", fmt.Errorf("unsupported schema_version %d (latest is %d)", version, CurrentSchemaVersion)
+	}
+}
+
+// schemaVersionOf reads the schema_version of a JSON document (1 if absent).
+func schemaVersionOf(doc []byte) (int, error) {
+	var header struct {
+		SchemaVersion *json.Number `json:"schema_version"`
+	}
+	if err := json.Unmarshal(doc, &header); err != nil || header.SchemaVersion == nil {
+		// Non-object documents are reported by schema validation.
+		return 1, nil
+	}
+	v, err := strconv.Atoi(header.SchemaVersion.String())
+	if err != nil {
+		return 0, fmt.Errorf("schema_version must be an integer, got %s", header.SchemaVersion)
+	}
+	return v, nil
+}
+
+// validateSchema validates a JSON document against the given schema and
+// returns one message per violation, prefixed with its line when positions
+// locate it.
+func validateSchema(schema string, doc []byte, positions sourcePositions) ([]string, error) {
+	result, err := gojsonschema.Validate(gojsonschema.NewStringLoader(schema), gojsonschema.NewBytesLoader(doc))
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, desc := range result.Errors() {
+		msg := desc.String()
+		if pos := positions.lookup(schemaFieldPointer(desc.Field())); pos.IsValid() {
+			msg = fmt.Sprintf("line %d: %s", pos.Line, msg)
+		}
+		errs = append(errs, msg)
+	}
+	return errs, nil
+}
+
+// unknownKeys lists the properties of doc that schema does not define, e.g.
+// "line 12: stacks.0.stack-content.3.regular_expression2" when positions
+// locate them.
+func unknownKeys(schema string, doc []byte, positions sourcePositions) ([]string, error) {
+	result, err := gojsonschema.Validate(gojsonschema.NewStringLoader(schema), gojsonschema.NewBytesLoader(doc))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	seen := map[string]bool{}
+	for _, desc := range result.Errors() {
+		if desc.Type() != "additional_property_not_allowed" {
+			continue
+		}
+		field := fmt.Sprint(desc.Details()["property"])
+		if parent := desc.Field(); parent != "(root)" {
+			field = parent + "." + field
+		}
+		if seen[field] {
+			continue
+		}
+		seen[field] = true
+		if pos := positions.lookup(schemaFieldPointer(field)); pos.IsValid() {
+			field = fmt.Sprintf("line %d: %s", pos.Line, field)
+		}
+		keys = append(keys, field)
+	}
+	return keys, nil
+}
+
+// migrations[v] rewrites a version v document, in place, to version v+1.
+var migrations = map[int]func(root *yaml.Node) error{
+	1: migrateV1ToV2,
+}
+
+// migrateNode brings the document rooted at root from version `from` to
+// CurrentSchemaVersion.
+func migrateNode(root *yaml.Node, from int) error {
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected an object at the top level")
+	}
+	for v := from; v < CurrentSchemaVersion; v++ {
+		if err := migrations[v](root); err != nil {
+			return fmt.Errorf("migrating from schema_version %d: %v", v, err)
+		}
+	}
+	setMember(root, "schema_version", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(CurrentSchemaVersion)})
+	return nil
+}
+
+// migrateV1ToV2 renames the profile-type "error-margin" and
+// "value-matching-sum" to "error_margin" and "value_matching_sum", moves the
+// "comment"/"_comment" keys used as notes to "note", and drops the empty
+// values_regex (and other null members) older captures wrote.
+func migrateV1ToV2(root *yaml.Node) error {
+	dropNullMembers(root)
+	for i, stack := range sequenceItems(member(root, "stacks")) {
+		if err := renameMember(stack, "error-margin", "error_margin"); err != nil {
+			return fmt.Errorf("stacks[%d]: %v", i, err)
+		}
+		if err := renameMember(stack, "value-matching-sum", "value_matching_sum"); err != nil {
+			return fmt.Errorf("stacks[%d]: %v", i, err)
+		}
+		if err := moveCommentToNote(stack); err != nil {
+			return fmt.Errorf("stacks[%d]: %v", i, err)
+		}
+		for j, content := range sequenceItems(member(stack, "stack-content")) {
+			if err := moveCommentToNote(content); err != nil {
+				return fmt.Errorf("stacks[%d].stack-content[%d]: %v", i, j, err)
+			}
+			for _, label := range sequenceItems(member(content, "labels")) {
+				if re := member(label, "values_regex"); re != nil && re.Value == "" && member(label, "values") != nil {
+					deleteMember(label, "values_regex")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func moveCommentToNote(obj *yaml.Node) error {
+	for _, key := range []string{"comment", "_comment"} {
+		if err := renameMember(obj, key, "note"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- ordered document helpers -------------------------------------------------
+//
+// Migrations work on yaml.Node trees rather than maps so that rewritten files
+// keep their key order (and, for YAML, their comments).
+
+func member(obj *yaml.Node, key string) *yaml.Node {
+	if obj == nil || obj.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(obj.Content); i += 2 {
+		if obj.Content[i].Value == key {
+			return obj.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func sequenceItems(seq *yaml.Node) []*yaml.Node {
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return seq.Content
+}
+
+// setMember replaces the value of key, or inserts key first (after a leading
+// "$schema") so that schema_version reads as a header.
+func setMember(obj *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(obj.Content); i += 2 {
+		if obj.Content[i].Value == key {
+			obj.Content[i+1] = value
+			return
+		}
+	}
+	at := 0
+	if len(obj.Content) >= 2 && obj.Content[0].Value == "$schema" {
+		at = 2
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Value: key}
+	obj.Content = append(obj.Content[:at], append([]*yaml.Node{keyNode, value}, obj.Content[at:]...)...)
+}
+
+func renameMember(obj *yaml.Node, from, to string) error {
+	if obj == nil || obj.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(obj.Content); i += 2 {
+		if obj.Content[i].Value == from {
+			if member(obj, to) != nil {
+				return fmt.Errorf("both %q and %q are set", from, to)
+			}
+			obj.Content[i].Value = to
+		}
+	}
+	return nil
+}
+
+func deleteMember(obj *yaml.Node, key string) {
+	for i := 0; i+1 < len(obj.Content); i += 2 {
+		if obj.Content[i].Value == key {
+			obj.Content = append(obj.Content[:i], obj.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+func dropNullMembers(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode {
+		kept := n.Content[:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if v := n.Content[i+1]; v.Kind == yaml.ScalarNode && v.ShortTag() == "!!null" {
+				continue
+			}
+			kept = append(kept, n.Content[i], n.Content[i+1])
+		}
+		n.Content = kept
+	}
+	for _, c := range n.Content {
+		dropNullMembers(c)
+	}
+}
+
+// nodeToJSON encodes a yaml.Node tree as JSON, keeping key order.
+func nodeToJSON(n *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeNodeJSON(&buf, n); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeNodeJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeNodeJSON(buf, n.Content[0])
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeNodeJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, c := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeNodeJSON(buf, c); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!int", "!!float", "!!bool":
+			buf.WriteString(n.Value)
+		case "!!null":
+			buf.WriteString("null")
+		default:
+			s, _ := json.Marshal(n.Value)
+			buf.Write(s)
+		}
+	default:
+		return fmt.Errorf("unsupported YAML construct at line %d (anchors and aliases are not supported)", n.Line)
+	}
+	return nil
+}
+
+// --- comments of JSON-with-comments files -------------------------------------
+//
+// Migrating a JSONC file keeps its comments, as for YAML: each is attached to
+// the member or item it precedes (HeadComment) or, when it ends the line
+// that member or item starts on, to that member or item (LineComment), and
+// written back next to it.
+
+// jsoncComment is a // or /* */ comment of a JSONC document.
+type jsoncComment struct {
+	text      string
+	start     Position // Line and Column only
+	endLine   int
+	afterCode bool // something precedes it on its line
+}
+
+// jsoncComments lists the comments of content, in order.
+func jsoncComments(content []byte) []jsoncComment {
+	stripped := stripJSONC(content)
+	var comments []jsoncComment
+	line, lineStart, codeOnLine := 1, 0, false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '\n':
+			line, lineStart, codeOnLine = line+1, i+1, false
+		case stripped[i] == c:
+			codeOnLine = codeOnLine || (c != ' ' && c != '\t' && c != '\r')
+		case c == '/': // not a trailing comma: a comment
+			end := len(content)
+			if content[i+1] == '/' {
+				if k := bytes.IndexByte(content[i:], '\n'); k >= 0 {
+					end = i + k
+				}
+			} else if k := bytes.Index(content[i+2:], []byte("*/")); k >= 0 {
+				end = i + 2 + k + 2
+			}
+			text := string(content[i:end])
+			comments = append(comments, jsoncComment{
+				text:      strings.TrimRight(text, " \t\r"),
+				start:     Position{Line: line, Column: i - lineStart + 1},
+				endLine:   line + strings.Count(text, "\n"),
+				afterCode: codeOnLine,
+			})
+			if k := strings.LastIndexByte(text, '\n'); k >= 0 {
+				line, lineStart, codeOnLine = line+strings.Count(text, "\n"), i+k+1, false
+			}
+			i = end - 1
+		}
+	}
+	return comments
+}
+
+// jsoncToNode parses a JSON-with-comments document, keeping its comments on
+// the nodes as described above.
+func jsoncToNode(content []byte) (*yaml.Node, error) {
+	root, err := jsonToYAMLNode(json.NewDecoder(bytes.NewReader(stripJSONC(content))))
+	if err != nil {
+		return nil, err
+	}
+	comments := jsoncComments(content)
+	if len(comments) == 0 {
+		return root, nil
+	}
+
+	// Anchors are the nodes comments attach to, in document order: the root,
+	// then the key of each member and each item.
+	type anchor struct {
+		node *yaml.Node
+		pos  Position
+	}
+	positions := formatJSON.positions("", content)
+	anchors := []anchor{{root, positions[""]}}
+	var walk func(n *yaml.Node, pointer string)
+	walk = func(n *yaml.Node, pointer string) {
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				p := pointer + "/" + escapePointerToken(n.Content[i].Value)
+				anchors = append(anchors, anchor{n.Content[i], positions[p]})
+				walk(n.Content[i+1], p)
+			}
+		case yaml.SequenceNode:
+			for i, item := range n.Content {
+				p := pointer + "/" + strconv.Itoa(i)
+				anchors = append(anchors, anchor{item, positions[p]})
+				walk(item, p)
+			}
+		}
+	}
+	walk(root, "")
+
+	for _, c := range comments {
+		if c.afterCode {
+			// The outermost member or item starting on the comment's line.
+			var first *anchor
+			for i, a := range anchors {
+				if a.pos.Line == c.start.Line && a.pos.Column < c.start.Column && (first == nil || a.pos.Column < first.pos.Column) {
+					first = &anchors[i]
+				}
+			}
+			if first != nil {
+				first.node.LineComment = joinComment(first.node.LineComment, c.text)
+				continue
+			}
+		}
+		var next *yaml.Node
+		for _, a := range anchors {
+			if a.pos.Line > c.endLine {
+				next = a.node
+				break
+			}
+		}
+		if next == nil {
+			root.FootComment = joinComment(root.FootComment, c.text)
+		} else {
+			next.HeadComment = joinComment(next.HeadComment, c.text)
+		}
+	}
+	return root, nil
+}
+
+func joinComment(comments, c string) string {
+	if comments == "" {
+		return c
+	}
+	return comments + "\n" + c
+}
+
+// writeNodeJSONC encodes a document parsed by jsoncToNode as JSON indented
+// by two spaces, as json.Indent would, with its comments.
+func writeNodeJSONC(buf *bytes.Buffer, root *yaml.Node) {
+	writeComments(buf, root.HeadComment, "")
+	if !writeValueJSONC(buf, root, "", root.LineComment) && root.LineComment != "" {
+		buf.WriteString(" " + root.LineComment)
+	}
+	buf.WriteByte('\n')
+	writeComments(buf, root.FootComment, "")
+}
+
+// writeValueJSONC writes n at the given indentation. A non-empty object or
+// array takes lineComment after its opening bracket, where it was written,
+// and reports so; other values leave it to the caller, to follow the comma.
+func writeValueJSONC(buf *bytes.Buffer, n *yaml.Node, indent, lineComment string) bool {
+	if (n.Kind != yaml.MappingNode && n.Kind != yaml.SequenceNode) || len(n.Content) == 0 {
+		// Only scalars and empty containers get here, which writeNodeJSON
+		// encodes without failing.
+		_ = writeNodeJSON(buf, n)
+		return false
+	}
+	open, close, step := "[", "]", 1
+	if n.Kind == yaml.MappingNode {
+		open, close, step = "{", "}", 2
+	}
+	buf.WriteString(open)
+	if lineComment != "" {
+		buf.WriteString(" " + lineComment)
+	}
+	buf.WriteByte('\n')
+	inner := indent + "  "
+	for i := 0; i < len(n.Content); i += step {
+		// Comments are on the key of members, on the value of items.
+		anchor, value := n.Content[i], n.Content[i+step-1]
+		writeComments(buf, anchor.HeadComment, inner)
+		buf.WriteString(inner)
+		if step == 2 {
+			key, _ := json.Marshal(anchor.Value)
+			buf.Write(key)
+			buf.WriteString(": ")
+		}
+		taken := writeValueJSONC(buf, value, inner, anchor.LineComment)
+		if i+step < len(n.Content) {
+			buf.WriteByte(',')
+		}
+		if !taken && anchor.LineComment != "" {
+			buf.WriteString(" " + anchor.LineComment)
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(indent + close)
+	return true
+}
+
+// writeComments writes each line of comments on its own line.
+func writeComments(buf *bytes.Buffer, comments, indent string) {
+	if comments == "" {
+		return
+	}
+	for _, line := range strings.Split(comments, "\n") {
+		buf.WriteString(indent + strings.TrimSpace(line) + "\n")
+	}
+}
+
+// migrateJSON migrates a JSON document of the given version to the current
+// one. Used when loading, so older files need not be rewritten.
+func migrateJSON(doc []byte, from int) ([]byte, error) {
+	if from == CurrentSchemaVersion {
+		return doc, nil
+	}
+	root, err := jsonToYAMLNode(json.NewDecoder(bytes.NewReader(doc)))
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateNode(root, from); err != nil {
+		return nil, err
+	}
+	return nodeToJSON(root)
+}
+
+// MigrateFile rewrites the expectation file at path to CurrentSchemaVersion, in
+// its own format. It returns whether the file needed migrating; with dryRun the
+// file is only checked. The migrated document must pass the strict current
+// schema: unknown (e.g. misspelled) properties are listed with their line
+// instead of being carried over or dropped, and nothing is written until they
+// are fixed. Comments are kept, in YAML and JSON-with-comments files alike.
+func MigrateFile(path string, dryRun bool) (bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	format := formatOf(path)
+	positions := format.positions(path, content)
+
+	var doc yaml.Node
+	root := &doc
+	if format == formatYAML {
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			return false, fmt.Errorf("invalid %s syntax in %s: %v", format.name(path), path, err)
+		}
+		if len(doc.Content) == 0 {
+			return false, fmt.Errorf("%s is empty", path)
+		}
+		root = doc.Content[0]
+	} else {
+		if root, err = jsoncToNode(content); err != nil {
+			return false, fmt.Errorf("invalid %s syntax in %s: %v", format.name(path), path, err)
+		}
+	}
+
+	from := 1
+	if v := member(root, "schema_version"); v != nil {
+		if from, err = strconv.Atoi(v.Value); err != nil {
+			return false, fmt.Errorf("%s: schema_version must be an integer, got %q", path, v.Value)
+		}
+	}
+	if _, err := schemaFor(from); err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := migrateNode(root, from); err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+
+	jsonData, err := nodeToJSON(root)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+	unknown, err := unknownKeys(expectedProfileSchemaV2, jsonData, positions)
+	if err != nil {
+		return false, fmt.Errorf("schema validation error for %s: %v", path, err)
+	}
+	if len(unknown) > 0 {
+		return false, fmt.Errorf("%s has keys schema_version %d does not define, fix or remove them:\n  - %s", path, CurrentSchemaVersion, strings.Join(unknown, "\n  - "))
+	}
+	errs, err := validateSchema(expectedProfileSchemaV2, jsonData, positions)
+	if err != nil {
+		return false, fmt.Errorf("schema validation error for %s: %v", path, err)
+	}
+	if len(errs) > 0 {
+		return false, fmt.Errorf("%s does not satisfy schema_version %d:\n  - %s", path, CurrentSchemaVersion, strings.Join(errs, "\n  - "))
+	}
+	if from == CurrentSchemaVersion || dryRun {
+		return from != CurrentSchemaVersion, nil
+	}
+
+	var out []byte
+	if format == formatYAML {
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return false, err
+		}
+		if err := enc.Close(); err != nil {
+			return false, err
+		}
+		out = buf.Bytes()
+	} else {
+		var buf bytes.Buffer
+		writeNodeJSONC(&buf, root)
+		out = buf.Bytes()
+	}
+	return true, os.WriteFile(path, out, 0644)
+}
@@ -0,0 +1,255 @@
+package analysis
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const v1Expectation = `{
+  "test_name": "migrate-me",
+  "stacks": [
+    {
+      "profile-type": "cpu-time",
+      "error-margin": 7,
+      "value-matching-sum": 100,
+      "stack-content": [
+        {
+          "_comment": "a runs twice as long as b",
+          "regular_expression": "^main;a$",
+          "percent": 66,
+          "labels": [{ "key": "thread name", "values": ["main"], "values_regex": "" }]
+        }
+      ]
+    }
+  ]
+}`
+
+// TestLoadV1MigratesInMemory checks a version 1 file still loads, with the
+// renamed error margin, value-matching-sum and comment landing in their
+// version 2 fields.
+func TestLoadV1MigratesInMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expected_profile.json")
+	if err := os.WriteFile(path, []byte(v1Expectation), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := ReadJSONFile(path)
+	if err != nil {
+		t.Fatalf("ReadJSONFile: %v", err)
+	}
+	if d.SchemaVersion != CurrentSchemaVersion {
+		t.Errorf("SchemaVersion = %d, want %d", d.SchemaVersion, CurrentSchemaVersion)
+	}
+	if d.Stacks[0].ErrorMargin != 7 {
+		t.Errorf("error-margin not migrated: %d", d.Stacks[0].ErrorMargin)
+	}
+	if sum, ok := d.Stacks[0].ValueMatchingSum.Value(); !ok || sum != 100 {
+		t.Errorf("value-matching-sum not migrated: %v", d.Stacks[0].ValueMatchingSum)
+	}
+	if d.Stacks[0].StackContent[0].Note != "a runs twice as long as b" {
+		t.Errorf("_comment not migrated to note: %q", d.Stacks[0].StackContent[0].Note)
+	}
+}
+
+// TestStrictSchemaRejectsTypos checks unknown properties and malformed labels
+// are errors in version 2 files.
+func TestStrictSchemaRejectsTypos(t *testing.T) {
+	cases := map[string]string{
+		"unknown property":   `{"schema_version": 2, "stacks": [{"profile-type": "cpu", "stack-content": [{"regular_expression": "a", "percent": 1, "error-margin": 5}]}]}`,
+		"label without key":  `{"schema_version": 2, "stacks": [{"profile-type": "cpu", "stack-content": [{"regular_expression": "a", "percent": 1, "labels": [{"values": ["x"]}]}]}]}`,
+		"label with both":    `{"schema_version": 2, "stacks": [{"profile-type": "cpu", "stack-content": [{"regular_expression": "a", "percent": 1, "labels": [{"key": "k", "values": ["x"], "values_regex": "x"}]}]}]}`,
+		"unsupported future": `{"schema_version": 99, "stacks": []}`,
+		"no stack content":   `{"schema_version": 2, "stacks": [{"profile-type": "cpu"}]}`,
+		"baseline no file":   `{"schema_version": 2, "stacks": [{"profile-type": "cpu", "baseline": {"max_distance": 5}}]}`,
+	}
+	dir := t.TempDir()
+	for name, doc := range cases {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "_")+".json")
+		if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadJSONFile(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestMigrateFile rewrites a version 1 JSON file and checks the result is a
+// valid version 2 file, then that a second migration is a no-op.
+func TestMigrateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expected_profile.json")
+	if err := os.WriteFile(path, []byte(v1Expectation), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := MigrateFile(path, true); err != nil || !changed {
+		t.Fatalf("dry run: changed=%v err=%v", changed, err)
+	}
+	if raw, _ := os.ReadFile(path); string(raw) != v1Expectation {
+		t.Fatal("dry run modified the file")
+	}
+
+	if changed, err := MigrateFile(path, false); err != nil || !changed {
+		t.Fatalf("migrate: changed=%v err=%v", changed, err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatalf("migrated file is not JSON: %v\n%s", err, raw)
+	}
+	if doc["schema_version"] != float64(CurrentSchemaVersion) {
+		t.Errorf("schema_version = %v\n%s", doc["schema_version"], raw)
+	}
+	// Key order is preserved: schema_version first, then the original keys.
+	if !strings.HasPrefix(strings.TrimSpace(string(raw)), "{\n  \"schema_version\": 2,\n  \"test_name\"") {
+		t.Errorf("unexpected layout:\n%s", raw)
+	}
+	if strings.Contains(string(raw), "error-margin") || strings.Contains(string(raw), "value-matching-sum") || strings.Contains(string(raw), "values_regex") {
+		t.Errorf("version 1 leftovers in migrated file:\n%s", raw)
+	}
+
+	if changed, err := MigrateFile(path, false); err != nil || changed {
+		t.Errorf("second migration: changed=%v err=%v", changed, err)
+	}
+}
+
+// TestMigrateFile_YAMLKeepsComments checks YAML files are migrated in place
+// with their comments, and that misspelled properties block the migration.
+func TestMigrateFile_YAMLKeepsComments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "expected_profile.yaml")
+	if err := os.WriteFile(path, []byte(`# the workload sleeps half of the time
+stacks:
+  - profile-type: wall-time
+    error-margin: 5 # CI is noisy
+    stack-content:
+      - regular_expression: ;sleep$
+        percent: 50
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateFile(path, false); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	raw, _ := os.ReadFile(path)
+	for _, want := range []string{"# the workload sleeps half of the time", "# CI is noisy", "schema_version: 2", "error_margin: 5"} {
+		if !strings.Contains(string(raw), want) {
+			t.Errorf("missing %q in migrated YAML:\n%s", want, raw)
+		}
+	}
+	if _, err := ReadJSONFile(path); err != nil {
+		t.Errorf("migrated YAML does not load: %v", err)
+	}
+
+	typo := filepath.Join(dir, "typo.json")
+	if err := os.WriteFile(typo, []byte(`{"stacks": [{"profile-type": "cpu", "stack-content": [{"regular_expresion": "a", "percent": 1}]}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateFile(typo, false); err == nil || !strings.Contains(err.Error(), "regular_expresion") {
+		t.Errorf("expected the misspelled property to be reported, got %v", err)
+	}
+}
+
+// TestMigrateFile_JSONCKeepsComments checks JSON-with-comments files keep
+// their comments next to the members and items they were written by.
+func TestMigrateFile_JSONCKeepsComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expected_profile.jsonc")
+	if err := os.WriteFile(path, []byte(`// the workload sleeps half of the time
+{
+  "stacks": [
+    { // wall time
+      "profile-type": "wall-time",
+      "error-margin": 5, // CI is noisy
+      "stack-content": [
+        /* sleeping */
+        { "regular_expression": ";sleep$", "percent": 50 },
+      ],
+    },
+  ],
+}
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateFile(path, false); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	raw, _ := os.ReadFile(path)
+	want := `// the workload sleeps half of the time
+{
+  "schema_version": 2,
+  "stacks": [
+    { // wall time
+      "profile-type": "wall-time",
+      "error_margin": 5, // CI is noisy
+      "stack-content": [
+        /* sleeping */
+        {
+          "regular_expression": ";sleep$",
+          "percent": 50
+        }
+      ]
+    }
+  ]
+}
+`
+	if string(raw) != want {
+		t.Errorf("migrated JSONC:\n%s\nwant:\n%s", raw, want)
+	}
+	if _, err := ReadJSONFile(path); err != nil {
+		t.Errorf("migrated JSONC does not load: %v", err)
+	}
+}
+
+// TestMigrateFile_ReportsUnknownKeys checks every key the current schema does
+// not define is listed with its line, and that the file is left as is.
+func TestMigrateFile_ReportsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expected_profile.json")
+	doc := `{
+  "test_name": "typos",
+  "stacks": [
+    {
+      "profile-type": "cpu-time",
+      "error-margin": 5,
+      "stack-content": [
+        { "regular_expression": "^main;a$", "percent": 50 },
+        { "regular_expression": "^main;b$", "regular_expression2": ".*", "percent": 50 }
+      ],
+      "valu-matching-sum": 100
+    }
+  ]
+}`
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := MigrateFile(path, false)
+	if err == nil {
+		t.Fatal("expected the unknown keys to be reported")
+	}
+	for _, want := range []string{
+		"line 9: stacks.0.stack-content.1.regular_expression2",
+		"line 11: stacks.0.valu-matching-sum",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+	if raw, _ := os.ReadFile(path); string(raw) != doc {
+		t.Error("a file with unknown keys was rewritten")
+	}
+}
+
+// TestExpectedProfileSchemaIsValidJSON guards the exported editor schema.
+func TestExpectedProfileSchemaIsValidJSON(t *testing.T) {
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(ExpectedProfileSchema()), &schema); err != nil {
+		t.Fatalf("exported schema is not JSON: %v", err)
+	}
+	if schema["additionalProperties"] != false {
+		t.Error("exported schema is not strict")
+	}
+}
@@ -0,0 +1,197 @@
+// V8 adapter: reads V8's own CPU and sampling heap profiles, the Chrome
+// DevTools .cpuprofile and .heapprofile JSON written by node --cpu-prof /
+// --heap-prof or the inspector, into the neutral ProfileSet. Node.js
+// profilers convert these to pprof; reading them directly lets a conversion
+// bug be told apart from a profiling one. Profile types are named as in the
+// pprof of Datadog's Node.js profiler.
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// --- format detection & parsing --------------------------------------------
+
+func isV8CPUProfileName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".cpuprofile")
+}
+
+func isV8HeapProfileName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".heapprofile")
+}
+
+// v8CallFrame is a DevTools Runtime.CallFrame.
+type v8CallFrame struct {
+	FunctionName string `json:"functionName"`
+}
+
+// name is the frame's function name, as Node.js profilers name it in pprof.
+func (f v8CallFrame) name() string {
+	if f.FunctionName == "" {
+		return "(anonymous)"
+	}
+	return f.FunctionName
+}
+
+// v8Root is the name of the root node of V8 profiles, which is not a frame.
+const v8Root = "(root)"
+
+// v8CPUProfile is a DevTools Profiler.Profile. Times are in microseconds.
+type v8CPUProfile struct {
+	Nodes []struct {
+		ID        int64       `json:"id"`
+		CallFrame v8CallFrame `json:"callFrame"`
+		HitCount  int64       `json:"hitCount"`
+		Children  []int64     `json:"children"`
+	} `json:"nodes"`
+	StartTime int64 `json:"startTime"`
+	EndTime   int64 `json:"endTime"`
+	// Samples are the IDs of the leaf node of each sample, TimeDeltas the
+	// time elapsed since the previous sample (since StartTime for the first).
+	Samples    []int64 `json:"samples"`
+	TimeDeltas []int64 `json:"timeDeltas"`
+}
+
+// v8HeapProfile is a DevTools HeapProfiler.SamplingHeapProfile.
+type v8HeapProfile struct {
+	Head    v8HeapNode `json:"head"`
+	Samples []struct {
+		NodeID int64 `json:"nodeId"`
+	} `json:"samples"`
+}
+
+type v8HeapNode struct {
+	ID        int64       `json:"id"`
+	CallFrame v8CallFrame `json:"callFrame"`
+	// SelfSize is the estimated size of the live objects allocated by the
+	// node's function itself, in bytes.
+	SelfSize int64        `json:"selfSize"`
+	Children []v8HeapNode `json:"children"`
+}
+
+// --- conversion ------------------------------------------------------------
+
+// FromV8CPUProfile builds a ProfileSet from a DevTools .cpuprofile: "sample"
+// counts the samples of each stack and "wall" the time until the next sample
+// (the end of the profile for the last one), in nanoseconds. Both last the
+// profile's duration. Profiles without samples, as some tools write them, are
+// read from the hit counts of their nodes, spreading the duration evenly.
+func FromV8CPUProfile(data []byte) (*ProfileSet, error) {
+	var p v8CPUProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("V8 CPU profile: %w", err)
+	}
+	if len(p.Samples) != len(p.TimeDeltas) {
+		return nil, fmt.Errorf("V8 CPU profile: %d samples but %d time deltas", len(p.Samples), len(p.TimeDeltas))
+	}
+	parents := map[int64]int64{}
+	names := map[int64]string{}
+	for _, n := range p.Nodes {
+		names[n.ID] = n.CallFrame.name()
+		for _, c := range n.Children {
+			parents[c] = n.ID
+		}
+	}
+
+	// Values per leaf node, in first-sample order.
+	var leaves []int64
+	counts, wall := map[int64]int64{}, map[int64]int64{}
+	add := func(node, count, micros int64) {
+		if _, seen := counts[node]; !seen {
+			leaves = append(leaves, node)
+		}
+		counts[node] += count
+		wall[node] += max(micros, 0) * 1000
+	}
+	if len(p.Samples) > 0 {
+		t := p.StartTime
+		for i, node := range p.Samples {
+			t += p.TimeDeltas[i]
+			next := p.EndTime
+			if i+1 < len(p.TimeDeltas) {
+				next = t + p.TimeDeltas[i+1]
+			}
+			add(node, 1, next-t)
+		}
+	} else {
+		var hits int64
+		for _, n := range p.Nodes {
+			hits += n.HitCount
+		}
+		for _, n := range p.Nodes {
+			if n.HitCount > 0 {
+				add(n.ID, n.HitCount, (p.EndTime-p.StartTime)*n.HitCount/hits)
+			}
+		}
+	}
+
+	ps := newProfileSet()
+	noLabels := ps.internLabels(nil)
+	var totalCount, totalWall int64
+	for _, node := range leaves {
+		if _, ok := names[node]; !ok {
+			return nil, fmt.Errorf("V8 CPU profile: sample of unknown node %d", node)
+		}
+		var frames []string // leaf-first, reversed below
+		// Bounded by the number of nodes, should children make a cycle.
+		for n, depth := node, 0; depth < len(names); depth++ {
+			if name := names[n]; name != v8Root {
+				frames = append(frames, name)
+			}
+			parent, ok := parents[n]
+			if !ok {
+				break
+			}
+			n = parent
+		}
+		reverse(frames)
+		stack := ps.internStack(strings.Join(frames, ";"))
+		ps.addSample("sample", stack, noLabels, counts[node])
+		ps.addSample("wall", stack, noLabels, wall[node])
+		totalCount += counts[node]
+		totalWall += wall[node]
+	}
+	secs := float64(p.EndTime-p.StartTime) / 1e6
+	ps.addProfileDuration("sample", totalCount, secs)
+	ps.addProfileDuration("wall", totalWall, secs)
+	return ps.finalize(), nil
+}
+
+// FromV8HeapProfile builds a ProfileSet from a DevTools .heapprofile, a
+// snapshot: "space" is the self size of each stack's node, in bytes, as
+// Node.js profilers report it, and "samples" the number of sampled
+// allocations at the node when the profile lists its samples. V8 does not
+// write the object counts it estimates, so there is no "objects" type.
+func FromV8HeapProfile(data []byte) (*ProfileSet, error) {
+	var p v8HeapProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("V8 heap profile: %w", err)
+	}
+	samples := map[int64]int64{}
+	for _, s := range p.Samples {
+		samples[s.NodeID]++
+	}
+
+	ps := newProfileSet()
+	noLabels := ps.internLabels(nil)
+	var walk func(n *v8HeapNode, frames []string)
+	walk = func(n *v8HeapNode, frames []string) {
+		if name := n.CallFrame.name(); name != v8Root {
+			frames = append(frames, name)
+		}
+		if n.SelfSize != 0 || samples[n.ID] != 0 {
+			stack := ps.internStack(strings.Join(frames, ";"))
+			ps.addSample("space", stack, noLabels, n.SelfSize)
+			if len(p.Samples) > 0 {
+				ps.addSample("samples", stack, noLabels, samples[n.ID])
+			}
+		}
+		for i := range n.Children {
+			walk(&n.Children[i], frames[:len(frames):len(frames)])
+		}
+	}
+	walk(&p.Head, nil)
+	return ps.finalize(), nil
+}
@@ -0,0 +1,138 @@
+package analysis
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// v8CPUNodes is the node tree of the test CPU profiles:
+// (root) -> main -> {work, (anonymous)} and (root) -> (idle).
+const v8CPUNodes = `"nodes": [
+	{"id": 1, "callFrame": {"functionName": "(root)", "url": "", "lineNumber": -1}, "children": [2, 5]},
+	{"id": 2, "callFrame": {"functionName": "main", "url": "file:///app/main.js", "lineNumber": 1}, "children": [3, 4]},
+	{"id": 3, "callFrame": {"functionName": "work", "url": "file:///app/main.js", "lineNumber": 10}, "hitCount": 3},
+	{"id": 4, "callFrame": {"functionName": "", "url": "file:///app/main.js", "lineNumber": 20}, "hitCount": 0},
+	{"id": 5, "callFrame": {"functionName": "(idle)", "url": ""}, "hitCount": 1}
+]`
+
+func TestFromV8CPUProfile(t *testing.T) {
+	// Samples at 1010, 1030, 1060 and 1075us, the profile ending at 1100us.
+	ps, err := FromV8CPUProfile([]byte(`{` + v8CPUNodes + `,
+		"startTime": 1000, "endTime": 1100,
+		"samples": [3, 3, 4, 5], "timeDeltas": [10, 20, 30, 15]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for typ, want := range map[string]string{
+		"sample": "main;work=2\nmain;(anonymous)=1\n(idle)=1",
+		"wall":   "main;work=50000\n(idle)=25000\nmain;(anonymous)=15000",
+	} {
+		if got := folded(ps, typ); got != want {
+			t.Errorf("%s:\n%s\nwant:\n%s", typ, got, want)
+		}
+		if d := ps.Duration(typ); d != 0.0001 {
+			t.Errorf("Duration(%s) = %v, want 0.0001", typ, d)
+		}
+	}
+}
+
+func TestFromV8CPUProfile_HitCounts(t *testing.T) {
+	ps, err := FromV8CPUProfile([]byte(`{` + v8CPUNodes + `, "startTime": 1000, "endTime": 1100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for typ, want := range map[string]string{
+		"sample": "main;work=3\n(idle)=1",
+		"wall":   "main;work=75000\n(idle)=25000",
+	} {
+		if got := folded(ps, typ); got != want {
+			t.Errorf("%s:\n%s\nwant:\n%s", typ, got, want)
+		}
+	}
+}
+
+func TestFromV8CPUProfile_Errors(t *testing.T) {
+	cases := map[string]struct{ in, want string }{
+		"json":         {`{"nodes": [`, "V8 CPU profile"},
+		"deltas":       {`{` + v8CPUNodes + `, "samples": [3, 3], "timeDeltas": [10]}`, "2 samples but 1 time deltas"},
+		"unknown node": {`{` + v8CPUNodes + `, "samples": [9], "timeDeltas": [10]}`, "unknown node 9"},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := FromV8CPUProfile([]byte(c.in))
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("err = %v, want %q", err, c.want)
+			}
+		})
+	}
+}
+
+// v8HeapHead is the node tree of the test heap profiles:
+// (root) -> main -> {a 1KiB, b 2KiB}.
+const v8HeapHead = `"head": {"id": 1, "callFrame": {"functionName": "(root)"}, "selfSize": 0, "children": [
+	{"id": 2, "callFrame": {"functionName": "main"}, "selfSize": 0, "children": [
+		{"id": 3, "callFrame": {"functionName": "a"}, "selfSize": 1024, "children": []},
+		{"id": 4, "callFrame": {"functionName": "b"}, "selfSize": 2048, "children": []}
+	]}
+]}`
+
+func TestFromV8HeapProfile(t *testing.T) {
+	ps, err := FromV8HeapProfile([]byte(`{` + v8HeapHead + `, "samples": [
+		{"size": 1024, "nodeId": 3, "ordinal": 1},
+		{"size": 1024, "nodeId": 4, "ordinal": 2},
+		{"size": 1024, "nodeId": 4, "ordinal": 3}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for typ, want := range map[string]string{
+		"space":   "main;b=2048\nmain;a=1024",
+		"samples": "main;b=2\nmain;a=1",
+	} {
+		if got := folded(ps, typ); got != want {
+			t.Errorf("%s:\n%s\nwant:\n%s", typ, got, want)
+		}
+		if d := ps.Duration(typ); d != 0 {
+			t.Errorf("Duration(%s) = %v, want 0 for a snapshot", typ, d)
+		}
+	}
+
+	ps, err = FromV8HeapProfile([]byte(`{` + v8HeapHead + `}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(ps.SampleTypes(), ","); got != "space" {
+		t.Errorf("SampleTypes without samples = %s, want space", got)
+	}
+}
+
+func TestLoadProfileSet_V8(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"wall.cpuprofile":  `{` + v8CPUNodes + `, "startTime": 1000, "endTime": 1100, "samples": [3], "timeDeltas": [10]}`,
+		"heap.heapprofile": `{` + v8HeapHead + `}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ps, err := LoadProfileSet(filepath.Join(dir, "wall.cpuprofile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ps.Total("wall"); got != 90000 {
+		t.Errorf("wall total = %d, want 90000", got)
+	}
+	ps, err = LoadProfileSet(filepath.Join(dir, "heap.heapprofile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ps.Total("space"); got != 3072 {
+		t.Errorf("space total = %d, want 3072", got)
+	}
+	if ps, err = LoadProfileDir(dir); err != nil || !ps.Has("wall") || !ps.Has("space") {
+		t.Errorf("LoadProfileDir: %v, %v", ps, err)
+	}
+}
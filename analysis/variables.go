@@ -0,0 +1,302 @@
+// Expectation variables: an expected_profile.json may declare numeric
+// variables with defaults and use them, with simple arithmetic, in its numeric
+// fields, e.g.
+//
+//	"variables": { "THREADS": 4 },
+//	... "value": "${THREADS} * 1e9"
+//
+// so one expectation serves several parameterizations of the same workload.
+// Defaults are overridden by an environment variable of the same name, which
+// is in turn overridden by explicit values (prof-analyze -var THREADS=8).
+// Expressions are resolved before schema validation, so everything downstream
+// only ever sees plain numbers.
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Numeric fields that accept an expression, per level of the document.
+var (
+	typedStacksNumericFields  = []string{"error_margin", "error-margin", "value_matching_sum", "value-matching-sum"}
+	stackContentNumericFields = []string{"value", "percent", "error_margin"}
+)
+
+// resolveVariables evaluates every expression-valued numeric field of an
+// expected profile document and returns the rewritten document. The
+// "variables" object is rewritten with the effective values so the result is
+// self-describing. Documents without expressions are returned unchanged.
+func resolveVariables(doc []byte, overrides map[string]string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var root map[string]any
+	if err := dec.Decode(&root); err != nil {
+		// Not an object: leave it to schema validation to report.
+		return doc, nil
+	}
+
+	vars, err := effectiveVariables(root["variables"], overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	resolve := func(obj map[string]any, field, path string) error {
+		expr, ok := obj[field].(string)
+		if !ok {
+			return nil
+		}
+		v, err := evalExpr(expr, vars)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", path, field, err)
+		}
+		obj[field] = json.Number(strconv.FormatInt(int64(math.Round(v)), 10))
+		changed = true
+		return nil
+	}
+
+	stacks, _ := root["stacks"].([]any)
+	for i, s := range stacks {
+		typed, ok := s.(map[string]any)
+		if !ok {
+			continue
+		}
+		path := fmt.Sprintf("stacks[%d]", i)
+		for _, f := range typedStacksNumericFields {
+			if err := resolve(typed, f, path); err != nil {
+				return nil, err
+			}
+		}
+		contents, _ := typed["stack-content"].([]any)
+		for j, c := range contents {
+			content, ok := c.(map[string]any)
+			if !ok {
+				continue
+			}
+			for _, f := range stackContentNumericFields {
+				if err := resolve(content, f, fmt.Sprintf("%s.stack-content[%d]", path, j)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// Declared variables are rewritten even when no field uses them, as the
+	// environment may override them.
+	if !changed && len(vars) == 0 {
+		return doc, nil
+	}
+	if len(vars) > 0 {
+		resolved := map[string]any{}
+		for k, v := range vars {
+			resolved[k] = v
+		}
+		root["variables"] = resolved
+	}
+	return json.Marshal(root)
+}
+
+// effectiveVariables applies environment and explicit overrides to the
+// declared defaults. Overriding an undeclared variable is an error, so a typo
+// in -var does not silently do nothing.
+func effectiveVariables(declared any, overrides map[string]string) (map[string]float64, error) {
+	vars := map[string]float64{}
+	if declared != nil {
+		decls, ok := declared.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("'variables' must be an object of name: number")
+		}
+		for name, def := range decls {
+			n, ok := def.(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("variable %s: default must be a number", name)
+			}
+			v, err := n.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("variable %s: %v", name, err)
+			}
+			vars[name] = v
+		}
+	}
+
+	for name := range vars {
+		if s, ok := os.LookupEnv(name); ok {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return nil, fmt.Errorf("variable %s: environment value %q is not a number", name, s)
+			}
+			vars[name] = v
+		}
+	}
+	for name, s := range overrides {
+		if _, ok := vars[name]; !ok {
+			return nil, fmt.Errorf("variable %s is not declared in 'variables'", name)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: value %q is not a number", name, s)
+		}
+		vars[name] = v
+	}
+	return vars, nil
+}
+
+// evalExpr evaluates an arithmetic expression over numbers (including
+// exponent notation such as 1e9), ${NAME} variable references, + - * /,
+// unary minus and parentheses.
+func evalExpr(expr string, vars map[string]float64) (float64, error) {
+	p := exprParser{src: expr, vars: vars}
+	v, err := p.sum()
+	if err != nil {
+		return 0, fmt.Errorf("expression %q: %v", expr, err)
+	}
+	p.skipSpace()
+	if p.pos != len(p.src) {
+		return 0, fmt.Errorf("expression %q: unexpected %q at offset %d", expr, p.src[p.pos:], p.pos)
+	}
+	return v, nil
+}
+
+type exprParser struct {
+	src  string
+	pos  int
+	vars map[string]float64
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space byte, or 0 at the end of input.
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) sum() (float64, error) {
+	v, err := p.product()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '+':
+			p.pos++
+			rhs, err := p.product()
+			if err != nil {
+				return 0, err
+			}
+			v += rhs
+		case '-':
+			p.pos++
+			rhs, err := p.product()
+			if err != nil {
+				return 0, err
+			}
+			v -= rhs
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *exprParser) product() (float64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.peek() {
+		case '*':
+			p.pos++
+			rhs, err := p.unary()
+			if err != nil {
+				return 0, err
+			}
+			v *= rhs
+		case '/':
+			p.pos++
+			rhs, err := p.unary()
+			if err != nil {
+				return 0, err
+			}
+			if rhs == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			v /= rhs
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *exprParser) unary() (float64, error) {
+	if p.peek() == '-' {
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (float64, error) {
+	switch c := p.peek(); {
+	case c == '(':
+		p.pos++
+		v, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing ')' at offset %d", p.pos)
+		}
+		p.pos++
+		return v, nil
+	case c == '$':
+		if !strings.HasPrefix(p.src[p.pos:], "${") {
+			return 0, fmt.Errorf("expected '${' at offset %d", p.pos)
+		}
+		end := strings.IndexByte(p.src[p.pos:], '}')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated variable reference at offset %d", p.pos)
+		}
+		name := p.src[p.pos+2 : p.pos+end]
+		p.pos += end + 1
+		v, ok := p.vars[name]
+		if !ok {
+			return 0, fmt.Errorf("undeclared variable %s", name)
+		}
+		return v, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.src) {
+			ch := p.src[p.pos]
+			isExpSign := (ch == '+' || ch == '-') && p.pos > start && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E')
+			if !(ch == '.' || ch == 'e' || ch == 'E' || (ch >= '0' && ch <= '9') || isExpSign) {
+				break
+			}
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return v, nil
+	case c == 0:
+		return 0, fmt.Errorf("unexpected end of expression")
+	default:
+		return 0, fmt.Errorf("unexpected %q at offset %d", c, p.pos)
+	}
+}
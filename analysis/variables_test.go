@@ -0,0 +1,107 @@
+package analysis
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestEvalExpr covers precedence, parentheses, unary minus, exponent literals
+// and variable references.
+func TestEvalExpr(t *testing.T) {
+	vars := map[string]float64{"THREADS": 4, "RATIO": 0.25}
+	cases := map[string]float64{
+		"42":                        42,
+		"1e9":                       1e9,
+		"2.5E-1":                    0.25,
+		"${THREADS} * 1e9":          4e9,
+		"1 + 2 * 3":                 7,
+		"(1 + 2) * 3":               9,
+		"-${THREADS} + 10":          6,
+		"100 * (1 - ${RATIO})":      75,
+		"${THREADS}/${THREADS} - 1": 0,
+	}
+	for expr, want := range cases {
+		got, err := evalExpr(expr, vars)
+		if err != nil {
+			t.Errorf("evalExpr(%q): %v", expr, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("evalExpr(%q) = %v, want %v", expr, got, want)
+		}
+	}
+
+	for _, bad := range []string{"", "1 +", "(1", "${NOPE}", "${THREADS", "1 / 0", "2 x"} {
+		if _, err := evalExpr(bad, vars); err == nil {
+			t.Errorf("evalExpr(%q): expected an error", bad)
+		}
+	}
+}
+
+// TestReadJSONFileWithVars checks precedence (explicit > env > default) and
+// that resolved values reach the numeric fields and the Variables map.
+func TestReadJSONFileWithVars(t *testing.T) {
+	path := t.TempDir() + "/expected_profile.json"
+	if err := os.WriteFile(path, []byte(`{
+      "variables": { "THREADS": 2, "SLEEP": 0.5 },
+      "stacks": [{
+        "profile-type": "wall-time",
+        "error-margin": "${THREADS} * 5",
+        "stack-content": [
+          { "regular_expression": "^worker$", "value": "${THREADS} * ${SLEEP} * 1e9" }
+        ]
+      }]
+    }`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	value := func(d StackTestData) int64 {
+		v, _ := d.Stacks[0].StackContent[0].Value.Value()
+		return v
+	}
+
+	d, err := ReadJSONFile(path)
+	if err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+	if value(d) != 1e9 || d.Stacks[0].ErrorMargin != 10 {
+		t.Errorf("defaults: value=%d error-margin=%d, want 1e9/10", value(d), d.Stacks[0].ErrorMargin)
+	}
+
+	t.Setenv("THREADS", "4")
+	if d, err = ReadJSONFile(path); err != nil || value(d) != 2e9 || d.Variables["THREADS"] != 4 {
+		t.Errorf("env override: value=%d vars=%v err=%v, want 2e9", value(d), d.Variables, err)
+	}
+
+	if d, err = ReadJSONFileWithVars(path, map[string]string{"THREADS": "8"}); err != nil || value(d) != 4e9 {
+		t.Errorf("explicit override: value=%d err=%v, want 4e9", value(d), err)
+	}
+
+	if _, err = ReadJSONFileWithVars(path, map[string]string{"THREAD": "8"}); err == nil || !strings.Contains(err.Error(), "not declared") {
+		t.Errorf("expected an undeclared-variable error, got %v", err)
+	}
+}
+
+// TestReadJSONFileWithVars_EnvWithoutExpressions checks an environment
+// override reaches the Variables map when no field uses an expression.
+func TestReadJSONFileWithVars_EnvWithoutExpressions(t *testing.T) {
+	path := t.TempDir() + "/expected_profile.json"
+	if err := os.WriteFile(path, []byte(`{
+      "variables": { "THREADS": 2 },
+      "stacks": [{
+        "profile-type": "wall-time",
+        "stack-content": [{ "regular_expression": "^worker$", "percent": 100 }]
+      }]
+    }`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("THREADS", "4")
+	d, err := ReadJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Variables["THREADS"] != 4 {
+		t.Errorf("Variables = %v, want THREADS=4 from the environment", d.Variables)
+	}
+}
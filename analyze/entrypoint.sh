@@ -1,4 +1,8 @@
 #!/bin/bash
 
 cd /app
-go test -v -run TestAnalyze -expectedJson /github/workspace/$INPUT_EXPECTED_JSON -pprofPath /github/workspace/$INPUT_PPROF_PATH
+junit_args=()
+if [ -n "$INPUT_JUNIT_DIR" ]; then
+  junit_args=(-junitDir "/github/workspace/$INPUT_JUNIT_DIR")
+fi
+go test -v -run TestAnalyze -expectedJson /github/workspace/$INPUT_EXPECTED_JSON -pprofPath /github/workspace/$INPUT_PPROF_PATH "${junit_args[@]}"
@@ -11,20 +11,92 @@
 //
 // Usage:
 //
-//	prof-analyze -expectedJson expected_profile.json -pprofPath ./out
+//	prof-analyze -expectedJson expected_profile.json -pprofPath ./out [-var THREADS=8 ...] [-workers N] [-explain] [-color auto|always|never] [-github-annotations]
+//	             [-junit report.xml] [-json report.json] [-html report.html] [-markdown "$GITHUB_STEP_SUMMARY"]
+//	prof-analyze migrate [-check] expected_profile.json [...]
+//	prof-analyze schema > expected_profile.schema.json
+//	prof-analyze lint [-strict] [-var THREADS=8 ...] expected_profile.json [...]
+//	prof-analyze baseline -o baseline.json [-test-name name] <profile file|dir> [...]
+//
+// `migrate` rewrites expectation files to the latest schema_version (with
+// -check it only reports the files needing it, exiting 1 if any do). `schema`
+// prints the JSON Schema of the latest version for editor autocompletion.
+// `lint` statically checks expectation files (regexes compile, percents add
+// up, value-matching-sum entries do not overlap) and exits 1 on errors, or on
+// warnings too with -strict. `baseline` captures the stacks of one or more
+// runs (a directory stands for its profile files), merged, as a baseline a
+// profile type can be compared with (see analysis.Baseline).
+//
+// Each file is parsed once, and -workers (default: the number of CPUs)
+// profile types and files are analyzed concurrently; the output order does
+// not depend on it.
+//
+// -explain lists, after each stack content's assertions, the heaviest distinct
+// stacks its regex matched and those only its labels excluded, with the values
+// of the labels it checks, to catch regexes that over-match. -color controls
+// ANSI colors: by default they are only used on a terminal, and never when
+// NO_COLOR is set.
+// -github-annotations (on by default in GitHub Actions) also prints workflow
+// commands annotating the failing entries of the expectation file.
 package main
 
 import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/DataDog/prof-correctness/analysis"
 )
 
+// varFlags collects repeated -var name=value flags overriding the variables
+// declared in the expected_profile.json.
+type varFlags map[string]string
+
+func (v varFlags) String() string {
+	var parts []string
+	for k, val := range v {
+		parts = append(parts, k+"="+val)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (v varFlags) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", s)
+	}
+	v[name] = value
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(migrate(os.Args[2:]))
+		case "lint":
+			os.Exit(lint(os.Args[2:]))
+		case "baseline":
+			os.Exit(baseline(os.Args[2:]))
+		case "schema":
+			fmt.Println(analysis.ExpectedProfileSchema())
+			return
+		}
+	}
+
 	expectedJSON := flag.String("expectedJson", "", "Path to the expected_profile.json file (required)")
 	pprofPath := flag.String("pprofPath", "", "Path to the directory containing pprof files (required)")
+	vars := varFlags{}
+	flag.Var(vars, "var", "Override a variable declared in the expected_profile.json, as name=value (repeatable)")
+	workers := flag.Int("workers", 0, "Number of profile types and files to analyze concurrently (default the number of CPUs)")
+	explain := flag.Bool("explain", false, "List the stacks and label sets each stack content matched, and those excluded by its labels")
+	color := flag.String("color", "auto", "Color the output: auto (on a terminal, unless NO_COLOR is set), always or never")
+	annotations := flag.Bool("github-annotations", analysis.InGitHubActions(), "Print GitHub Actions annotations pointing at the failing expectation lines (default true in GitHub Actions)")
+	junitPath := flag.String("junit", "", "Also write the results as JUnit XML to this path")
+	jsonPath := flag.String("json", "", "Also write the results as a JSON report (see analysis.Report) to this path")
+	htmlPath := flag.String("html", "", "Also write a self-contained HTML report with flame graphs to this path")
+	markdownPath := flag.String("markdown", "", "Also append a Markdown summary to this path (e.g. $GITHUB_STEP_SUMMARY)")
 	flag.Parse()
 
 	if *expectedJSON == "" || *pprofPath == "" {
@@ -33,11 +105,133 @@ func main() {
 		os.Exit(2)
 	}
 
+	style, err := analysis.ParseStyle(*color)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "prof-analyze:", err)
+		os.Exit(2)
+	}
+
 	r := analysis.NewStdReporter(os.Stdout, os.Stderr)
-	analysis.Run(r, func() {
-		analysis.AnalyzeResults(r, *expectedJSON, *pprofPath)
-	})
-	if r.Failed() {
+	r.Style = style
+	var reporter analysis.Reporter = r
+	if *annotations {
+		reporter = analysis.NewGitHubReporter(r, os.Stdout)
+	}
+	// Errors are reported as they occur and recorded in res.
+	res, _ := analysis.Analyze(*expectedJSON, *pprofPath, analysis.Options{Vars: vars, Reporter: reporter, Explain: *explain, Workers: *workers})
+	if *junitPath != "" {
+		if err := analysis.WriteJUnitFile(*junitPath, res); err != nil {
+			r.Errorf("Error writing JUnit report: %v", err)
+		}
+	}
+	if *jsonPath != "" {
+		if err := analysis.WriteJSONReportFile(*jsonPath, res); err != nil {
+			r.Errorf("Error writing JSON report: %v", err)
+		}
+	}
+	if *htmlPath != "" {
+		if err := analysis.WriteHTMLReportFile(*htmlPath, res); err != nil {
+			r.Errorf("Error writing HTML report: %v", err)
+		}
+	}
+	if *markdownPath != "" {
+		if err := analysis.AppendMarkdownReportFile(*markdownPath, res); err != nil {
+			r.Errorf("Error writing Markdown summary: %v", err)
+		}
+	}
+	r.PrintSummary()
+	if r.Failed() || res.Failed() {
 		os.Exit(1)
 	}
 }
+
+// migrate implements the migrate subcommand and returns the exit code.
+func migrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	check := fs.Bool("check", false, "Only report files that need migrating, without rewriting them")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: prof-analyze migrate [-check] <expected_profile file> [...]")
+		return 2
+	}
+
+	code := 0
+	for _, path := range fs.Args() {
+		changed, err := analysis.MigrateFile(path, *check)
+		switch {
+		case err != nil:
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+		case changed && *check:
+			fmt.Printf("%s: needs migrating to schema_version %d\n", path, analysis.CurrentSchemaVersion)
+			code = 1
+		case changed:
+			fmt.Printf("%s: migrated to schema_version %d\n", path, analysis.CurrentSchemaVersion)
+		}
+	}
+	return code
+}
+
+// lint implements the lint subcommand and returns the exit code.
+func lint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "Exit non-zero on warnings too")
+	vars := varFlags{}
+	fs.Var(vars, "var", "Override a variable declared in the expectation files, as name=value (repeatable)")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: prof-analyze lint [-strict] [-var name=value ...] <expected_profile file> [...]")
+		return 2
+	}
+
+	code := 0
+	for _, path := range fs.Args() {
+		issues, err := analysis.LintFile(path, vars)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+			continue
+		}
+		for _, issue := range issues {
+			fmt.Printf("%s: %s\n", path, issue)
+			if issue.Severity == analysis.LintError || *strict {
+				code = 1
+			}
+		}
+	}
+	return code
+}
+
+// baseline implements the baseline subcommand and returns the exit code.
+func baseline(args []string) int {
+	fs := flag.NewFlagSet("baseline", flag.ExitOnError)
+	out := fs.String("o", "", "Path of the baseline to write, .json or .yaml (required)")
+	testName := fs.String("test-name", "", "test_name of the baseline")
+	_ = fs.Parse(args)
+	if *out == "" || fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: prof-analyze baseline -o baseline.json [-test-name name] <profile file|dir> [...]")
+		return 2
+	}
+
+	var sets []*analysis.ProfileSet
+	for _, path := range fs.Args() {
+		var ps *analysis.ProfileSet
+		info, err := os.Stat(path)
+		if err == nil && info.IsDir() {
+			ps, err = analysis.LoadProfileDir(path)
+		} else if err == nil {
+			ps, err = analysis.LoadProfileSet(path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+		sets = append(sets, ps)
+	}
+	if err := analysis.WriteBaseline(*out, analysis.Merge(sets...), *testName); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Baseline of %d runs stored in %s\n", len(sets), *out)
+	return 0
+}
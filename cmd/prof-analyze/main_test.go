@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/DataDog/prof-correctness/analysis"
 )
 
 // binPath is set by TestMain to point at a freshly-built prof-analyze.
@@ -123,3 +127,306 @@ func TestCLI_MissingExpectedFile(t *testing.T) {
 		t.Fatalf("expected exit 1 on missing expected JSON (Fatalf path), got %d\nstdout: %s\nstderr: %s", code, stdout.String(), stderr.String())
 	}
 }
+
+func TestCLI_VarOverride(t *testing.T) {
+	cases := []struct {
+		args []string
+		want int
+	}{
+		{nil, 0},                                // declared defaults match the fixture
+		{[]string{"-var", "HOT_MS=90"}, 0},      // explicit value, same as default
+		{[]string{"-var", "HOT_MS=50"}, 1},      // overridden expectation no longer matches
+		{[]string{"-var", "NOT_DECLARED=1"}, 1}, // typo in a variable name is reported
+	}
+	for _, tc := range cases {
+		dir := t.TempDir()
+		copyFixturePprof(t, dir)
+		args := append([]string{"-expectedJson", "testdata/expected-vars.json", "-pprofPath", dir}, tc.args...)
+		cmd := exec.Command(binPath, args...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		if code := exitCode(err); code != tc.want {
+			t.Errorf("%v: expected exit %d, got %d\nstdout: %s\nstderr: %s", tc.args, tc.want, code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestCLI_Migrate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "expected_profile.json")
+	if err := os.WriteFile(path, []byte(`{"stacks": [{"profile-type": "cpu-time", "error-margin": 5, "stack-content": [{"regular_expression": "^a$", "percent": 100}]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) int {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(binPath, args...)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		t.Logf("%v\nstdout: %s\nstderr: %s", args, stdout.String(), stderr.String())
+		return exitCode(err)
+	}
+
+	if code := run("migrate", "-check", path); code != 1 {
+		t.Errorf("expected exit 1 for -check on an old file, got %d", code)
+	}
+	if code := run("migrate", path); code != 0 {
+		t.Errorf("expected exit 0 on migrate, got %d", code)
+	}
+	if code := run("migrate", "-check", path); code != 0 {
+		t.Errorf("expected exit 0 for -check on a migrated file, got %d", code)
+	}
+	if code := run("migrate"); code != 2 {
+		t.Errorf("expected exit 2 without files, got %d", code)
+	}
+}
+
+func TestCLI_Schema(t *testing.T) {
+	out, err := exec.Command(binPath, "schema").Output()
+	if err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if !bytes.Contains(out, []byte(`"schema_version"`)) {
+		t.Errorf("schema output missing schema_version:\n%s", out)
+	}
+}
+
+func TestCLI_Lint(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"schema_version": 2, "stacks": [{"profile-type": "cpu-time", "stack-content": [{"regular_expression": "^main;a(", "percent": 50}]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	redundant := filepath.Join(dir, "redundant.json")
+	if err := os.WriteFile(redundant, []byte(`{"schema_version": 2, "pprof-regex": "cpu", "stacks": [{"profile-type": "cpu-time", "pprof-regex": "cpu", "stack-content": [{"regular_expression": "^a$", "percent": 50}]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"lint", filepath.Join("testdata", "expected.json")}, 0},
+		{[]string{"lint", bad}, 1},
+		{[]string{"lint", redundant}, 0},
+		{[]string{"lint", "-strict", redundant}, 1},
+		{[]string{"lint"}, 2},
+	} {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(binPath, tc.args...)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		if code := exitCode(err); code != tc.want {
+			t.Errorf("%v: expected exit %d, got %d\nstdout: %s\nstderr: %s", tc.args, tc.want, code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestCLI_JUnit(t *testing.T) {
+	dir := t.TempDir()
+	copyFixturePprof(t, dir)
+	junitPath := filepath.Join(dir, "reports", "junit.xml")
+	cmd := exec.Command(binPath,
+		"-expectedJson", "testdata/expected-mismatch.json",
+		"-pprofPath", dir,
+		"-junit", junitPath,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if code := exitCode(err); code != 1 {
+		t.Fatalf("expected exit 1 on mismatch, got %d\nstdout: %s\nstderr: %s", code, stdout.String(), stderr.String())
+	}
+	raw, err := os.ReadFile(junitPath)
+	if err != nil {
+		t.Fatalf("JUnit report not written: %v", err)
+	}
+	for _, want := range []string{"<testsuites", "<testcase", "[cpu-time] profile.pprof", "<failure"} {
+		if !bytes.Contains(raw, []byte(want)) {
+			t.Errorf("missing %q in JUnit report:\n%s", want, raw)
+		}
+	}
+}
+
+func TestCLI_JSONReport(t *testing.T) {
+	dir := t.TempDir()
+	copyFixturePprof(t, dir)
+	reportPath := filepath.Join(dir, "report.json")
+	cmd := exec.Command(binPath,
+		"-expectedJson", "testdata/expected.json",
+		"-pprofPath", dir,
+		"-json", reportPath,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("expected exit 0, got %v\nstdout: %s\nstderr: %s", err, stdout.String(), stderr.String())
+	}
+	raw, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("JSON report not written: %v", err)
+	}
+	var report analysis.Report
+	if err := json.Unmarshal(raw, &report); err != nil {
+		t.Fatalf("JSON report does not decode: %v\n%s", err, raw)
+	}
+	if report.Version != analysis.ReportVersion || !report.Passed || len(report.Files) != 1 {
+		t.Fatalf("unexpected report:\n%s", raw)
+	}
+	for _, typ := range report.Files[0].Types {
+		for _, a := range typ.Assertions {
+			if a.Verdict != analysis.VerdictPass || a.Actual == 0 {
+				t.Errorf("unexpected assertion in report: %+v", a)
+			}
+		}
+	}
+}
+
+func TestCLI_HTMLAndMarkdownReports(t *testing.T) {
+	dir := t.TempDir()
+	copyFixturePprof(t, dir)
+	htmlPath := filepath.Join(dir, "report.html")
+	markdownPath := filepath.Join(dir, "summary.md")
+	if err := os.WriteFile(markdownPath, []byte("previous step\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(binPath,
+		"-expectedJson", "testdata/expected.json",
+		"-pprofPath", dir,
+		"-html", htmlPath,
+		"-markdown", markdownPath,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("expected exit 0, got %v\nstdout: %s\nstderr: %s", err, stdout.String(), stderr.String())
+	}
+	html, err := os.ReadFile(htmlPath)
+	if err != nil {
+		t.Fatalf("HTML report not written: %v", err)
+	}
+	if !strings.Contains(string(html), "<svg") {
+		t.Errorf("HTML report has no flame graph:\n%s", html)
+	}
+	md, err := os.ReadFile(markdownPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(md), "previous step\n### ✅ ") {
+		t.Errorf("Markdown summary should be appended:\n%s", md)
+	}
+}
+
+func TestCLI_Explain(t *testing.T) {
+	dir := t.TempDir()
+	copyFixturePprof(t, dir)
+	cmd := exec.Command(binPath,
+		"-expectedJson", "testdata/expected.json",
+		"-pprofPath", dir,
+		"-explain",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("expected exit 0, got %v\nstdout: %s\nstderr: %s", err, stdout.String(), stderr.String())
+	}
+	for _, want := range []string{
+		"Explain '^hot_function$':",
+		"Matched 1 distinct stacks worth 90000000 (90.0% of the profile):",
+		"   90.0%  90000000  hot_function",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("missing %q in output:\n%s", want, stdout.String())
+		}
+	}
+}
+
+func TestCLI_Color(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		ansi bool
+	}{
+		{nil, false}, // auto: stdout is not a terminal
+		{[]string{"-color", "always"}, true},
+		{[]string{"-color", "never"}, false},
+	} {
+		dir := t.TempDir()
+		copyFixturePprof(t, dir)
+		args := append([]string{"-expectedJson", "testdata/expected.json", "-pprofPath", dir}, tt.args...)
+		out, err := exec.Command(binPath, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: expected exit 0, got %v\n%s", tt.args, err, out)
+		}
+		if got := bytes.Contains(out, []byte("\033[32mAssertion succeeded")); got != tt.ansi {
+			t.Errorf("%v: ANSI colors = %v, want %v\n%s", tt.args, got, tt.ansi, out)
+		}
+	}
+
+	cmd := exec.Command(binPath, "-expectedJson", "testdata/expected.json", "-pprofPath", t.TempDir(), "-color", "sometimes")
+	if err := cmd.Run(); err == nil || cmd.ProcessState.ExitCode() != 2 {
+		t.Errorf("expected exit 2 for an unknown -color, got %v", err)
+	}
+}
+
+func TestCLI_GitHubAnnotations(t *testing.T) {
+	cmd := exec.Command(binPath, "-expectedJson", "testdata/expected.json", "-pprofPath", t.TempDir())
+	cmd.Env = append(os.Environ(), "GITHUB_ACTIONS=true")
+	out, err := cmd.Output()
+	if err == nil {
+		t.Fatalf("expected a failure without profiles:\n%s", out)
+	}
+	if !bytes.Contains(out, []byte("\n::error::No matching files found for ")) {
+		t.Errorf("expected an error annotation in GitHub Actions:\n%s", out)
+	}
+}
+
+func TestCLI_ScopesSummary(t *testing.T) {
+	dir := t.TempDir()
+	copyFixturePprof(t, dir)
+	out, err := exec.Command(binPath, "-expectedJson", "testdata/expected.json", "-pprofPath", dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("expected exit 0, got %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"=== RUN   cpu-time/profile.pprof\n",
+		"--- PASS: cpu-samples/profile.pprof (",
+		"Summary:\n",
+		"2 scopes: 2 passed, 0 failed\n",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestCLI_Baseline(t *testing.T) {
+	dir := t.TempDir()
+	copyFixturePprof(t, dir)
+	baselinePath := filepath.Join(dir, "baseline.json")
+	out, err := exec.Command(binPath, "baseline", "-o", baselinePath, dir, filepath.Join(dir, "profile.pprof")).CombinedOutput()
+	if code := exitCode(err); code != 0 {
+		t.Fatalf("baseline: exit %d\n%s", code, out)
+	}
+	if !strings.Contains(string(out), "Baseline of 2 runs stored in "+baselinePath) {
+		t.Errorf("baseline output:\n%s", out)
+	}
+
+	expected := filepath.Join(dir, "expected.json")
+	if err := os.WriteFile(expected, []byte(`{
+  "schema_version": 2,
+  "stacks": [{ "profile-type": "cpu-time", "baseline": { "file": "baseline.json", "max_distance": 1 } }]
+}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = exec.Command(binPath, "-expectedJson", expected, "-pprofPath", dir, "-github-annotations=false").CombinedOutput()
+	if code := exitCode(err); code != 0 {
+		t.Fatalf("analyze: exit %d\n%s", code, out)
+	}
+	if !strings.Contains(string(out), "Assertion succeeded: profile 'cpu-time' is within 1% of the baseline (distance was 0.0%)") {
+		t.Errorf("analyze output:\n%s", out)
+	}
+
+	if err := exec.Command(binPath, "baseline", dir).Run(); exitCode(err) != 2 {
+		t.Errorf("baseline without -o: exit %d, want 2", exitCode(err))
+	}
+}
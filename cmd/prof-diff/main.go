@@ -0,0 +1,120 @@
+// Command prof-diff compares a baseline profile with a candidate, e.g. the same
+// scenario profiled by profiler releases N and N+1, and reports how the value
+// of each stack and label changed, absolutely and as a share of its profile
+// type.
+//
+// Exit codes:
+//
+//	0  no threshold exceeded
+//	1  a threshold was exceeded
+//	2  usage error, or a profile could not be loaded
+//
+// Usage:
+//
+//	go run ./cmd/prof-diff [-n 10] [-json] [-normalize=false] [-max-total-change pct] [-max-distance pct] [-max-share-delta pp]
+//	                       <baseline file|dir> <candidate file|dir>
+//
+// A directory stands for all its profile files merged. Frames are normalized
+// before stacks are aligned (see analysis.NormalizeFrame) unless -normalize
+// is false. Labels whose values change every run (thread, span and trace IDs,
+// timestamps) are not compared. -max-total-change fails on a profile type
+// whose total value changed by more than pct percent; -max-distance on one
+// whose total-variation distance (the share of the profile that moved between
+// stacks) is more than pct percent; -max-share-delta on a stack or label value
+// whose share of its profile type moved by more than pp percentage points.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/DataDog/prof-correctness/analysis"
+)
+
+func main() {
+	n := flag.Int("n", 10, "stacks and label values to print per profile type, in text output")
+	asJSON := flag.Bool("json", false, "print the whole diff as JSON (see analysis.ProfileDiff)")
+	normalize := flag.Bool("normalize", true, "normalize addresses, lambda/closure numbers and line numbers in frames before aligning stacks")
+	maxTotalChange := flag.Float64("max-total-change", 0, "exit 1 if a profile type's total value changed by more than this percent")
+	maxDistance := flag.Float64("max-distance", 0, "exit 1 if a profile type's total-variation distance is more than this percent")
+	maxShareDelta := flag.Float64("max-share-delta", 0, "exit 1 if a stack's or label value's share of its profile type moved by more than these percentage points")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: prof-diff [flags] <baseline file|dir> <candidate file|dir>")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var sets [2]*analysis.ProfileSet
+	for i, path := range flag.Args() {
+		ps, err := load(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "prof-diff: %s: %v\n", path, err)
+			os.Exit(2)
+		}
+		sets[i] = ps
+	}
+	var opts analysis.DiffOptions
+	if *normalize {
+		opts.Normalize = analysis.NormalizeFrame
+	}
+	d := analysis.Diff(sets[0], sets[1], opts)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(d); err != nil {
+			fmt.Fprintln(os.Stderr, "prof-diff:", err)
+			os.Exit(2)
+		}
+	} else {
+		printDiff(os.Stdout, d, *n)
+	}
+
+	exceeded := d.Exceeded(analysis.DiffThresholds{MaxTotalChange: *maxTotalChange, MaxDistance: *maxDistance, MaxShareDelta: *maxShareDelta})
+	for _, msg := range exceeded {
+		fmt.Fprintln(os.Stderr, "prof-diff:", msg)
+	}
+	if len(exceeded) > 0 {
+		os.Exit(1)
+	}
+}
+
+// load loads a profile file, or the profile files of a directory merged.
+func load(path string) (*analysis.ProfileSet, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return analysis.LoadProfileDir(path)
+	}
+	return analysis.LoadProfileSet(path)
+}
+
+func printDiff(w io.Writer, d *analysis.ProfileDiff, n int) {
+	for _, t := range d.Types {
+		fmt.Fprintf(w, "== %s: %s ==\n", t.ProfileType, t.Total.FormatChange())
+		if len(t.Stacks) == 0 && len(t.Labels) == 0 {
+			fmt.Fprintln(w, "  no change")
+		} else {
+			fmt.Fprintf(w, "  distance: %.1f%%\n", t.Distance)
+		}
+		if len(t.Stacks) > 0 {
+			fmt.Fprintf(w, "  stacks (%d changed):\n", len(t.Stacks))
+			for _, s := range t.Stacks[:min(n, len(t.Stacks))] {
+				fmt.Fprintf(w, "    %s  %s\n      %s\n", s.FormatShare(), s.FormatChange(), s.Stack)
+			}
+		}
+		if len(t.Labels) > 0 {
+			fmt.Fprintf(w, "  labels (%d changed):\n", len(t.Labels))
+			for _, l := range t.Labels[:min(n, len(t.Labels))] {
+				fmt.Fprintf(w, "    %s  %s  %s=%s\n", l.FormatShare(), l.FormatChange(), l.Key, l.Values)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
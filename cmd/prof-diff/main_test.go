@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/DataDog/prof-correctness/analysis"
+)
+
+// binPath is set by TestMain to point at a freshly-built prof-diff.
+var binPath string
+
+func TestMain(m *testing.M) {
+	tmp, err := os.MkdirTemp("", "prof-diff-test-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mkdtemp: %v\n", err)
+		os.Exit(2)
+	}
+	defer os.RemoveAll(tmp)
+
+	binPath = filepath.Join(tmp, "prof-diff")
+	build := exec.Command("go", "build", "-o", binPath, ".")
+	build.Stderr = os.Stderr
+	build.Stdout = os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "build prof-diff: %v\n", err)
+		os.Exit(2)
+	}
+	os.Exit(m.Run())
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	return -1
+}
+
+// writePprof writes a one-type pprof with the given folded stacks to path.
+func writePprof(t *testing.T, path string, stacks map[string]int64) {
+	t.Helper()
+	p := &profile.Profile{SampleType: []*profile.ValueType{{Type: "cpu", Unit: "count"}}}
+	locs := map[string]*profile.Location{}
+	for stack, v := range stacks {
+		frames := strings.Split(stack, ";")
+		var sample []*profile.Location
+		for i := len(frames) - 1; i >= 0; i-- { // leaf first
+			loc := locs[frames[i]]
+			if loc == nil {
+				fn := &profile.Function{ID: uint64(len(locs) + 1), Name: frames[i]}
+				loc = &profile.Location{ID: fn.ID, Line: []profile.Line{{Function: fn}}}
+				locs[frames[i]] = loc
+				p.Function = append(p.Function, fn)
+				p.Location = append(p.Location, loc)
+			}
+			sample = append(sample, loc)
+		}
+		p.Sample = append(p.Sample, &profile.Sample{Location: sample, Value: []int64{v}})
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// baselineAndCandidate writes a baseline file and a candidate directory of
+// two files, and returns their paths.
+func baselineAndCandidate(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.pprof")
+	writePprof(t, base, map[string]int64{"main;work.func1": 60, "main;idle": 40})
+	candidate := filepath.Join(dir, "candidate")
+	if err := os.Mkdir(candidate, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writePprof(t, filepath.Join(candidate, "worker1.pprof"), map[string]int64{"main;work.func2": 40, "main;idle": 10})
+	writePprof(t, filepath.Join(candidate, "worker2.pprof"), map[string]int64{"main;work.func2": 40, "main;idle": 10})
+	return base, candidate
+}
+
+func TestCLI_Text(t *testing.T) {
+	base, candidate := baselineAndCandidate(t)
+	out, err := exec.Command(binPath, base, candidate).CombinedOutput()
+	if code := exitCode(err); code != 0 {
+		t.Fatalf("exit %d, want 0\n%s", code, out)
+	}
+	for _, want := range []string{
+		"== cpu: 100 -> 100 (+0.0%) ==",
+		"distance: 20.0%",
+		"stacks (2 changed):",
+		"60.00% -> 80.00% (+20.00pp)  60 -> 80 (+33.3%)\n      main;work.func\n",
+		"40.00% -> 20.00% (-20.00pp)  40 -> 20 (-50.0%)\n      main;idle\n",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestCLI_JSONAndThresholds(t *testing.T) {
+	base, candidate := baselineAndCandidate(t)
+	out, err := exec.Command(binPath, "-json", "-normalize=false", "-max-share-delta", "10", base, candidate).Output()
+	if code := exitCode(err); code != 1 {
+		t.Fatalf("exit %d, want 1 (share moved by 20pp)\n%s", code, out)
+	}
+	var d analysis.ProfileDiff
+	if err := json.Unmarshal(out, &d); err != nil {
+		t.Fatalf("unmarshal: %v\n%s", err, out)
+	}
+	if len(d.Types) != 1 || len(d.Types[0].Stacks) != 3 {
+		t.Fatalf("diff = %+v, want 3 unaligned stacks without normalization", d)
+	}
+
+	if out, err := exec.Command(binPath, "-max-share-delta", "25", "-max-total-change", "1", base, candidate).CombinedOutput(); exitCode(err) != 0 {
+		t.Errorf("exit %d, want 0 within thresholds\n%s", exitCode(err), out)
+	}
+}
+
+func TestCLI_Usage(t *testing.T) {
+	if err := exec.Command(binPath, "only-one").Run(); exitCode(err) != 2 {
+		t.Errorf("exit %d, want 2", exitCode(err))
+	}
+	if err := exec.Command(binPath, "missing.pprof", "missing.pprof").Run(); exitCode(err) != 2 {
+		t.Errorf("exit %d, want 2 for a missing file", exitCode(err))
+	}
+}
@@ -5,63 +5,160 @@
 //
 // Usage:
 //
-//	go run ./cmd/prof-dump [-n 5] <file.otlp|file.pprof> [more files...]
+//	go run ./cmd/prof-dump [-n 5] [-merge] [-filter re] [-exclude re] [-focus frame] [-scale f]
+//	                       [-subtract base.pprof] [-group-by label] <file.otlp|file.pprof> [more files...]
 //
-//	-n   number of sample lines to print per profile type (default 5)
+//	-n         number of sample lines to print per profile type (default 5)
+//	-merge     dump all the files merged into one profile
+//	-filter    keep only the samples whose folded stack matches the regex
+//	-exclude   drop the samples whose folded stack matches the regex
+//	-focus     keep the samples with this frame, re-rooted at it
+//	-scale     multiply the values by this factor
+//	-subtract  subtract this profile, transformed the same way, from each one
+//	-group-by  dump the samples of each value of this label separately
+//
+// The operations are those of analysis.ProfileSet, applied in this order.
 package main
 
 import (
 	"flag"
 	"fmt"
 	"os"
+	"regexp"
 	"sort"
 
 	"github.com/DataDog/prof-correctness/analysis"
 )
 
+// transforms are the operations applied to every dumped profile.
+type transforms struct {
+	filter, exclude *regexp.Regexp
+	focus           string
+	scale           float64
+}
+
+func (t transforms) apply(ps *analysis.ProfileSet) *analysis.ProfileSet {
+	if t.filter != nil {
+		ps = ps.Filter(func(_ string, s analysis.StackSample) bool { return t.filter.MatchString(s.Stack) })
+	}
+	if t.exclude != nil {
+		ps = ps.Filter(func(_ string, s analysis.StackSample) bool { return !t.exclude.MatchString(s.Stack) })
+	}
+	if t.focus != "" {
+		ps = ps.FocusOn(t.focus)
+	}
+	if t.scale != 0 {
+		ps = ps.Scale(t.scale)
+	}
+	return ps
+}
+
 func main() {
 	n := flag.Int("n", 5, "sample lines to print per profile type")
+	merge := flag.Bool("merge", false, "dump all the files merged into one profile")
+	filter := flag.String("filter", "", "keep only the samples whose folded stack matches this regex")
+	exclude := flag.String("exclude", "", "drop the samples whose folded stack matches this regex")
+	focus := flag.String("focus", "", "keep the samples with this frame, re-rooted at it")
+	scale := flag.Float64("scale", 0, "multiply the values by this factor")
+	subtract := flag.String("subtract", "", "subtract this profile, transformed the same way, from each one")
+	groupBy := flag.String("group-by", "", "dump the samples of each value of this label separately")
 	flag.Parse()
 	if flag.NArg() == 0 {
-		fmt.Fprintln(os.Stderr, "usage: prof-dump [-n N] <profile-file> [...]")
+		fmt.Fprintln(os.Stderr, "usage: prof-dump [flags] <profile-file> [...]")
+		flag.PrintDefaults()
 		os.Exit(2)
 	}
+	t := transforms{focus: *focus, scale: *scale}
+	for _, f := range []struct {
+		flag string
+		re   **regexp.Regexp
+	}{{*filter, &t.filter}, {*exclude, &t.exclude}} {
+		if f.flag == "" {
+			continue
+		}
+		re, err := regexp.Compile(f.flag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "prof-dump:", err)
+			os.Exit(2)
+		}
+		*f.re = re
+	}
+
+	var base *analysis.ProfileSet
+	if *subtract != "" {
+		ps, err := analysis.LoadProfileSet(*subtract)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "prof-dump: %s: %v\n", *subtract, err)
+			os.Exit(1)
+		}
+		base = t.apply(ps)
+	}
+
+	type named struct {
+		name string
+		ps   *analysis.ProfileSet
+	}
+	var sets []named
 	for _, path := range flag.Args() {
-		dump(path, *n)
+		ps, err := analysis.LoadProfileSet(path)
+		if err != nil {
+			fmt.Printf("%s: ERROR %v\n\n", path, err)
+			continue
+		}
+		sets = append(sets, named{path, ps})
+	}
+	if *merge && len(sets) > 0 {
+		all := make([]*analysis.ProfileSet, len(sets))
+		for i, s := range sets {
+			all[i] = s.ps
+		}
+		sets = []named{{fmt.Sprintf("%d files merged", len(sets)), analysis.Merge(all...)}}
+	}
+	for _, s := range sets {
+		ps := t.apply(s.ps)
+		name := s.name
+		if base != nil {
+			ps = ps.Subtract(base)
+			name += " - " + *subtract
+		}
+		if *groupBy == "" {
+			dump(name, ps, *n)
+			continue
+		}
+		groups := ps.GroupBy(*groupBy)
+		keys := make([]string, 0, len(groups))
+		for k := range groups {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			dump(fmt.Sprintf("%s [%s=%s]", name, *groupBy, k), groups[k], *n)
+		}
 	}
 }
 
-func dump(path string, n int) {
-	ps, err := analysis.LoadProfileSet(path)
-	if err != nil {
-		fmt.Printf("%s: ERROR %v\n\n", path, err)
-		return
-	}
-	fmt.Printf("== %s ==\n", path)
+func dump(name string, ps *analysis.ProfileSet, n int) {
+	fmt.Printf("== %s ==\n", name)
 	for _, t := range ps.SampleTypes() {
-		samples, _ := ps.Samples(t)
-
-		var total int64
 		labelKeys := map[string]struct{}{}
-		for _, s := range samples {
-			total += s.Val
+		for s := range ps.All(t) {
 			for k := range s.Labels {
 				labelKeys[k] = struct{}{}
 			}
 		}
 
 		fmt.Printf("\n  profile-type=%q  samples=%d  total-value=%d  duration=%.2fs\n",
-			t, len(samples), total, ps.Duration(t))
+			t, ps.Len(t), ps.Total(t), ps.Duration(t))
 		fmt.Printf("  label-keys observed: %v\n", sortedKeys(labelKeys))
 
-		limit := n
-		if limit > len(samples) {
-			limit = len(samples)
-		}
-		for i := 0; i < limit; i++ {
-			s := samples[i]
+		i := 0
+		for s := range ps.All(t) {
+			if i == n {
+				break
+			}
 			fmt.Printf("    [%d] val=%d labels=%s\n", i, s.Val, fmtLabels(s.Labels))
 			fmt.Printf("        stack: %s\n", s.Stack)
+			i++
 		}
 	}
 	fmt.Println()
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -56,7 +57,7 @@ func testScenarios(t *testing.T, scenarioRegexp string) {
 			tag := buildTestApp(t, config)
 			t.Log("Built test app with:", tag)
 			pprof_folder := runTestApp(t, tag, config.folder)
-			analysis.AnalyzeResults(t, config.jsonFilePath, pprof_folder)
+			analyzeResults(t, config.jsonFilePath, pprof_folder, filepath.Base(config.folder), true)
 		})
 	}
 }
@@ -64,11 +65,48 @@ func testScenarios(t *testing.T, scenarioRegexp string) {
 var (
 	expectedJson = flag.String("expectedJson", "default.json", "Path to the expected JSON file")
 	pprofPath    = flag.String("pprofPath", "./", "Path to the directory with the pprof")
+	junitDir     = flag.String("junitDir", os.Getenv("JUNIT_DIR"), "Directory to write a JUnit XML report per scenario to (default $JUNIT_DIR)")
 )
 
+// analyzeResults asserts the profiles in pprofFolder against the expectations
+// like analysis.AnalyzeResults, and writes the results to <junitDir>/<name>.xml
+// when -junitDir is set. Unless writeHTML is false, an HTML report is written
+// next to the profiles (report.html), which CI uploads with them on failure;
+// on GitHub Actions a Markdown summary is also added to the job summary.
+func analyzeResults(t *testing.T, jsonFilePath string, pprofFolder string, name string, writeHTML bool) {
+	var r analysis.Reporter = t
+	if analysis.InGitHubActions() {
+		// Point failures at their line in the expectation file.
+		r = analysis.NewGitHubReporter(t, os.Stdout)
+	}
+	res, err := analysis.Analyze(jsonFilePath, pprofFolder, analysis.Options{Reporter: r})
+	if *junitDir != "" {
+		if err := analysis.WriteJUnitFile(filepath.Join(*junitDir, name+".xml"), res); err != nil {
+			t.Errorf("Error writing JUnit report: %v", err)
+		}
+	}
+	if writeHTML {
+		htmlPath := filepath.Join(pprofFolder, "report.html")
+		if err := analysis.WriteHTMLReportFile(htmlPath, res); err != nil {
+			t.Errorf("Error writing HTML report: %v", err)
+		} else {
+			t.Log("HTML report written to", htmlPath)
+		}
+	}
+	if summary := os.Getenv("GITHUB_STEP_SUMMARY"); summary != "" {
+		if err := analysis.AppendMarkdownReportFile(summary, res); err != nil {
+			t.Errorf("Error writing job summary: %v", err)
+		}
+	}
+	if err != nil {
+		// Each error has been reported already.
+		t.FailNow()
+	}
+}
+
 func TestAnalyze(t *testing.T) {
 	flag.Parse()
-	analysis.AnalyzeResults(t, *expectedJson, *pprofPath)
+	analyzeResults(t, *expectedJson, *pprofPath, "analyze", false)
 }
 
 func TestDDProfScenarios(t *testing.T) {
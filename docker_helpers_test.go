@@ -11,6 +11,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/DataDog/prof-correctness/analysis"
 )
 
 var (
@@ -57,13 +59,13 @@ func findDockerConfigs(rootDir string, t *testing.T, scenarioRegexp string) ([]D
 			return nil
 		}
 
-		// check if the file is a JSON file or a Dockerfile
-		if filepath.Base(path) == "expected_profile.json" {
+		// check if the file holds the expectations (JSON, JSONC or YAML) or is a Dockerfile
+		if analysis.IsExpectationFile(path) {
 			jsonFilePath = path
 		} else if filepath.Base(path) == "Dockerfile" {
 			dockerfilePath = path
 		} else {
-			// skip files that are not JSON or Dockerfiles
+			// skip files that are not expectations or Dockerfiles
 			return nil
 		}
 		// if we have both a JSON file and a Dockerfile, create a Config instance
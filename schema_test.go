@@ -144,7 +144,7 @@ func TestSchemaValidation_AllExistingProfiles(t *testing.T) {
 		if err != nil {
 			return err
 		}
-		if info.Name() == "expected_profile.json" {
+		if analysis.IsExpectationFile(path) {
 			jsonFiles = append(jsonFiles, path)
 		}
 		return nil
@@ -167,3 +167,63 @@ func TestSchemaValidation_AllExistingProfiles(t *testing.T) {
 		})
 	}
 }
+
+// TestSchemaValidation_AllExistingProfilesMigrate checks every scenario's
+// expectations migrate cleanly to the strict current schema_version, which
+// catches misspelled properties the lax version 1 schema silently ignores.
+func TestSchemaValidation_AllExistingProfilesMigrate(t *testing.T) {
+	scenariosDir := "scenarios"
+	if _, err := os.Stat(scenariosDir); os.IsNotExist(err) {
+		t.Skip("scenarios directory not found")
+	}
+
+	err := filepath.Walk(scenariosDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if analysis.IsExpectationFile(path) {
+			t.Run(path, func(t *testing.T) {
+				if _, err := analysis.MigrateFile(path, true); err != nil {
+					t.Errorf("Migration failed: %v", err)
+				}
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk scenarios directory: %v", err)
+	}
+}
+
+// TestSchemaValidation_AllExistingProfilesLint checks no scenario's
+// expectations have lint errors (bad regexes, contradictory percents,
+// double-counted value-matching-sum entries).
+func TestSchemaValidation_AllExistingProfilesLint(t *testing.T) {
+	scenariosDir := "scenarios"
+	if _, err := os.Stat(scenariosDir); os.IsNotExist(err) {
+		t.Skip("scenarios directory not found")
+	}
+
+	err := filepath.Walk(scenariosDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if analysis.IsExpectationFile(path) {
+			t.Run(path, func(t *testing.T) {
+				issues, err := analysis.LintFile(path, nil)
+				if err != nil {
+					t.Fatalf("Lint failed: %v", err)
+				}
+				for _, issue := range issues {
+					if issue.Severity == analysis.LintError {
+						t.Error(issue)
+					}
+				}
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk scenarios directory: %v", err)
+	}
+}